@@ -16,10 +16,21 @@ import (
 	"github.com/fvbock/endless"
 	"github.com/gorilla/mux"
 	"github.com/terraform-provider-ibm-api/utils"
-	mgo "gopkg.in/mgo.v2"
 )
 
 var staticContent = flag.String("staticPath", "./swagger/swagger-ui", "Path to folder with Swagger UI")
+var storeKind = flag.String("store", "mongo", "Where to keep the action records: mongo, file or memory")
+var mongoURL = flag.String("mongoURL", "localhost", "MongoDB server to use with -store=mongo")
+var workers = flag.Int("workers", 2, "Number of terraform actions that can run at the same time")
+var authConfig = flag.String("authConfig", "", "File with the API keys and JWT keys allowed to call the API, no authentication if empty")
+var tenants = flag.String("tenants", "", "File with the tenants allowed and their quotas, any tenant is allowed if empty")
+var masterKey = flag.String("masterKey", "", "File with the base64 encoded 32 byte key the stored secrets are encrypted with, no secrets can be stored if empty")
+var backendURL = flag.String("backendURL", "", "URL terraform reaches this server at to keep its state in the action store, local state files if empty")
+var driftInterval = flag.Duration("driftInterval", 0, "How often every configuration is checked for drift with a refresh-only plan, never if 0")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 5*time.Minute, "How long the running actions have to finish when the server stops before they are cancelled")
+var smtpAddr = flag.String("smtpAddr", "", "SMTP server, host:port, the emails of the notification channels are sent through, no email if empty. The credentials are read from SMTP_USERNAME and SMTP_PASSWORD")
+var smtpFrom = flag.String("smtpFrom", "terraform@localhost", "Sender of the emails of the notification channels")
+var publicURL = flag.String("publicURL", "", "URL this server is reached at, for the log links of the actions it starts itself, http://localhost:<port> if empty")
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	isJsonRequest := false
@@ -52,18 +63,68 @@ func ApiDescriptionHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
-	session, err := mgo.Dial("localhost")
+	var port int
+	flag.IntVar(&port, "p", 9080, "Port on which this server listens")
+	flag.Parse()
+
+	if *authConfig != "" {
+		err := utils.SetupAuth(*authConfig)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		log.Println("No -authConfig given, the API is open to anyone")
+	}
+
+	if *tenants != "" {
+		err := utils.SetupTenants(*tenants)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *masterKey != "" {
+		err := utils.SetupMasterKey(*masterKey)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		log.Println("No -masterKey given, webhooks, git credentials and sensitive variables cannot be stored")
+	}
+
+	if *smtpAddr != "" {
+		err := utils.SetupSMTP(*smtpAddr, *smtpFrom)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *backendURL != "" {
+		err := utils.SetupStateBackend(*backendURL)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	store, err := utils.NewActionStore(*storeKind, *mongoURL)
 	if err != nil {
 		panic(err)
 	}
-	defer session.Close()
+	defer store.Close()
 
-	session.SetMode(mgo.Monotonic, true)
-	ensureIndex(session)
+	utils.StartWorkers(store, *workers)
+
+	if *publicURL != "" {
+		utils.SetPublicURL(*publicURL)
+	} else {
+		utils.SetPublicURL(fmt.Sprintf("http://localhost:%d", port))
+	}
+	if *driftInterval > 0 {
+		utils.StartDriftDetection(store, *driftInterval)
+	}
+	utils.StartScheduler(store)
+	utils.StartWebhookDeliveries(store)
 
-	var port int
-	flag.IntVar(&port, "p", 9080, "Port on which this server listens")
-	flag.Parse()
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", IndexHandler)
@@ -75,48 +136,109 @@ func main() {
 		r.HandleFunc("/"+apiKey, ApiDescriptionHandler)
 	}
 
-	r.HandleFunc("/v1/configuration", utils.ConfHandler(session)).Methods("POST")
+	r.HandleFunc("/v1/configuration", utils.Authorize(utils.RoleApplier, utils.ConfHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration", utils.Authorize(utils.RoleViewer, utils.ConfListHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}", utils.Authorize(utils.RoleViewer, utils.ConfGetHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}", utils.Authorize(utils.RoleApplier, utils.ConfPatchHandler(store))).Methods("PATCH")
+
+	r.HandleFunc("/v1/configuration/{repo_name}", utils.Authorize(utils.RoleAdmin, utils.ConfDeleteHandler(store))).Methods("DELETE")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/variables", utils.Authorize(utils.RoleViewer, utils.VariablesHandler(store))).Methods("GET")
 
-	r.HandleFunc("/v1/configuration/{repo_name}", utils.ConfDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/v1/configuration/{repo_name}/outputs", utils.Authorize(utils.RoleViewer, utils.OutputsHandler(store))).Methods("GET")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/plan", utils.PlanHandler(session)).Methods("POST")
+	r.HandleFunc("/v1/configuration/{repo_name}/state/versions", utils.Authorize(utils.RoleViewer, utils.StateVersionsHandler(store))).Methods("GET")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/show", utils.ShowHandler(session)).Methods("POST")
+	r.HandleFunc("/v1/configuration/{repo_name}/state/versions/{version_id}", utils.Authorize(utils.RoleAdmin, utils.StateVersionHandler(store))).Methods("GET")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/apply", utils.ApplyHandler(session)).Methods("POST")
+	r.HandleFunc("/v1/configuration/{repo_name}/state/versions/{version_id}/restore", utils.Authorize(utils.RoleAdmin, utils.RestoreStateHandler(store))).Methods("POST")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/destroy", utils.DestroyHandler(session)).Methods("POST")
+	r.HandleFunc("/v1/state/{config}", utils.AuthorizeState(utils.StateBackendHandler(store))).Methods("GET", "POST", "DELETE", "LOCK", "UNLOCK")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/log", utils.LogHandler).Methods("GET")
+	r.HandleFunc("/v1/configuration/{repo_name}/expiry/extend", utils.Authorize(utils.RoleApplier, utils.ExtendHandler(store))).Methods("POST")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/status", utils.StatusHandler(session)).Methods("GET")
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks", utils.Authorize(utils.RoleViewer, utils.WebhooksHandler(store))).Methods("GET")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{log_file}", utils.ViewLogHandler)
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks", utils.Authorize(utils.RoleApplier, utils.CreateWebhookHandler(store))).Methods("POST")
 
-	r.HandleFunc("/v1/configuration/{repo_name}/{action}", utils.GetActionDetailsHandler(session)).Methods("GET")
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks/{webhook_id}", utils.Authorize(utils.RoleViewer, utils.WebhookHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks/{webhook_id}", utils.Authorize(utils.RoleApplier, utils.UpdateWebhookHandler(store))).Methods("PATCH")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks/{webhook_id}", utils.Authorize(utils.RoleApplier, utils.DeleteWebhookHandler(store))).Methods("DELETE")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/webhooks/{webhook_id}/deliveries", utils.Authorize(utils.RoleViewer, utils.WebhookDeliveriesHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/schedules", utils.Authorize(utils.RoleViewer, utils.SchedulesHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/schedules", utils.Authorize(utils.RoleApplier, utils.CreateScheduleHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/schedules/{schedule_id}", utils.Authorize(utils.RoleViewer, utils.ScheduleHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/schedules/{schedule_id}", utils.Authorize(utils.RoleApplier, utils.UpdateScheduleHandler(store))).Methods("PATCH")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/schedules/{schedule_id}", utils.Authorize(utils.RoleApplier, utils.DeleteScheduleHandler(store))).Methods("DELETE")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/lock", utils.Authorize(utils.RoleViewer, utils.LockHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/lock", utils.Authorize(utils.RoleAdmin, utils.UnlockHandler(store))).Methods("DELETE")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/approval", utils.Authorize(utils.RoleViewer, utils.ApprovalPolicyHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/approval", utils.Authorize(utils.RoleAdmin, utils.SetApprovalPolicyHandler(store))).Methods("PUT")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/plan", utils.Authorize(utils.RolePlanner, utils.PlanHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/show", utils.Authorize(utils.RolePlanner, utils.ShowHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/drift", utils.Authorize(utils.RolePlanner, utils.DriftHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/apply", utils.Authorize(utils.RoleApplier, utils.ApplyHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/destroy", utils.Authorize(utils.RoleApplier, utils.DestroyHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/plan/{actionID}/changes", utils.Authorize(utils.RoleViewer, utils.PlanChangesHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/log", utils.Authorize(utils.RoleViewer, utils.LogHandler)).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/log/stream", utils.Authorize(utils.RoleViewer, utils.LogStreamHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/status", utils.Authorize(utils.RoleViewer, utils.StatusHandler(store))).Methods("GET")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/cancel", utils.Authorize(utils.RolePlanner, utils.CancelHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/approve", utils.Authorize(utils.RoleApplier, utils.ApproveHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{actionID}/reject", utils.Authorize(utils.RoleApplier, utils.RejectHandler(store))).Methods("POST")
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}/{log_file}", utils.Authorize(utils.RoleViewer, utils.ViewLogHandler))
+
+	r.HandleFunc("/v1/configuration/{repo_name}/{action}", utils.Authorize(utils.RoleViewer, utils.GetActionDetailsHandler(store))).Methods("GET")
 
 	fmt.Println("Server will listen at port", port)
 	muxWithMiddlewares := http.TimeoutHandler(r, time.Second*60, "Timeout!")
-	err = endless.ListenAndServe(fmt.Sprintf(":%d", port), muxWithMiddlewares)
+	err = endless.ListenAndServe(fmt.Sprintf(":%d", port), withoutTimeout(r, muxWithMiddlewares))
 	if err != nil {
 		fmt.Printf("Couldn't start the server %v", err)
 	}
+
+	// The server stopped or handed over to a restarted one, the actions
+	// running here end before the process does
+	log.Println("Waiting for the running actions")
+	utils.StopWorkers(*shutdownTimeout)
 }
 
-func ensureIndex(s *mgo.Session) {
-	session := s.Copy()
-	defer session.Close()
-	c := session.DB("action").C("actionDetails")
-
-	index := mgo.Index{
-		Key:        []string{"actionid"},
-		Unique:     true,
-		DropDups:   true,
-		Background: true,
-		Sparse:     true,
-	}
-	err := c.EnsureIndex(index)
-	if err != nil {
-		panic(err)
-	}
+//withoutTimeout sends the log streams, which stay open until the action
+//finishes, straight to the router and everything else to h.
+func withoutTimeout(r *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/log/stream") {
+			r.ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
 }
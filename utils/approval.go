@@ -0,0 +1,357 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//defaultApprovalTimeout is how long an action waits for its approvals when
+//the policy does not say.
+var defaultApprovalTimeout = 24 * time.Hour
+
+//approvalActions are the actions that can require an approval.
+var approvalActions = map[string]bool{
+	"apply":   true,
+	"destroy": true,
+}
+
+// ApprovalPolicy -
+type ApprovalPolicy struct {
+	Tenant     string `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName string `json:"id" description:"Name of the configuration"`
+	Required   int    `json:"required" description:"Number of distinct approvers needed before apply or destroy runs, 0 turns approvals off"`
+	Timeout    string `json:"timeout,omitempty" description:"How long an action waits for approval before it times out, e.g. 4h. Defaults to 24h"`
+}
+
+// Approval -
+type Approval struct {
+	Approver string    `json:"approver" description:"Who approved or rejected the action"`
+	Approved bool      `json:"approved"`
+	Comment  string    `json:"comment,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// ApprovalRequest -
+type ApprovalRequest struct {
+	Approver string `json:"approver,omitempty" description:"Who approves or rejects the action, the caller when authentication is on. Without authentication it is not checked, so the approvals are only advisory."`
+	Comment  string `json:"comment,omitempty" description:"Why"`
+}
+
+//ApprovalStore keeps the approval policies of the configurations.
+type ApprovalStore interface {
+	//SetApprovalPolicy saves the approval policy of policy.ConfigName of
+	//policy.Tenant.
+	SetApprovalPolicy(policy ApprovalPolicy) error
+	//GetApprovalPolicy returns the approval policy of the configuration or
+	//ErrNotFound.
+	GetApprovalPolicy(tenant, configName string) (ApprovalPolicy, error)
+	//AddApproval adds the approval to an action pending approval and returns
+	//the updated action. It returns ErrNotFound if the action is not pending
+	//approval and ErrDuplicate if the approver already voted.
+	AddApproval(actionID string, approval Approval) (ActionResponse, error)
+}
+
+//approvalTimeout returns the timeout of the policy.
+func (p ApprovalPolicy) approvalTimeout() time.Duration {
+	timeout, err := time.ParseDuration(p.Timeout)
+	if err != nil || timeout <= 0 {
+		return defaultApprovalTimeout
+	}
+	return timeout
+}
+
+//approvalsRequired returns how many approvals the action needs.
+func approvalsRequired(store ActionStore, tenant, configName, action string) (int, time.Duration, error) {
+	if !approvalActions[action] {
+		return 0, 0, nil
+	}
+	policy, err := store.GetApprovalPolicy(tenant, configName)
+	if err == ErrNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return policy.Required, policy.approvalTimeout(), nil
+}
+
+//endPendingAction takes the pending job off the queue and records the final
+//status of its action.
+func endPendingAction(store ActionStore, job Job, status string) error {
+	err := store.CancelJob(job.ActionID)
+	if err != nil {
+		return err
+	}
+	err = store.UpdateActionStatus(job.ActionID, status)
+	if err != nil {
+		log.Println("Failed to update the action status : ", err)
+	}
+	unlockConfig(store, job.Tenant, job.ConfigName, job.ActionID)
+	notify(store, job, statusEvents[status], "")
+	return nil
+}
+
+//expireApprovals times out the actions that waited too long for approval.
+func expireApprovals(store ActionStore) {
+	jobs, err := store.ListJobs(JobPending)
+	if err != nil {
+		log.Println("Failed to list the jobs pending approval : ", err)
+		return
+	}
+	for _, job := range jobs {
+		if time.Now().Before(job.ApprovalDeadline) {
+			continue
+		}
+		log.Printf("Approval of %s %s timed out\n", job.Action, job.ActionID)
+		err = endPendingAction(store, job, StatusTimedOut)
+		if err != nil && err != ErrNotFound {
+			log.Println("Failed to time out the action : ", err)
+		}
+	}
+}
+
+//ApprovalPolicyHandler handles request to get the approval policy of the configuration.
+// @Title ApprovalPolicyHandler
+// @Description Get the approval policy of the configuration.
+// @Param   repo_name     path    string     true "repo name"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ApprovalPolicy
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/approval [get]
+func ApprovalPolicyHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		tenant := RequestTenant(r)
+
+		policy, err := store.GetApprovalPolicy(tenant, repoName)
+		if err == ErrNotFound {
+			policy = ApprovalPolicy{Tenant: tenant, ConfigName: repoName}
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		output, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(output)
+	}
+}
+
+//SetApprovalPolicyHandler handles request to set the approval policy of the configuration.
+// @Title SetApprovalPolicyHandler
+// @Description Require approvals before apply and destroy run on the configuration.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   body     body     ApprovalPolicy   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ApprovalPolicy
+// @Failure 400 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/approval [put]
+func SetApprovalPolicyHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		// Read body
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		var policy ApprovalPolicy
+		err = json.Unmarshal(b, &policy)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if policy.Required < 0 {
+			http.Error(w, "required cannot be negative.", 400)
+			return
+		}
+		if policy.Timeout != "" {
+			if _, err := time.ParseDuration(policy.Timeout); err != nil {
+				http.Error(w, "Invalid timeout: "+err.Error(), 400)
+				return
+			}
+		}
+		policy.Tenant = RequestTenant(r)
+		policy.ConfigName = repoName
+
+		err = store.SetApprovalPolicy(policy)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		output, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(output)
+	}
+}
+
+//ApproveHandler handles request to approve an action pending approval.
+// @Title ApproveHandler
+// @Description Approve the action. It is queued once it has the approvals the configuration requires.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   action_name     path    string     true "action name"
+// @Param   action_id     path    string     true "action id"
+// @Param   body     body     ApprovalRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ActionResponse
+// @Failure 400 {object} string
+// @Failure 403 {object} string
+// @Failure 404 {object} string
+// @Failure 409 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/{action_name}/{action_id}/approve [post]
+func ApproveHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vote(w, r, store, true)
+	}
+}
+
+//RejectHandler handles request to reject an action pending approval.
+// @Title RejectHandler
+// @Description Reject the action. It will not run.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   action_name     path    string     true "action name"
+// @Param   action_id     path    string     true "action id"
+// @Param   body     body     ApprovalRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ActionResponse
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 409 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/{action_name}/{action_id}/reject [post]
+func RejectHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vote(w, r, store, false)
+	}
+}
+
+//vote records the approval or rejection of the action and queues or ends
+//the action when it is decided.
+func vote(w http.ResponseWriter, r *http.Request, store ActionStore, approved bool) {
+	vars := mux.Vars(r)
+	actionID := vars["actionID"]
+
+	log.Println("Url Param 'actionID' is: " + actionID)
+
+	// Read body
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var msg ApprovalRequest
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	// With authentication on the approver is the caller
+	if id := RequestIdentity(r); id.Subject != "" {
+		msg.Approver = id.Subject
+	}
+	if msg.Approver == "" {
+		http.Error(w, "EMPTY APPROVER", 400)
+		return
+	}
+
+	job, err := getTenantJob(store, RequestTenant(r), actionID)
+	if err == ErrNotFound {
+		http.Error(w, "There is no such action.", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// The approvers are other people than the requester
+	if approved && job.CreatedBy != "" && msg.Approver == job.CreatedBy {
+		http.Error(w, "The requester of the action cannot approve it.", 403)
+		return
+	}
+
+	approval := Approval{
+		Approver: msg.Approver,
+		Approved: approved,
+		Comment:  msg.Comment,
+		At:       time.Now(),
+	}
+	actionResponse, err := store.AddApproval(actionID, approval)
+	if err == ErrNotFound {
+		http.Error(w, "The action is not pending approval.", 409)
+		return
+	}
+	if err == ErrDuplicate {
+		http.Error(w, fmt.Sprintf("%s has already voted on the action.", msg.Approver), 409)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if !approved {
+		err = endPendingAction(store, job, StatusRejected)
+	} else if countApprovals(actionResponse.Approvals) >= job.ApprovalsRequired {
+		err = store.ReleaseJob(actionID)
+		if err == nil {
+			err = store.UpdateActionStatus(actionID, StatusQueued)
+			wakeWorkers()
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	actionResponse, err = store.GetAction(actionID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	output, err := json.MarshalIndent(actionResponse, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+func countApprovals(approvals []Approval) int {
+	n := 0
+	for _, approval := range approvals {
+		if approval.Approved {
+			n++
+		}
+	}
+	return n
+}
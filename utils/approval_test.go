@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestApproveHandlerRefusesTheRequester(t *testing.T) {
+	defer func(previous *AuthConfig) { authConfig = previous }(authConfig)
+	authConfig = &AuthConfig{}
+	store := NewMemoryStore()
+	store.InsertAction(ActionResponse{ConfigName: "config", Action: "apply", ActionID: "pending", Status: StatusPendingApproval})
+	store.EnqueueJob(Job{ActionID: "pending", ConfigName: "config", Action: "apply", State: JobPending, CreatedBy: "alice", ApprovalsRequired: 1, EnqueuedAt: time.Now()})
+
+	approve := func(subject, body string) int {
+		r := httptest.NewRequest("POST", "/v1/configuration/config/apply/pending/approve", strings.NewReader(body))
+		ctx := context.WithValue(r.Context(), identityKey{}, Identity{Subject: subject, Role: RoleApplier})
+		r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"actionID": "pending"})
+		w := httptest.NewRecorder()
+		ApproveHandler(store)(w, r)
+		return w.Code
+	}
+
+	// The approver in the body is ignored, the caller is the approver
+	if code := approve("alice", `{"approver": "bob"}`); code != 403 {
+		t.Errorf("approval by the requester = %d, want 403", code)
+	}
+	action, _ := store.GetAction("pending")
+	if len(action.Approvals) != 0 {
+		t.Errorf("the approval of the requester was recorded: %+v", action.Approvals)
+	}
+
+	if code := approve("bob", ""); code != 200 {
+		t.Errorf("approval by another user = %d, want 200", code)
+	}
+	job, _ := store.GetJob("pending")
+	if job.State != JobQueued {
+		t.Errorf("job approved by another user is %s, want %s", job.State, JobQueued)
+	}
+}
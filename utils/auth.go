@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Roles, each one can do everything the previous ones can.
+const (
+	RoleViewer  = "viewer"
+	RolePlanner = "planner"
+	RoleApplier = "applier"
+	RoleAdmin   = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:  1,
+	RolePlanner: 2,
+	RoleApplier: 3,
+	RoleAdmin:   4,
+}
+
+//jwtLeeway is the clock skew allowed when checking exp and nbf.
+var jwtLeeway = time.Minute
+
+//AuthConfig is the content of the file given to SetupAuth.
+type AuthConfig struct {
+	APIKeys []APIKey  `json:"api_keys"`
+	JWT     JWTConfig `json:"jwt"`
+}
+
+//APIKey is a key sent in the X-API-Key header.
+type APIKey struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Role    string `json:"role"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+//JWTConfig says which bearer tokens are accepted.
+type JWTConfig struct {
+	Issuer      string   `json:"issuer,omitempty"`
+	Audience    string   `json:"audience,omitempty"`
+	RoleClaim   string   `json:"role_claim,omitempty"`
+	TenantClaim string   `json:"tenant_claim,omitempty"`
+	Keys        []JWTKey `json:"keys"`
+}
+
+//JWTKey verifies the tokens signed with HS256 (secret) or RS256 (PEM public key).
+type JWTKey struct {
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg"`
+	Secret    string `json:"secret,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+
+	rsaKey *rsa.PublicKey
+}
+
+//Identity is who made the request. An identity with a tenant can only work
+//in that tenant.
+type Identity struct {
+	Subject string
+	Role    string
+	Tenant  string
+}
+
+type identityKey struct{}
+
+//authConfig is nil when authentication is off.
+var authConfig *AuthConfig
+
+//SetupAuth turns authentication on with the API keys and JWT keys in the
+//file at path.
+func SetupAuth(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config AuthConfig
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range config.APIKeys {
+		if key.Key == "" || roleRank[key.Role] == 0 {
+			return fmt.Errorf("api key of %q needs a key and one of the roles viewer, planner, applier or admin", key.Subject)
+		}
+		if key.Tenant != "" && !tenantNameRegexp.MatchString(key.Tenant) {
+			return fmt.Errorf("api key of %q has an invalid tenant %q", key.Subject, key.Tenant)
+		}
+	}
+	for i := range config.JWT.Keys {
+		key := &config.JWT.Keys[i]
+		switch key.Algorithm {
+		case "HS256":
+			if key.Secret == "" {
+				return fmt.Errorf("HS256 key %q has no secret", key.KeyID)
+			}
+		case "RS256":
+			key.rsaKey, err = parseRSAPublicKey(key.PublicKey)
+			if err != nil {
+				return fmt.Errorf("RS256 key %q: %v", key.KeyID, err)
+			}
+		default:
+			return fmt.Errorf("key %q has unsupported algorithm %q", key.KeyID, key.Algorithm)
+		}
+	}
+	if config.JWT.RoleClaim == "" {
+		config.JWT.RoleClaim = "role"
+	}
+	if config.JWT.TenantClaim == "" {
+		config.JWT.TenantClaim = "tenant"
+	}
+
+	authConfig = &config
+	return nil
+}
+
+func parseRSAPublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("public_key is not PEM encoded")
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public_key is not an RSA key")
+	}
+	return key, nil
+}
+
+//authenticate returns the identity of the caller.
+func authenticate(r *http.Request) (Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return authenticateAPIKey(key)
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return authenticateJWT(strings.TrimSpace(auth[len("Bearer "):]))
+	}
+	return Identity{}, errors.New("missing credentials, send an X-API-Key header or a bearer token")
+}
+
+func authenticateAPIKey(key string) (Identity, error) {
+	for _, k := range authConfig.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return Identity{Subject: k.Subject, Role: k.Role, Tenant: k.Tenant}, nil
+		}
+	}
+	return Identity{}, errors.New("invalid api key")
+}
+
+func authenticateJWT(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return Identity{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range authConfig.JWT.Keys {
+		if key.Algorithm != header.Algorithm || (header.KeyID != "" && key.KeyID != header.KeyID) {
+			continue
+		}
+		if verifySignature(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Identity{}, errors.New("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return Identity{}, err
+	}
+	return checkClaims(claims)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func verifySignature(key JWTKey, signed, signature []byte) bool {
+	switch key.Algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte(key.Secret))
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.rsaKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+func checkClaims(claims map[string]interface{}) (Identity, error) {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return Identity{}, errors.New("the token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return Identity{}, errors.New("the token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return Identity{}, errors.New("the token is not valid yet")
+	}
+	if issuer := authConfig.JWT.Issuer; issuer != "" && claims["iss"] != issuer {
+		return Identity{}, errors.New("the token has the wrong issuer")
+	}
+	if audience := authConfig.JWT.Audience; audience != "" && !hasAudience(claims["aud"], audience) {
+		return Identity{}, errors.New("the token has the wrong audience")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, errors.New("the token has no subject")
+	}
+
+	// The role claim is a role or a list of roles, the highest one wins
+	role := ""
+	switch v := claims[authConfig.JWT.RoleClaim].(type) {
+	case string:
+		role = v
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok && roleRank[s] > roleRank[role] {
+				role = s
+			}
+		}
+	}
+	if roleRank[role] == 0 {
+		return Identity{}, errors.New("the token has no known role")
+	}
+	tenant, _ := claims[authConfig.JWT.TenantClaim].(string)
+	return Identity{Subject: subject, Role: role, Tenant: tenant}, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Authorize only lets callers with at least the given role through to the
+//handler, in the tenant they work in. The role is not checked when
+//authentication is off.
+func Authorize(role string, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var id Identity
+		if authConfig != nil {
+			var err error
+			id, err = authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="terraform-provider-ibm-api"`)
+				http.Error(w, err.Error(), 401)
+				return
+			}
+			if roleRank[id.Role] < roleRank[role] {
+				log.Printf("%s with role %s is not allowed to %s %s\n", id.Subject, id.Role, r.Method, r.URL.Path)
+				http.Error(w, fmt.Sprintf("The %s role is needed for this request.", role), 403)
+				return
+			}
+			ctx = context.WithValue(ctx, identityKey{}, id)
+		}
+
+		tenant, code, err := requestTenant(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		ctx = context.WithValue(ctx, tenantContextKey{}, tenant)
+		h(w, r.WithContext(ctx))
+	}
+}
+
+//RequestIdentity returns the identity of the caller, an empty Identity when
+//authentication is off.
+func RequestIdentity(r *http.Request) Identity {
+	id, _ := r.Context().Value(identityKey{}).(Identity)
+	return id
+}
+
+//hasRole tells if the caller has at least the role, always true when
+//authentication is off.
+func hasRole(r *http.Request, role string) bool {
+	return authConfig == nil || roleRank[RequestIdentity(r).Role] >= roleRank[role]
+}
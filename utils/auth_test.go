@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//signJWT returns a token of the claims signed with the HS256 secret or the
+//RS256 key.
+func signJWT(t *testing.T, header, claims map[string]interface{}, secret string, key *rsa.PrivateKey) string {
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := segment(header) + "." + segment(claims)
+	var signature []byte
+	if key != nil {
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := AuthConfig{JWT: JWTConfig{
+		Issuer:   "https://issuer",
+		Audience: "tf-api",
+		Keys: []JWTKey{
+			{KeyID: "hs", Algorithm: "HS256", Secret: "s3cret"},
+			{KeyID: "rs", Algorithm: "RS256", PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		},
+	}}
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "auth.json")
+	err = ioutil.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous *AuthConfig) { authConfig = previous }(authConfig)
+	err = SetupAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":  "alice",
+			"iss":  "https://issuer",
+			"aud":  "tf-api",
+			"role": "applier",
+			"exp":  now + 3600,
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]interface{}{"alg": "RS256", "kid": "rs"}
+	unsigned := signJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), "", nil)
+	unsigned = unsigned[:strings.LastIndex(unsigned, ".")+1]
+
+	tests := []struct {
+		name    string
+		token   string
+		want    Identity
+		wantErr string
+	}{
+		{name: "HS256", token: signJWT(t, hs, claims(nil), "s3cret", nil), want: Identity{Subject: "alice", Role: "applier"}},
+		{name: "RS256", token: signJWT(t, rs, claims(nil), "", rsaKey), want: Identity{Subject: "alice", Role: "applier"}},
+		{name: "tenant claim", token: signJWT(t, hs, claims(map[string]interface{}{"tenant": "team-a"}), "s3cret", nil), want: Identity{Subject: "alice", Role: "applier", Tenant: "team-a"}},
+		{name: "highest role of a list", token: signJWT(t, hs, claims(map[string]interface{}{"role": []string{"viewer", "admin", "unknown"}}), "s3cret", nil), want: Identity{Subject: "alice", Role: "admin"}},
+		{name: "audience in a list", token: signJWT(t, hs, claims(map[string]interface{}{"aud": []string{"other", "tf-api"}}), "s3cret", nil), want: Identity{Subject: "alice", Role: "applier"}},
+		{name: "expired within the leeway", token: signJWT(t, hs, claims(map[string]interface{}{"exp": now - 30}), "s3cret", nil), want: Identity{Subject: "alice", Role: "applier"}},
+		{name: "wrong secret", token: signJWT(t, hs, claims(nil), "other", nil), wantErr: "invalid token signature"},
+		{name: "wrong RSA key", token: signJWT(t, rs, claims(nil), "", otherKey), wantErr: "invalid token signature"},
+		{name: "unknown key id", token: signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "nope"}, claims(nil), "s3cret", nil), wantErr: "invalid token signature"},
+		{name: "alg none", token: unsigned, wantErr: "invalid token signature"},
+		{name: "HS256 signed with the public key", token: signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rs"}, claims(nil), config.JWT.Keys[1].PublicKey, nil), wantErr: "invalid token signature"},
+		{name: "expired", token: signJWT(t, hs, claims(map[string]interface{}{"exp": now - 3600}), "s3cret", nil), wantErr: "the token has expired"},
+		{name: "no expiry", token: signJWT(t, hs, claims(map[string]interface{}{"exp": nil}), "s3cret", nil), wantErr: "the token has no expiry"},
+		{name: "not valid yet", token: signJWT(t, hs, claims(map[string]interface{}{"nbf": now + 3600}), "s3cret", nil), wantErr: "the token is not valid yet"},
+		{name: "wrong issuer", token: signJWT(t, hs, claims(map[string]interface{}{"iss": "https://evil"}), "s3cret", nil), wantErr: "the token has the wrong issuer"},
+		{name: "wrong audience", token: signJWT(t, hs, claims(map[string]interface{}{"aud": "other"}), "s3cret", nil), wantErr: "the token has the wrong audience"},
+		{name: "no subject", token: signJWT(t, hs, claims(map[string]interface{}{"sub": nil}), "s3cret", nil), wantErr: "the token has no subject"},
+		{name: "unknown role", token: signJWT(t, hs, claims(map[string]interface{}{"role": "root"}), "s3cret", nil), wantErr: "the token has no known role"},
+		{name: "two segments", token: "a.b", wantErr: "malformed token"},
+		{name: "bad header", token: "!!.e30.c2ln", wantErr: "malformed token"},
+	}
+	for _, tt := range tests {
+		got, err := authenticateJWT(tt.token)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSetupAuthRejectsInvalidKeys(t *testing.T) {
+	defer func(previous *AuthConfig) { authConfig = previous }(authConfig)
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "api key without role", config: `{"api_keys": [{"key": "k", "subject": "s"}]}`},
+		{name: "api key with unknown role", config: `{"api_keys": [{"key": "k", "subject": "s", "role": "root"}]}`},
+		{name: "api key with invalid tenant", config: `{"api_keys": [{"key": "k", "subject": "s", "role": "viewer", "tenant": "../x"}]}`},
+		{name: "HS256 without secret", config: `{"jwt": {"keys": [{"alg": "HS256"}]}}`},
+		{name: "RS256 without key", config: `{"jwt": {"keys": [{"alg": "RS256"}]}}`},
+		{name: "unsupported algorithm", config: `{"jwt": {"keys": [{"alg": "ES256", "secret": "x"}]}}`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "auth.json")
+		err := ioutil.WriteFile(path, []byte(tt.config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if SetupAuth(path) == nil {
+			t.Errorf("%s: SetupAuth accepted %s", tt.name, tt.config)
+		}
+	}
+}
+
+func TestRequestTenant(t *testing.T) {
+	defer func(previous *AuthConfig) { authConfig = previous }(authConfig)
+	tests := []struct {
+		name     string
+		auth     bool
+		id       Identity
+		header   string
+		want     string
+		wantCode int
+	}{
+		{name: "authentication off", header: "team-a", want: "team-a"},
+		{name: "identity with a tenant", auth: true, id: Identity{Subject: "ci", Role: RoleApplier, Tenant: "team-a"}, want: "team-a"},
+		{name: "identity with another tenant", auth: true, id: Identity{Subject: "ci", Role: RoleApplier, Tenant: "team-a"}, header: "team-b", wantCode: 403},
+		{name: "identity without a tenant", auth: true, id: Identity{Subject: "ci", Role: RoleApplier}, want: ""},
+		{name: "identity without a tenant in the default tenant", auth: true, id: Identity{Subject: "ci", Role: RoleApplier}, header: DefaultTenant, want: ""},
+		{name: "identity without a tenant choosing one", auth: true, id: Identity{Subject: "ci", Role: RoleApplier}, header: "team-a", wantCode: 403},
+		{name: "admin without a tenant choosing one", auth: true, id: Identity{Subject: "root", Role: RoleAdmin}, header: "team-a", want: "team-a"},
+	}
+	for _, tt := range tests {
+		authConfig = nil
+		if tt.auth {
+			authConfig = &AuthConfig{}
+		}
+		r := httptest.NewRequest("GET", "/v1/configuration", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Tenant", tt.header)
+		}
+		got, code, err := requestTenant(r, tt.id)
+		if tt.wantCode != 0 {
+			if err == nil || code != tt.wantCode {
+				t.Errorf("%s: = %q, %d, %v, want %d", tt.name, got, code, err, tt.wantCode)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
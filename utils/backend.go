@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//stateBackendURL is the URL terraform reaches the server at to keep its
+//state, "" when terraform keeps it in local files.
+var stateBackendURL string
+
+//backendKey signs the tokens terraform authenticates to the state backend
+//with.
+var backendKey []byte
+
+//backendOverrideFile is written in the configuration so terraform uses the
+//state backend of the server, whatever backend the repo declares.
+const backendOverrideFile = "backend_override.tf"
+
+// RemoteState -
+type RemoteState struct {
+	Tenant     string     `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName string     `json:"id" description:"Name of the configuration"`
+	Data       string     `json:"data" description:"The state"`
+	Serial     int64      `json:"serial" description:"Serial of the state"`
+	Lineage    string     `json:"lineage" description:"Lineage of the state"`
+	Lock       *StateLock `json:"lock,omitempty" description:"The terraform lock on the state"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// StateLock -
+type StateLock struct {
+	ID        string `json:"ID"`
+	Operation string `json:"Operation,omitempty"`
+	Info      string `json:"Info,omitempty"`
+	Who       string `json:"Who,omitempty"`
+	Version   string `json:"Version,omitempty"`
+	Created   string `json:"Created,omitempty"`
+	Path      string `json:"Path,omitempty"`
+}
+
+//RemoteStateStore keeps the states of the configurations when the server is
+//the state backend of terraform.
+type RemoteStateStore interface {
+	//GetState returns the state of the configuration or ErrNotFound, with
+	//the lock of a state not saved yet.
+	GetState(tenant, configName string) (RemoteState, error)
+	//PutState saves the state. It returns ErrLocked if the state is locked
+	//with another lock than lockID.
+	PutState(state RemoteState, lockID string) error
+	//LockState locks the state of the configuration. If it is already locked
+	//the current lock is returned with ErrLocked.
+	LockState(tenant, configName string, lock StateLock) (StateLock, error)
+	//UnlockState releases the lock on the state. It returns the current lock
+	//with ErrLocked if it is another one, an empty lockID releases any lock.
+	UnlockState(tenant, configName, lockID string) (StateLock, error)
+	//DeleteState removes the state of the configuration.
+	DeleteState(tenant, configName string) error
+}
+
+//errNoBackendKey is returned when the state backend is set up without the
+//master key its tokens are derived from.
+var errNoBackendKey = errors.New("the state backend needs -masterKey, its tokens are derived from it")
+
+//SetupStateBackend makes the server the state backend of terraform, reached
+//at url. The tokens of the backend are derived from the master key, so all
+//the replicas of the server accept them and they survive a restart.
+func SetupStateBackend(url string) error {
+	if masterKey == nil {
+		return errNoBackendKey
+	}
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("state backend"))
+	backendKey = mac.Sum(nil)
+	stateBackendURL = strings.TrimRight(url, "/")
+	return nil
+}
+
+//backendToken returns the password terraform gets for the state of the
+//configuration.
+func backendToken(tenant, configName string) string {
+	mac := hmac.New(sha256.New, backendKey)
+	mac.Write([]byte(tenant + "\x00" + configName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//writeBackendOverride writes the backend override file in the directory
+//terraform runs in for the configuration, or removes it when the state is
+//kept in local files.
+func writeBackendOverride(dir string, config ConfigRecord) error {
+	file := path.Join(dir, backendOverrideFile)
+	if stateBackendURL == "" {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tenant := config.Tenant
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	address := stateBackendURL + "/v1/state/" + config.ID
+	override := fmt.Sprintf(`terraform {
+  backend "http" {
+    address        = %s
+    lock_address   = %s
+    unlock_address = %s
+    username       = %s
+    password       = %s
+  }
+}
+`, hclString(address), hclString(address), hclString(address), hclString(tenant), hclString(backendToken(config.Tenant, config.ID)))
+	return ioutil.WriteFile(file, []byte(override), 0600)
+}
+
+//stateRequestTenant returns the tenant of a request of terraform, which
+//authenticates with the name of the tenant and the token of the state.
+func stateRequestTenant(r *http.Request, configName string) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok || backendKey == nil || !tenantNameRegexp.MatchString(username) {
+		return "", false
+	}
+	tenant := tenantKey(username)
+	token := backendToken(tenant, configName)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(password)) != 1 {
+		return "", false
+	}
+	return tenant, true
+}
+
+//AuthorizeState lets terraform through to the state of the configuration with
+//the token of its backend override file, and the other callers only with the
+//admin role as the state holds the secrets of the configuration. Only the
+//admins can delete the state.
+func AuthorizeState(h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	authorized := Authorize(RoleAdmin, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := stateRequestTenant(r, mux.Vars(r)["config"])
+		if !ok || r.Method == "DELETE" {
+			authorized(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityKey{}, Identity{Subject: "terraform", Role: RoleApplier, Tenant: tenant})
+		ctx = context.WithValue(ctx, tenantContextKey{}, tenant)
+		h(w, r.WithContext(ctx))
+	}
+}
+
+//writeStateLock writes the lock that holds the state.
+func writeStateLock(w http.ResponseWriter, lock StateLock) {
+	output, _ := json.Marshal(lock)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(423)
+	w.Write(output)
+}
+
+//StateBackendHandler handles the requests of terraform to its HTTP state backend.
+// @Title StateBackendHandler
+// @Description The terraform HTTP state backend of the configuration: GET reads the state, POST saves it, DELETE removes it, LOCK and UNLOCK lock it.
+// @Param   config     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} string
+// @Failure 400 {object} string
+// @Failure 423 {object} StateLock
+// @Failure 500 {object} string
+// @Router /v1/state/{config} [get]
+func StateBackendHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		configName := vars["config"]
+		tenant := RequestTenant(r)
+
+		// Read body
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			state, err := store.GetState(tenant, configName)
+			if err == ErrNotFound {
+				w.WriteHeader(204)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			w.Write([]byte(state.Data))
+
+		case "POST":
+			header, err := parseStateHeader(b)
+			if err != nil {
+				http.Error(w, "Invalid state: "+err.Error(), 400)
+				return
+			}
+			state := RemoteState{
+				Tenant:     tenant,
+				ConfigName: configName,
+				Data:       string(b),
+				Serial:     header.Serial,
+				Lineage:    header.Lineage,
+				UpdatedAt:  time.Now(),
+			}
+			err = store.PutState(state, r.URL.Query().Get("ID"))
+			if err == ErrLocked {
+				current, _ := store.GetState(tenant, configName)
+				if current.Lock != nil {
+					writeStateLock(w, *current.Lock)
+					return
+				}
+				http.Error(w, "The state is locked.", 423)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+		case "DELETE":
+			err := store.DeleteState(tenant, configName)
+			if err != nil && err != ErrNotFound {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+		case "LOCK":
+			var lock StateLock
+			err := json.Unmarshal(b, &lock)
+			if err != nil || lock.ID == "" {
+				http.Error(w, "Invalid lock info.", 400)
+				return
+			}
+			current, err := store.LockState(tenant, configName, lock)
+			if err == ErrLocked {
+				writeStateLock(w, current)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+		case "UNLOCK":
+			var lock StateLock
+			if len(b) > 0 {
+				err := json.Unmarshal(b, &lock)
+				if err != nil {
+					http.Error(w, "Invalid lock info.", 400)
+					return
+				}
+			}
+			current, err := store.UnlockState(tenant, configName, lock.ID)
+			if err == ErrLocked {
+				writeStateLock(w, current)
+				return
+			}
+			if err != nil && err != ErrNotFound {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
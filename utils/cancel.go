@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//ErrCancelled is returned by the terraform commands of a cancelled action.
+var ErrCancelled = errors.New("the action was cancelled")
+
+//ErrTimedOut is returned by the terraform commands killed because they ran
+//longer than their timeout.
+var ErrTimedOut = errors.New("the action ran longer than its timeout")
+
+//cancelGracePeriod is how long terraform gets to stop after SIGINT before it
+//is killed.
+var cancelGracePeriod = 2 * time.Minute
+
+//cancelPollInterval is how often the worker running a job checks whether
+//the job was cancelled on another server.
+var cancelPollInterval = 5 * time.Second
+
+//actionRoles are the roles needed to run the actions, and so to cancel them,
+//other than RolePlanner.
+var actionRoles = map[string]string{
+	"apply":   RoleApplier,
+	"destroy": RoleApplier,
+}
+
+//actionRole returns the role needed to run and cancel the action.
+func actionRole(action string) string {
+	if role, ok := actionRoles[action]; ok {
+		return role
+	}
+	return RolePlanner
+}
+
+//actionRun tracks the terraform process of an action run by a worker of this
+//server.
+type actionRun struct {
+	cmd       *exec.Cmd
+	done      chan struct{}
+	cancelled bool
+}
+
+var actionRuns = struct {
+	sync.Mutex
+	m map[string]*actionRun
+}{m: make(map[string]*actionRun)}
+
+//startRun registers the action as running on this server until its job is
+//finished. It keeps a cancellation that came in between the worker claiming
+//the job and this call.
+func startRun(actionID string) {
+	actionRuns.Lock()
+	defer actionRuns.Unlock()
+	if _, ok := actionRuns.m[actionID]; !ok {
+		actionRuns.m[actionID] = &actionRun{}
+	}
+}
+
+//endRun removes the action registered by startRun.
+func endRun(actionID string) {
+	actionRuns.Lock()
+	defer actionRuns.Unlock()
+	delete(actionRuns.m, actionID)
+}
+
+//runCmd starts the command as the process of the action and waits for it.
+//It returns ErrCancelled if the action is or gets cancelled. copying, if not
+//nil, is waited for before the command: the goroutines reading its pipes
+//must be done with them before the pipes are closed.
+func runCmd(actionID string, cmd *exec.Cmd, copying *sync.WaitGroup) error {
+	actionRuns.Lock()
+	run := actionRuns.m[actionID]
+	if run != nil && run.cancelled {
+		actionRuns.Unlock()
+		return ErrCancelled
+	}
+	cmd.SysProcAttr = runProcAttr()
+	err := cmd.Start()
+	if err != nil {
+		actionRuns.Unlock()
+		return err
+	}
+	done := make(chan struct{})
+	if run != nil {
+		run.cmd = cmd
+		run.done = done
+	}
+	actionRuns.Unlock()
+
+	if copying != nil {
+		copying.Wait()
+	}
+	err = cmd.Wait()
+	close(done)
+
+	actionRuns.Lock()
+	defer actionRuns.Unlock()
+	if run != nil {
+		run.cmd = nil
+		if run.cancelled {
+			return ErrCancelled
+		}
+	}
+	return err
+}
+
+//timedOut returns ErrTimedOut when the command failed because the context
+//it ran with expired.
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && err != ErrCancelled && ctx.Err() == context.DeadlineExceeded {
+		return ErrTimedOut
+	}
+	return err
+}
+
+//cancelRun cancels an action run by a worker of this server. Its terraform
+//process is interrupted and killed if it is still running after the grace
+//period.
+func cancelRun(store ActionStore, actionID string) {
+	actionRuns.Lock()
+	run, ok := actionRuns.m[actionID]
+	if !ok {
+		// The cancellation is kept for a worker that claimed the job but has
+		// not registered the run yet. The run is registered until its job is
+		// finished, so the job is checked to drop the entry when it has
+		// finished already.
+		run = &actionRun{cancelled: true}
+		actionRuns.m[actionID] = run
+		actionRuns.Unlock()
+
+		job, err := store.GetJob(actionID)
+		if err == nil && job.State == JobRunning && job.Owner == workerOwner() {
+			return
+		}
+		actionRuns.Lock()
+		if actionRuns.m[actionID] == run {
+			delete(actionRuns.m, actionID)
+		}
+		actionRuns.Unlock()
+		return
+	}
+	defer actionRuns.Unlock()
+
+	run.cancelled = true
+	if run.cmd != nil {
+		interruptRun(actionID, run)
+	}
+}
+
+//watchCancel cancels the run of the action once a cancellation is requested
+//on its job, by the server the cancellation was sent to, until stop is
+//closed.
+func watchCancel(store ActionStore, actionID string, stop <-chan struct{}) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := store.GetJob(actionID)
+		if err == nil && job.CancelRequested {
+			log.Println("Cancellation requested for action", actionID)
+			cancelRun(store, actionID)
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//cancelRuns cancels all the actions run by the workers of this server.
+func cancelRuns() {
+	actionRuns.Lock()
+	defer actionRuns.Unlock()
+
+	for actionID, run := range actionRuns.m {
+		run.cancelled = true
+		if run.cmd != nil {
+			interruptRun(actionID, run)
+		}
+	}
+}
+
+//killGroup kills the process group of the command, started by runCmd, so
+//no process is left holding its pipes.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+//interruptRun interrupts the terraform process of the run and kills it if it
+//is still running after the grace period. The signals go to its process
+//group, so the providers get them too as on a terminal. It is called with
+//actionRuns locked.
+func interruptRun(actionID string, run *actionRun) {
+	cmd, done := run.cmd, run.done
+	log.Println("Interrupting", cmd.Args, "of action", actionID)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(cancelGracePeriod):
+			log.Println("Killing", cmd.Args, "of action", actionID)
+			killGroup(cmd)
+		}
+	}()
+}
+
+//CancelHandler handles request to cancel an action.
+// @Title CancelHandler
+// @Description Cancel a queued or running action, with the role needed to run it. Terraform is interrupted and killed if it does not stop in time, by the server running it.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   action_name     path    string     true "action name"
+// @Param   action_id     path    string     true "action id"
+// @Accept  json
+// @Produce  json
+// @Success 202 {object} ActionResponse
+// @Failure 403 {object} string
+// @Failure 404 {object} string
+// @Failure 409 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/{action_name}/{action_id}/cancel [post]
+func CancelHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		actionID := vars["actionID"]
+
+		log.Println("Url Param 'actionID' is: " + actionID)
+
+		job, err := getTenantJob(store, RequestTenant(r), actionID)
+		if err == ErrNotFound {
+			http.Error(w, "There is no such action.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if role := actionRole(job.Action); !hasRole(r, role) {
+			http.Error(w, fmt.Sprintf("The %s role is needed to cancel a %s.", role, job.Action), 403)
+			return
+		}
+
+		if job.State == JobPending || job.State == JobQueued {
+			err = store.CancelJob(actionID)
+			if err == nil {
+				updateErr := store.UpdateActionStatus(actionID, StatusCancelled)
+				if updateErr != nil {
+					log.Println("Failed to update the action status : ", updateErr)
+				}
+				if lockingActions[job.Action] {
+					unlockConfig(store, job.Tenant, job.ConfigName, job.ActionID)
+				}
+				notify(store, job, EventCancelled, "")
+			} else if err == ErrNotFound {
+				// Picked up by a worker in the meantime
+				job, err = store.GetJob(actionID)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
+		if job.State == JobFinished {
+			http.Error(w, "The action has already finished.", 409)
+			return
+		}
+		if job.State == JobRunning && job.Owner == workerOwner() {
+			cancelRun(store, actionID)
+		} else if job.State == JobRunning {
+			// The worker running it on another server polls the job
+			err = store.RequestCancel(actionID)
+			if err == ErrNotFound {
+				http.Error(w, "The action is no longer running.", 409)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
+		actionResponse, err := store.GetAction(actionID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		output, err := json.MarshalIndent(actionResponse, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(202)
+		w.Write(output)
+	}
+}
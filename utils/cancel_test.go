@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//registeredRun tells if the action has an entry in actionRuns.
+func registeredRun(actionID string) bool {
+	actionRuns.Lock()
+	defer actionRuns.Unlock()
+	_, ok := actionRuns.m[actionID]
+	return ok
+}
+
+func TestCancelRun(t *testing.T) {
+	store := NewMemoryStore()
+	for _, id := range []string{"finished", "claimed"} {
+		err := store.EnqueueJob(Job{ActionID: id, ConfigName: "config", Action: "plan", State: JobQueued, EnqueuedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.ClaimJob(workerOwner())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A cancellation after the job has finished leaves nothing behind
+	store.FinishJob("finished")
+	cancelRun(store, "finished")
+	if registeredRun("finished") {
+		t.Error("the cancellation of a finished job was kept")
+	}
+
+	// A cancellation before the worker registers the run stops it
+	cancelRun(store, "claimed")
+	startRun("claimed")
+	err := runCmd("claimed", exec.Command("true"), nil)
+	if err != ErrCancelled {
+		t.Errorf("runCmd of a cancelled action = %v, want ErrCancelled", err)
+	}
+	endRun("claimed")
+	if registeredRun("claimed") {
+		t.Error("the run was kept after it ended")
+	}
+}
+
+func TestCancelRunsInterruptsTheProcessGroup(t *testing.T) {
+	startRun("group")
+	defer endRun("group")
+	result := make(chan error, 1)
+	// The shell waits for sleep, which only stops if the group is interrupted
+	go func() { result <- runCmd("group", exec.Command("sh", "-c", "sleep 30; true"), nil) }()
+	for i := 0; i < 100; i++ {
+		actionRuns.Lock()
+		started := actionRuns.m["group"].cmd != nil
+		actionRuns.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancelRuns()
+	select {
+	case err := <-result:
+		if err != ErrCancelled {
+			t.Errorf("runCmd = %v, want ErrCancelled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the command was not interrupted")
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	defer func(interval time.Duration) { cancelPollInterval = interval }(cancelPollInterval)
+	cancelPollInterval = 10 * time.Millisecond
+	store := NewMemoryStore()
+	store.EnqueueJob(Job{ActionID: "watched", ConfigName: "config", Action: "apply", State: JobRunning, Owner: workerOwner()})
+	startRun("watched")
+	defer endRun("watched")
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchCancel(store, "watched", stop)
+
+	// As requested by the server the cancel was sent to
+	err := store.RequestCancel("watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCmd("watched", exec.Command("sleep", "30"), nil)
+	if err != ErrCancelled {
+		t.Errorf("runCmd = %v, want ErrCancelled", err)
+	}
+}
+
+func TestCancelHandler(t *testing.T) {
+	defer func(previous *AuthConfig) { authConfig = previous }(authConfig)
+	authConfig = &AuthConfig{}
+	store := NewMemoryStore()
+	jobs := []Job{
+		{ActionID: "queued-plan", Action: "plan", State: JobQueued},
+		{ActionID: "queued-apply", Action: "apply", State: JobQueued},
+		{ActionID: "remote-destroy", Action: "destroy", State: JobRunning, Owner: "elsewhere:1:b"},
+	}
+	for _, job := range jobs {
+		job.Tenant = DefaultTenant
+		job.ConfigName = "config"
+		store.InsertAction(ActionResponse{Tenant: DefaultTenant, ActionID: job.ActionID, Action: job.Action, Status: StatusQueued})
+		store.EnqueueJob(job)
+	}
+
+	tests := []struct {
+		actionID string
+		role     string
+		want     int
+	}{
+		{actionID: "queued-apply", role: RolePlanner, want: 403},
+		{actionID: "remote-destroy", role: RolePlanner, want: 403},
+		{actionID: "queued-plan", role: RolePlanner, want: 202},
+		{actionID: "queued-apply", role: RoleApplier, want: 202},
+		{actionID: "remote-destroy", role: RoleApplier, want: 202},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/v1/configuration/config/action/"+tt.actionID+"/cancel", nil)
+		ctx := context.WithValue(r.Context(), identityKey{}, Identity{Subject: "bob", Role: tt.role})
+		ctx = context.WithValue(ctx, tenantContextKey{}, DefaultTenant)
+		r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"actionID": tt.actionID})
+		w := httptest.NewRecorder()
+		CancelHandler(store)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("cancel of %s by a %s = %d %s, want %d", tt.actionID, tt.role, w.Code, w.Body, tt.want)
+		}
+	}
+
+	// The job running on another server is left to it
+	job, _ := store.GetJob("remote-destroy")
+	if job.State != JobRunning || !job.CancelRequested {
+		t.Errorf("remote job after the cancel = %+v, want a running job with a cancellation requested", job)
+	}
+	job, _ = store.GetJob("queued-plan")
+	if job.State != JobFinished {
+		t.Errorf("queued job after the cancel is %s, want %s", job.State, JobFinished)
+	}
+}
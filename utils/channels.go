@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//channelTimeout is how long a chat channel has to answer.
+var channelTimeout = 10 * time.Second
+
+//channelTypes are the kinds of notification channels.
+var channelTypes = map[string]bool{
+	"slack":      true,
+	"teams":      true,
+	"mattermost": true,
+	"email":      true,
+}
+
+//defaultTemplates are the messages of the channels without a template. They
+//are text/template templates over the ActionEvent. A slack channel without a
+//template is sent the Block Kit message of ComposeSlackMessage.
+var defaultTemplates = map[string]string{
+	"mattermost": `**{{.Action}} {{.ActionID}}** of **{{.ConfigName}}** : {{if .Message}}{{.Message}}{{else}}{{.Status}}{{end}}` +
+		`{{if .Error}}
+> {{.Error}}{{end}}{{if .PlanSummary}}
+{{.PlanSummary.Add}} to add, {{.PlanSummary.Change}} to change, {{.PlanSummary.Destroy}} to destroy{{end}}
+[Output logs]({{.OutURL}}) · [Error logs]({{.ErrURL}})`,
+	"teams": `{{if .Message}}{{.Message}}{{else}}{{.Status}}{{end}}` +
+		`{{if .Error}}<br>{{.Error}}{{end}}{{if .PlanSummary}}<br>{{.PlanSummary.Add}} to add, {{.PlanSummary.Change}} to change, {{.PlanSummary.Destroy}} to destroy{{end}}`,
+	"email": `{{.Action}} {{.ActionID}} of {{.ConfigName}} : {{if .Message}}{{.Message}}{{else}}{{.Status}}{{end}}
+{{if .Error}}
+{{.Error}}
+{{end}}{{if .PlanSummary}}
+{{.PlanSummary.Add}} to add, {{.PlanSummary.Change}} to change, {{.PlanSummary.Destroy}} to destroy
+{{end}}
+{{if .CreatedBy}}Requested by {{.CreatedBy}}
+{{end}}Output logs: {{.OutURL}}
+Error logs: {{.ErrURL}}
+`,
+}
+
+//defaultSubject is the subject of the emails of the channels without one.
+const defaultSubject = `[{{.ConfigName}}] {{.Action}} {{if .Message}}{{.Message}}{{else}}{{.Status}}{{end}}`
+
+// NotificationChannel -
+type NotificationChannel struct {
+	Type     string   `json:"type" description:"slack, teams, mattermost or email"`
+	URL      string   `json:"url,omitempty" description:"Incoming webhook of a slack, teams or mattermost channel"`
+	To       []string `json:"to,omitempty" description:"Recipients of an email channel"`
+	Events   []string `json:"events,omitempty" description:"The events sent, all but action.queued if empty"`
+	Subject  string   `json:"subject,omitempty" description:"Go template of the subject of the emails, over the event"`
+	Template string   `json:"template,omitempty" description:"Go template of the message, over the event, the default one of the type if empty"`
+}
+
+//checkChannels checks the channels of a configuration.
+func checkChannels(channels []NotificationChannel) error {
+	for i, c := range channels {
+		err := checkChannel(c)
+		if err != nil {
+			return fmt.Errorf("channel %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func checkChannel(c NotificationChannel) error {
+	if !channelTypes[c.Type] {
+		return fmt.Errorf("the type of a channel is slack, teams, mattermost or email, not %q", c.Type)
+	}
+	if c.Type == "email" {
+		if smtpAddr == "" {
+			return errNoSMTP
+		}
+		if len(c.To) == 0 {
+			return fmt.Errorf("an email channel needs recipients")
+		}
+		for _, to := range c.To {
+			_, err := mail.ParseAddress(to)
+			if err != nil {
+				return fmt.Errorf("invalid recipient %q: %v", to, err)
+			}
+		}
+	} else {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q, it must be an http or https URL", c.URL)
+		}
+	}
+	for _, event := range c.Events {
+		if !notifyEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	_, err := template.New("template").Parse(c.Template)
+	if err != nil {
+		return err
+	}
+	_, err = template.New("subject").Parse(c.Subject)
+	return err
+}
+
+//channelNotifier sends the events to a channel of the configuration.
+type channelNotifier struct {
+	channel NotificationChannel
+}
+
+//subscribed tells if the channel is sent the event. The channels are read
+//by people, so the start and end of the quiet actions are left out as for
+//Slack.
+func (n channelNotifier) subscribed(event ActionEvent) bool {
+	if len(n.channel.Events) == 0 {
+		return event.Event != EventQueued && !(quietActions[event.Action] && strings.HasPrefix(event.Event, "action."))
+	}
+	for _, e := range n.channel.Events {
+		if e == event.Event {
+			return true
+		}
+	}
+	return false
+}
+
+//Notify sends the message of the event to the channel.
+func (n channelNotifier) Notify(event ActionEvent) error {
+	if !n.subscribed(event) {
+		return nil
+	}
+	if n.channel.Type == "slack" && n.channel.Template == "" {
+		return postChannel(n.channel.URL, ComposeSlackMessage(event))
+	}
+	text := n.channel.Template
+	if text == "" {
+		text = defaultTemplates[n.channel.Type]
+	}
+	message, err := renderTemplate(text, event)
+	if err != nil {
+		return err
+	}
+
+	switch n.channel.Type {
+	case "email":
+		text = n.channel.Subject
+		if text == "" {
+			text = defaultSubject
+		}
+		subject, err := renderTemplate(text, event)
+		if err != nil {
+			return err
+		}
+		return sendEmail(n.channel.To, subject, message)
+	case "teams":
+		return postChannel(n.channel.URL, teamsCard(event, message))
+	}
+	// Mattermost takes the payload of Slack
+	return postChannel(n.channel.URL, SlackMessage{Text: message})
+}
+
+//renderTemplate executes the template with the event.
+func renderTemplate(text string, event ActionEvent) (string, error) {
+	t, err := template.New("message").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, event)
+	return b.String(), err
+}
+
+//postChannel posts the payload to the incoming webhook of a channel.
+func postChannel(webhook string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: channelTimeout}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the channel answered %s", resp.Status)
+	}
+	return nil
+}
+
+// TeamsCard is the MessageCard posted to a Microsoft Teams incoming webhook.
+type TeamsCard struct {
+	Type            string        `json:"@type"`
+	Context         string        `json:"@context"`
+	Summary         string        `json:"summary"`
+	ThemeColor      string        `json:"themeColor,omitempty"`
+	Title           string        `json:"title"`
+	Text            string        `json:"text"`
+	PotentialAction []TeamsAction `json:"potentialAction,omitempty"`
+}
+
+// TeamsAction is a button of a TeamsCard opening a URL.
+type TeamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []TeamsTarget `json:"targets"`
+}
+
+// TeamsTarget is the URL opened by a TeamsAction.
+type TeamsTarget struct {
+	OS  string `json:"os"`
+	URI string `json:"uri"`
+}
+
+//teamsColors are the colors of the cards of the statuses.
+var teamsColors = map[string]string{
+	StatusCompleted: "2EB886",
+	StatusFailed:    "D00000",
+	StatusTimedOut:  "D00000",
+	StatusRejected:  "D00000",
+	StatusCancelled: "808080",
+}
+
+//teamsCard returns the card of the event with the message as its text and
+//buttons to the logs.
+func teamsCard(event ActionEvent, message string) TeamsCard {
+	title := fmt.Sprintf("%s %s of %s", event.Action, event.ActionID, event.ConfigName)
+	card := TeamsCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    title,
+		ThemeColor: teamsColors[event.Status],
+		Title:      title,
+		Text:       message,
+	}
+	if event.OutURL != "" {
+		card.PotentialAction = []TeamsAction{
+			{Type: "OpenUri", Name: "Output logs", Targets: []TeamsTarget{{OS: "default", URI: event.OutURL}}},
+			{Type: "OpenUri", Name: "Error logs", Targets: []TeamsTarget{{OS: "default", URI: event.ErrURL}}},
+		}
+	}
+	return card
+}
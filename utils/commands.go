@@ -6,45 +6,64 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 var stdouterr []byte
 
-//It will clone the git repo which contains the configuration file.
-func cloneRepo(msg ConfigRequest) ([]byte, string, error) {
-	gitURL := msg.GitURL
-	urlPath, err := url.Parse(msg.GitURL)
+//It will return the name of the configuration cloned from the git url.
+func repoName(gitURL string) (string, error) {
+	urlPath, err := url.Parse(gitURL)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 	baseName := filepath.Base(urlPath.Path)
 	extName := filepath.Ext(urlPath.Path)
-	p := baseName[:len(baseName)-len(extName)]
-	if _, err := os.Stat(currentDir + "/" + p); err == nil {
-		stdouterr, err = pullRepo(p)
+	return baseName[:len(baseName)-len(extName)], nil
+}
 
-	} else {
-		cmd := exec.Command("git", "clone", gitURL)
-		fmt.Println(cmd.Args)
-		cmd.Dir = currentDir
-		stdouterr, err = cmd.CombinedOutput()
+//It will clone the git repo which contains the configuration file into
+//dir/<config id>, check out its ref and write its variables and backend
+//override in its path.
+//Git authenticates with the credentials of the configuration.
+func cloneRepo(dir string, config ConfigRecord) ([]byte, error) {
+	auth, err := newGitAuth(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	defer auth.close()
+
+	gitURL := config.GitURL
+	confDir := dir + "/" + config.ID
+	if _, err := os.Stat(confDir); os.IsNotExist(err) {
+		stdouterr, err = git(auth, dir, "clone", gitURL, config.ID)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 	}
-	path := currentDir + "/" + p + "/terraform.tfvars"
+	_, err = checkoutRepo(auth, confDir, config.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	workDir := filepath.Join(confDir, config.Path)
+	if info, err := os.Stat(workDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("there is no directory %s in the repo", config.Path)
+	}
+	path := workDir + "/terraform.tfvars"
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		createFile(msg, path)
+		createFile(config.Variables, path)
 	} else {
 		err = os.Remove(path)
-		createFile(msg, path)
+		createFile(config.Variables, path)
 	}
+	err = writeBackendOverride(workDir, config)
 
-	return stdouterr, p, err
+	return stdouterr, err
 }
 
 //It will create a vars file
-func createFile(msg ConfigRequest, path string) {
+func createFile(variables []ConfigVariable, path string) {
 	// detect if file exists
 
 	_, err := os.Stat(path)
@@ -58,18 +77,79 @@ func createFile(msg ConfigRequest, path string) {
 		defer file.Close()
 	}
 
-	writeFile(path, msg)
+	writeFile(path, variables)
+}
+
+//It will fetch the repo and check out the ref, a branch, a tag or a commit,
+//or the default branch when ref is empty. It returns the commit checked out.
+func checkoutRepo(auth *gitAuth, confDir, ref string) (string, error) {
+	_, err := git(auth, confDir, "fetch", "--force", "--tags", "--prune", "origin", "+refs/heads/*:refs/remotes/origin/*")
+	if err != nil {
+		return "", err
+	}
+	commit, err := resolveRef(auth, confDir, ref)
+	if err != nil {
+		return "", err
+	}
+	_, err = git(auth, confDir, "checkout", "--quiet", "--force", "--detach", commit)
+	if err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+//It will return the commit of the ref, looked up as a branch, a tag and then
+//a commit.
+func resolveRef(auth *gitAuth, confDir, ref string) (string, error) {
+	candidates := []string{"refs/remotes/origin/HEAD"}
+	if ref != "" {
+		candidates = []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref, ref}
+	}
+	for _, candidate := range candidates {
+		out, err := git(auth, confDir, "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+	}
+	if ref != "" {
+		// A commit no branch or tag points to
+		_, err := git(auth, confDir, "fetch", "origin", ref)
+		if err == nil {
+			out, err := git(auth, confDir, "rev-parse", "--verify", "--quiet", "FETCH_HEAD^{commit}")
+			if err == nil {
+				return strings.TrimSpace(string(out)), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("there is no branch, tag or commit %s in the repo", ref)
 }
 
-func pullRepo(repoName string) ([]byte, error) {
-	cmd := exec.Command("git", "pull")
+//It will run git in the repo and return its output. The credentials are
+//passed in the environment of git, so they are not logged with its args.
+func git(auth *gitAuth, confDir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
 	fmt.Println(cmd.Args)
-	cmd.Dir = currentDir + "/" + repoName
-	stdoutStderr, err := cmd.CombinedOutput()
+	if auth != nil {
+		cmd.Args = append(append([]string{"git"}, auth.args...), args...)
+		cmd.Env = append(os.Environ(), auth.env...)
+	}
+	cmd.Dir = confDir
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, err
+		return out, fmt.Errorf("git %s failed: %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+//It will return the commit checked out in the repo.
+func gitHead(confDir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = confDir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
 	}
-	return stdoutStderr, err
+	return strings.TrimSpace(string(out)), nil
 }
 
 func removeRepo(path, repoName string) error {
@@ -78,7 +158,7 @@ func removeRepo(path, repoName string) error {
 	return err
 }
 
-func writeFile(path string, msg ConfigRequest) {
+func writeFile(path string, variables []ConfigVariable) {
 	// open file using READ & WRITE permission
 	var file, err = os.OpenFile(path, os.O_RDWR, 0644)
 	if err != nil {
@@ -86,10 +166,12 @@ func writeFile(path string, msg ConfigRequest) {
 	}
 	defer file.Close()
 
-	variables := msg.VariableStore
-
-	for _, v := range *variables {
-		_, err = file.WriteString(v.Name + " = \"" + v.Value + "\" \n")
+	for _, v := range variables {
+		// Sensitive values are given to terraform in its environment
+		if v.Sensitive {
+			continue
+		}
+		_, err = file.WriteString(v.Name + " = " + v.hcl() + "\n")
 	}
 
 	// save changes
@@ -0,0 +1,488 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var configIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+var refRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/+-]*$`)
+
+//errConfigTaken is returned when the ID asked for is used by another repo.
+var errConfigTaken = errors.New("the configuration id is used by another repo, PATCH the configuration to change its repo")
+
+// ConfigRecord -
+type ConfigRecord struct {
+	Tenant       string                `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ID           string                `json:"id" description:"ID of the configuration, used in the URLs of its actions"`
+	GitURL       string                `json:"git_url" description:"The git url of the configuration"`
+	Ref          string                `json:"ref,omitempty" description:"The branch, tag or commit checked out, the default branch if empty"`
+	Path         string                `json:"path,omitempty" description:"Subdirectory of the repo terraform runs in, the root if empty"`
+	CommitSHA    string                `json:"commit_sha,omitempty" description:"Commit checked out when the configuration was last updated"`
+	Credentials  *GitCredentials       `json:"credentials,omitempty" description:"Credentials of a private repo, with the token or key encrypted"`
+	Variables    []ConfigVariable      `json:"variables" description:"The variables of the configuration"`
+	SlackWebhook string                `json:"slack_webhook,omitempty" description:"Slack incoming webhook the server posts the drift of the configuration to"`
+	Channels     []NotificationChannel `json:"channels,omitempty" description:"Slack, Teams, Mattermost and email channels the events of the actions are sent to"`
+	Expiry       *ConfigExpiry         `json:"expiry,omitempty" description:"When the server destroys the resources, set by an apply with a ttl"`
+	CreatedBy    string                `json:"created_by,omitempty" description:"Who created the configuration"`
+	CreatedAt    time.Time             `json:"created_at"`
+	UpdatedAt    time.Time             `json:"updated_at"`
+}
+
+// ConfigVariable -
+type ConfigVariable struct {
+	Name      string `json:"name" description:"The variable's name"`
+	Value     string `json:"value,omitempty" description:"The variable's value, encrypted when it is sensitive and never returned by the API"`
+	Type      string `json:"type,omitempty" description:"Empty for a string, json for a JSON value and hcl for an HCL expression"`
+	Sensitive bool   `json:"sensitive,omitempty" description:"The value is kept out of terraform.tfvars and the logs"`
+}
+
+// ConfigPatch -
+type ConfigPatch struct {
+	GitURL        *string                `json:"git_url,omitempty" description:"The new git url of the configuration"`
+	Ref           *string                `json:"ref,omitempty" description:"The new branch, tag or commit, empty for the default branch"`
+	Path          *string                `json:"path,omitempty" description:"The new subdirectory, empty for the root of the repo"`
+	Credentials   *GitCredentials        `json:"credentials,omitempty" description:"The new credentials of the repo, {} removes them"`
+	VariableStore *VariablesRequest      `json:"variablestore,omitempty" description:"Replaces all the variables"`
+	SlackWebhook  *string                `json:"slack_webhook,omitempty" description:"The new Slack incoming webhook, empty for the default one"`
+	Channels      *[]NotificationChannel `json:"channels,omitempty" description:"Replaces all the notification channels, [] removes them"`
+}
+
+//ConfigStore keeps the configuration records.
+type ConfigStore interface {
+	//InsertConfig adds the configuration. It returns ErrDuplicate if the
+	//tenant already has a configuration with that ID.
+	InsertConfig(config ConfigRecord) error
+	//SaveConfig replaces the record of the configuration but its expiry,
+	//which only SwapExpiry changes.
+	SaveConfig(config ConfigRecord) error
+	//SwapExpiry replaces the expiry of the configuration, nil for none, if it
+	//is still old. It returns ErrNotFound when the expiry changed meanwhile,
+	//another request or server updated it.
+	SwapExpiry(tenant, id string, old, expiry *ConfigExpiry) error
+	//GetConfig returns the configuration of the tenant or ErrNotFound.
+	GetConfig(tenant, id string) (ConfigRecord, error)
+	//ListConfigs returns the configurations of the tenant.
+	ListConfigs(tenant string) ([]ConfigRecord, error)
+	//ListAllConfigs returns the configurations of all the tenants.
+	ListAllConfigs() ([]ConfigRecord, error)
+	//DeleteConfig removes the configuration.
+	DeleteConfig(tenant, id string) error
+}
+
+//configVariables returns the variables of the request as stored on the
+//configuration, with the sensitive values encrypted.
+func configVariables(variables *VariablesRequest) ([]ConfigVariable, error) {
+	configVars := []ConfigVariable{}
+	if variables == nil {
+		return configVars, nil
+	}
+	for _, v := range *variables {
+		value, typ, err := parseVariableValue(v.Name, v.Value, v.HCL)
+		if err != nil {
+			return nil, err
+		}
+		if v.Sensitive {
+			value, err = encryptSecret(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		configVars = append(configVars, ConfigVariable{Name: v.Name, Value: value, Type: typ, Sensitive: v.Sensitive})
+	}
+	return configVars, nil
+}
+
+//checkRef tells if ref can be given to git as a branch, tag or commit.
+func checkRef(ref string) error {
+	if ref != "" && (!refRegexp.MatchString(ref) || strings.Contains(ref, "..")) {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+//cleanConfigPath returns the subdirectory of the repo terraform runs in, ""
+//for the root. It cannot leave the repo.
+func cleanConfigPath(p string) (string, error) {
+	clean := path.Clean(p)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || clean == ".git" || strings.HasPrefix(clean, ".git/") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+//configDir returns the directory terraform runs in for the configuration.
+func configDir(ws Workspace, config ConfigRecord) string {
+	return path.Join(ws.Dir, config.ID, config.Path)
+}
+
+//jobConfig returns the configuration of the job. A configuration cloned
+//before they were recorded has the default ref and path.
+func jobConfig(store ActionStore, job Job) (ConfigRecord, error) {
+	config, err := store.GetConfig(job.Tenant, job.ConfigName)
+	if err == ErrNotFound {
+		return ConfigRecord{Tenant: job.Tenant, ID: job.ConfigName}, nil
+	}
+	return config, err
+}
+
+//withoutValues returns the configuration as shown by the API, with the
+//variable names only and the credentials and sensitive values masked.
+func (c ConfigRecord) withoutValues() ConfigRecord {
+	c.Credentials = c.Credentials.masked()
+	variables := []ConfigVariable{}
+	for _, v := range c.Variables {
+		variable := ConfigVariable{Name: v.Name, Type: v.Type, Sensitive: v.Sensitive}
+		if v.Sensitive {
+			variable.Value = maskedSecret
+		}
+		variables = append(variables, variable)
+	}
+	c.Variables = variables
+	return c
+}
+
+//configID returns the ID of the configuration of the request. The
+//configuration of the same repo, ref and path keeps its ID. A new one is named
+//after the repo, with a random suffix if the name is taken.
+func configID(store ActionStore, ws Workspace, msg ConfigRequest) (string, error) {
+	if msg.ID != "" {
+		if !configIDRegexp.MatchString(msg.ID) || reservedDirs[msg.ID] {
+			return "", fmt.Errorf("invalid configuration id %q", msg.ID)
+		}
+		free, err := configIDFree(store, ws, msg.ID, msg)
+		if err != nil {
+			return "", err
+		}
+		if !free {
+			return "", errConfigTaken
+		}
+		return msg.ID, nil
+	}
+
+	configs, err := store.ListConfigs(ws.Tenant)
+	if err != nil {
+		return "", err
+	}
+	for _, config := range configs {
+		if config.GitURL == msg.GitURL && config.Ref == msg.Ref && config.Path == msg.Path {
+			return config.ID, nil
+		}
+	}
+
+	name, err := repoName(msg.GitURL)
+	if err != nil {
+		return "", err
+	}
+	if !configIDRegexp.MatchString(name) {
+		return "", fmt.Errorf("cannot name a configuration after %s", msg.GitURL)
+	}
+
+	id := name
+	for {
+		if !reservedDirs[id] {
+			free, err := configIDFree(store, ws, id, msg)
+			if err != nil {
+				return "", err
+			}
+			if free {
+				return id, nil
+			}
+		}
+		id = name + "-" + newActionID()[:6]
+	}
+}
+
+//configIDFree tells if the configuration of the request can use the ID,
+//because it is unused or already used by the same repo.
+func configIDFree(store ActionStore, ws Workspace, id string, msg ConfigRequest) (bool, error) {
+	config, err := store.GetConfig(ws.Tenant, id)
+	if err == nil {
+		return config.GitURL == msg.GitURL && config.Ref == msg.Ref && config.Path == msg.Path, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+	// A configuration cloned before they were recorded
+	confDir := path.Join(ws.Dir, id)
+	if _, err := os.Stat(confDir); os.IsNotExist(err) {
+		return true, nil
+	}
+	return gitRemote(confDir) == msg.GitURL, nil
+}
+
+//recloneRepo clones the repo of the configuration again, after its git url
+//changed. The old clone is put back if it fails. It is kept meanwhile in a
+//directory of its own whose name cannot be a configuration id, on the same
+//file system so it is only renamed.
+func recloneRepo(dir string, config ConfigRecord) error {
+	confDir := path.Join(dir, config.ID)
+	backupDir, err := ioutil.TempDir(dir, ".reclone-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(backupDir)
+	oldDir := path.Join(backupDir, config.ID)
+	err = os.Rename(confDir, oldDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = cloneRepo(dir, config)
+	if err != nil {
+		os.RemoveAll(confDir)
+		os.Rename(oldDir, confDir)
+		return err
+	}
+	return nil
+}
+
+//writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	output, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+//ConfListHandler handles request to list the configurations.
+// @Title ConfListHandler
+// @Description List the configurations of the tenant.
+// @Param   X-Tenant     header    string     false "tenant to work in"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} ConfigRecord
+// @Failure 500 {object} string
+// @Router /v1/configuration [get]
+func ConfListHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configs, err := store.ListConfigs(RequestTenant(r))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for i := range configs {
+			configs[i] = configs[i].withoutValues()
+		}
+		writeJSON(w, configs)
+	}
+}
+
+//ConfGetHandler handles request to get the configuration.
+// @Title ConfGetHandler
+// @Description Get the configuration.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ConfigRecord
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name} [get]
+func ConfGetHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		config, err := store.GetConfig(RequestTenant(r), repoName)
+		if err == ErrNotFound {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, config.withoutValues())
+	}
+}
+
+//ConfPatchHandler handles request to update the configuration.
+// @Title ConfPatchHandler
+// @Description Change the git url, the ref, the path, the credentials, the variables or the notification channels of the configuration. The repo is cloned again when its git url changes.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   body     body     ConfigPatch   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ConfigRecord
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name} [patch]
+func ConfPatchHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		// Read body
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var patch ConfigPatch
+		err = json.Unmarshal(b, &patch)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if patch.GitURL != nil && *patch.GitURL == "" {
+			http.Error(w, "EMPTY GIT URL", 400)
+			return
+		}
+		if patch.Ref != nil {
+			err = checkRef(*patch.Ref)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if patch.Path != nil {
+			*patch.Path, err = cleanConfigPath(*patch.Path)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		if patch.Channels != nil {
+			err = checkChannels(*patch.Channels)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		var variables []ConfigVariable
+		if patch.VariableStore != nil {
+			variables, err = configVariables(patch.VariableStore)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		var credentials *GitCredentials
+		if patch.Credentials != nil {
+			credentials, err = sealCredentials(patch.Credentials)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		randomID := newActionID()
+		err = lockConfig(store, ws.Tenant, repoName, "configure", randomID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlockConfig(store, ws.Tenant, repoName, randomID)
+
+		config, err := store.GetConfig(ws.Tenant, repoName)
+		if err == ErrNotFound {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		oldConfig := config
+		reclone := false
+		if patch.GitURL != nil && *patch.GitURL != config.GitURL {
+			config.GitURL = *patch.GitURL
+			reclone = true
+		}
+		if patch.Ref != nil {
+			config.Ref = *patch.Ref
+		}
+		oldDir := configDir(ws, config)
+		if patch.Path != nil {
+			config.Path = *patch.Path
+		}
+		if patch.Credentials != nil {
+			config.Credentials = credentials
+		}
+		if patch.VariableStore != nil {
+			config.Variables = variables
+		}
+		if patch.SlackWebhook != nil {
+			config.SlackWebhook = *patch.SlackWebhook
+		}
+		if patch.Channels != nil {
+			config.Channels = *patch.Channels
+		}
+		config.UpdatedAt = time.Now()
+
+		if reclone {
+			err = recloneRepo(ws.Dir, config)
+		} else {
+			_, err = cloneRepo(ws.Dir, config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		err = checkVariables(ws, config)
+		if err != nil {
+			// Put back the repo, checkout and variables of the configuration
+			var restoreErr error
+			if reclone {
+				restoreErr = recloneRepo(ws.Dir, oldConfig)
+			} else {
+				_, restoreErr = cloneRepo(ws.Dir, oldConfig)
+			}
+			if restoreErr != nil {
+				log.Println("Failed to restore the configuration : ", restoreErr)
+			}
+			if oldDir != configDir(ws, config) {
+				os.Remove(path.Join(configDir(ws, config), "terraform.tfvars"))
+			}
+			writeVariablesError(w, err)
+			return
+		}
+		if oldDir != configDir(ws, config) {
+			// The variables are written in the new path now
+			os.Remove(path.Join(oldDir, "terraform.tfvars"))
+		}
+		config.CommitSHA, err = gitHead(path.Join(ws.Dir, repoName))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		err = store.SaveConfig(config)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Println("Updated configuration " + repoName)
+
+		err = TerraformInit(configDir(ws, config), ws.LogDir, repoName, &planTimeOut, randomID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, config.withoutValues())
+	}
+}
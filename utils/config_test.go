@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+//gitRepo makes a git repo with a main.tf.
+func gitRepo(t *testing.T) string {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte("variable \"a\" {}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "."},
+		{"add", "."},
+		{"-c", "user.email=test@example.com", "-c", "user.name=test", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+	return dir
+}
+
+func TestRecloneRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := gitRepo(t)
+	dir := t.TempDir()
+	// foo.old is another configuration, not a leftover of foo
+	for _, name := range []string{"foo", "foo.old"} {
+		err := os.MkdirAll(filepath.Join(dir, name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name, "marker"), []byte(name), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := recloneRepo(dir, ConfigRecord{ID: "foo", GitURL: filepath.Join(dir, "missing")})
+	if err == nil {
+		t.Fatal("cloning a missing repo succeeded")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "foo", "marker")); string(b) != "foo" {
+		t.Error("the old clone was not put back")
+	}
+
+	err = recloneRepo(dir, ConfigRecord{ID: "foo", GitURL: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo", "main.tf")); err != nil {
+		t.Error("the repo was not cloned:", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "foo.old", "marker")); string(b) != "foo.old" {
+		t.Error("the configuration foo.old was removed")
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("the backup of the old clone was left: %d entries", len(entries))
+	}
+}
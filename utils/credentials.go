@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+//maskedSecret is shown by the API in place of a stored secret.
+const maskedSecret = "********"
+
+//gitCredentialHelper answers git with the username and token in the
+//environment of the git process, so they are never on its command line.
+const gitCredentialHelper = `!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$GIT_API_USERNAME" "$GIT_API_TOKEN"; }; f`
+
+// GitCredentials -
+type GitCredentials struct {
+	Username   string `json:"username,omitempty" description:"User the HTTPS token is sent with, x-access-token if empty"`
+	Token      string `json:"token,omitempty" description:"HTTPS token or password, stored encrypted and never returned by the API"`
+	SSHKey     string `json:"ssh_key,omitempty" description:"SSH private key, stored encrypted and never returned by the API"`
+	KnownHosts string `json:"known_hosts,omitempty" description:"known_hosts lines of the git server, needed with ssh_key"`
+}
+
+//isEmpty tells if the credentials are unset, which removes them.
+func (c *GitCredentials) isEmpty() bool {
+	return c.Token == "" && c.SSHKey == ""
+}
+
+//sealCredentials checks the credentials of a request and returns them as
+//stored, with the token and key encrypted. It returns nil for empty
+//credentials.
+func sealCredentials(c *GitCredentials) (*GitCredentials, error) {
+	if c == nil || c.isEmpty() {
+		return nil, nil
+	}
+	if c.Token != "" && c.SSHKey != "" {
+		return nil, errors.New("give either a token or an ssh_key, not both")
+	}
+	if c.SSHKey != "" && strings.TrimSpace(c.KnownHosts) == "" {
+		return nil, errors.New("an ssh_key needs the known_hosts of the git server")
+	}
+
+	sealed := &GitCredentials{Username: c.Username, KnownHosts: c.KnownHosts}
+	var err error
+	if c.Token != "" {
+		sealed.Token, err = encryptSecret(c.Token)
+	} else {
+		sealed.SSHKey, err = encryptSecret(c.SSHKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+//masked returns the credentials as shown by the API.
+func (c *GitCredentials) masked() *GitCredentials {
+	if c == nil {
+		return nil
+	}
+	masked := *c
+	if masked.Token != "" {
+		masked.Token = maskedSecret
+	}
+	if masked.SSHKey != "" {
+		masked.SSHKey = maskedSecret
+	}
+	return &masked
+}
+
+//gitAuth is how git authenticates to the remote of a configuration: the
+//options and environment given to git and the files they refer to. A nil
+//gitAuth uses whatever git finds on the host.
+type gitAuth struct {
+	args []string
+	env  []string
+	dir  string
+}
+
+//newGitAuth decrypts the stored credentials for a git command. It returns nil
+//when there are none. The caller closes it when git is done.
+func newGitAuth(c *GitCredentials) (*gitAuth, error) {
+	if c == nil || c.isEmpty() {
+		return nil, nil
+	}
+	auth := &gitAuth{env: []string{"GIT_TERMINAL_PROMPT=0"}}
+
+	if c.Token != "" {
+		token, err := decryptSecret(c.Token)
+		if err != nil {
+			return nil, err
+		}
+		username := c.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		// The empty helper drops the helpers configured on the host
+		auth.args = []string{"-c", "credential.helper=", "-c", "credential.helper=" + gitCredentialHelper}
+		auth.env = append(auth.env, "GIT_API_USERNAME="+username, "GIT_API_TOKEN="+token)
+		return auth, nil
+	}
+
+	key, err := decryptSecret(c.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	auth.dir, err = ioutil.TempDir("", "git-ssh")
+	if err != nil {
+		return nil, err
+	}
+	keyFile := path.Join(auth.dir, "id")
+	knownHostsFile := path.Join(auth.dir, "known_hosts")
+	err = ioutil.WriteFile(keyFile, []byte(strings.TrimSpace(key)+"\n"), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(knownHostsFile, []byte(strings.TrimSpace(c.KnownHosts)+"\n"), 0600)
+	}
+	if err != nil {
+		auth.close()
+		return nil, err
+	}
+	auth.env = append(auth.env, "GIT_SSH_COMMAND=ssh -F /dev/null -i "+keyFile+" -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile="+knownHostsFile)
+	return auth, nil
+}
+
+//close removes the files of the credentials.
+func (a *gitAuth) close() {
+	if a != nil && a.dir != "" {
+		os.RemoveAll(a.dir)
+	}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cronSpec is a parsed cron expression, a bit per value of each field.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	//A day matches either day field when both are restricted, as in cron
+	domStar, dowStar bool
+}
+
+//cronField is the range and the names of the values of a field.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	//Sunday is 0 or 7
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//parseCron parses a cron expression of five fields, minute hour day-of-month
+//month day-of-week, or one of the @ macros.
+func parseCron(expr string) (cronSpec, error) {
+	var spec cronSpec
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return spec, fmt.Errorf("a cron expression has 5 fields, %q has %d", expr, len(fields))
+	}
+
+	var err error
+	if spec.minute, err = parseCronField(fields[0], cronMinute); err != nil {
+		return spec, err
+	}
+	if spec.hour, err = parseCronField(fields[1], cronHour); err != nil {
+		return spec, err
+	}
+	if spec.dom, err = parseCronField(fields[2], cronDom); err != nil {
+		return spec, err
+	}
+	if spec.month, err = parseCronField(fields[3], cronMonth); err != nil {
+		return spec, err
+	}
+	if spec.dow, err = parseCronField(fields[4], cronDow); err != nil {
+		return spec, err
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domStar = strings.HasPrefix(fields[2], "*")
+	spec.dowStar = strings.HasPrefix(fields[4], "*")
+	return spec, nil
+}
+
+//parseCronField parses a comma separated list of values, ranges and steps,
+//e.g. 1,15 or 9-17 or */10 or mon-fri.
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			i := strings.IndexByte(part, '-')
+			var err error
+			if low, err = cronValue(part[:i], f); err != nil {
+				return 0, err
+			}
+			if high, err = cronValue(part[i+1:], f); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range in %s %q", f.name, part)
+			}
+		default:
+			var err error
+			if low, err = cronValue(part, f); err != nil {
+				return 0, err
+			}
+			// A value with a step runs to the end of the range, as in cron
+			if step == 1 {
+				high = low
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+//cronValue returns the value of a number or a name of the field.
+func cronValue(s string, f cronField) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q, it must be between %d and %d", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+//matchesDay tells if the expression runs on the day of t.
+func (c cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+//next returns the first time after t the expression runs at, in the
+//location of t. It is the zero time when the expression never runs, e.g. on
+//the 30th of February.
+func (c cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var skip time.Time
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			skip = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			skip = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			skip = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			skip = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// A daylight saving change can take time.Date back
+		if !skip.After(t) {
+			skip = t.Add(time.Minute)
+		}
+		t = skip
+	}
+	return time.Time{}
+}
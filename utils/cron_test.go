@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "* * * * *"},
+		{expr: "0 9 * * mon-fri"},
+		{expr: "*/15 0-6,22-23 1,15 jan-jun,dec *"},
+		{expr: "5/10 * * * *"},
+		{expr: "0 0 * * 7"},
+		{expr: "@daily"},
+		{expr: "  @Weekly  "},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "10-5 * * * *", wantErr: true},
+		{expr: "* * * foo *", wantErr: true},
+		{expr: "@every 5m", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << uint(v)
+		}
+		return b
+	}
+	tests := []struct {
+		field string
+		f     cronField
+		want  uint64
+	}{
+		{field: "5", f: cronMinute, want: bits(5)},
+		{field: "1,2,3", f: cronHour, want: bits(1, 2, 3)},
+		{field: "9-11", f: cronHour, want: bits(9, 10, 11)},
+		{field: "*/20", f: cronMinute, want: bits(0, 20, 40)},
+		{field: "50/5", f: cronMinute, want: bits(50, 55)},
+		{field: "1-10/4", f: cronDom, want: bits(1, 5, 9)},
+		{field: "FEB,Apr", f: cronMonth, want: bits(2, 4)},
+		{field: "mon-wed", f: cronDow, want: bits(1, 2, 3)},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.f)
+		if err != nil || got != tt.want {
+			t.Errorf("parseCronField(%q) = %b, %v, want %b", tt.field, got, err, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{name: "next minute", expr: "* * * * *", from: at(time.UTC, "2026-03-10 10:00"), want: at(time.UTC, "2026-03-10 10:01")},
+		{name: "seconds are dropped", expr: "* * * * *", from: at(time.UTC, "2026-03-10 10:00").Add(30 * time.Second), want: at(time.UTC, "2026-03-10 10:01")},
+		{name: "later today", expr: "30 14 * * *", from: at(time.UTC, "2026-03-10 10:00"), want: at(time.UTC, "2026-03-10 14:30")},
+		{name: "tomorrow", expr: "30 9 * * *", from: at(time.UTC, "2026-03-10 10:00"), want: at(time.UTC, "2026-03-11 09:30")},
+		{name: "next weekday", expr: "0 9 * * mon-fri", from: at(time.UTC, "2026-03-13 10:00"), want: at(time.UTC, "2026-03-16 09:00")},
+		{name: "sunday as 7", expr: "0 0 * * 7", from: at(time.UTC, "2026-03-10 10:00"), want: at(time.UTC, "2026-03-15 00:00")},
+		{name: "next month", expr: "0 0 1 * *", from: at(time.UTC, "2026-01-31 12:00"), want: at(time.UTC, "2026-02-01 00:00")},
+		{name: "next year", expr: "@yearly", from: at(time.UTC, "2026-03-10 10:00"), want: at(time.UTC, "2027-01-01 00:00")},
+		{name: "day of month or day of week", expr: "0 0 13 * fri", from: at(time.UTC, "2026-03-01 00:00"), want: at(time.UTC, "2026-03-06 00:00")},
+		{name: "leap day", expr: "0 0 29 2 *", from: at(time.UTC, "2026-03-01 00:00"), want: at(time.UTC, "2028-02-29 00:00")},
+		{name: "never", expr: "0 0 30 2 *", from: at(time.UTC, "2026-03-01 00:00"), want: time.Time{}},
+		{name: "in the time zone", expr: "0 9 * * *", from: at(newYork, "2026-03-10 10:00"), want: at(newYork, "2026-03-11 09:00")},
+		{name: "skipped daylight saving hour", expr: "30 2 * * *", from: at(newYork, "2026-03-08 00:00"), want: at(newYork, "2026-03-09 02:30")},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := spec.next(tt.from)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: next(%s) of %q = %s, want %s", tt.name, tt.from, tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//publicURL is the URL the server is reached at, for the log links of the
+//actions it starts itself.
+var publicURL = "http://localhost:9080"
+
+//SetPublicURL sets the URL the server is reached at.
+func SetPublicURL(url string) {
+	publicURL = strings.TrimRight(url, "/")
+}
+
+//quietActions are the actions whose start and end are not posted to Slack,
+//a drift action only posts when the drift appears or clears.
+var quietActions = map[string]bool{
+	"drift": true,
+}
+
+// DriftReport -
+type DriftReport struct {
+	Drifted         bool             `json:"drifted" description:"The resources differ from the state"`
+	ResourceChanges []ResourceChange `json:"resource_changes" description:"The resources that differ from the state"`
+}
+
+//parseDrift returns the resources that changed outside of terraform in the
+//output of terraform show -json for a refresh-only plan.
+func parseDrift(b []byte) (*DriftReport, error) {
+	var plan planJSON
+	err := json.Unmarshal(b, &plan)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DriftReport{ResourceChanges: []ResourceChange{}}
+	for _, rc := range plan.ResourceDrift {
+		actions := rc.Change.Actions
+		if len(actions) == 0 || (len(actions) == 1 && actions[0] == "no-op") {
+			continue
+		}
+		report.ResourceChanges = append(report.ResourceChanges, ResourceChange{Address: rc.Address, Actions: actions})
+	}
+	report.Drifted = len(report.ResourceChanges) > 0
+	return report, nil
+}
+
+//TerraformDriftPlan runs a refresh-only plan of the configuration and tells
+//if the resources drifted from the state.
+func TerraformDriftPlan(configDir, stateDir, logDir, planFile string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) (bool, error) {
+	args := append([]string{"plan", "-refresh-only", "-detailed-exitcode", "-input=false"}, append(stateArgs(stateDir, scenario), fmt.Sprintf("-out=%s", planFile))...)
+	err := run("terraform", args, configDir, logDir, scenario, secrets, timeout, randomID)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		return true, nil
+	}
+	return false, err
+}
+
+//runDrift runs the refresh-only plan of the drift action and records its
+//report. Slack is told when the drift appears or clears.
+func runDrift(store ActionStore, ws Workspace, confDir string, secrets []ConfigVariable, job Job) error {
+	plan := planFile(ws, job.ActionID)
+	defer os.Remove(plan)
+
+	drifted, err := TerraformDriftPlan(confDir, ws.StateDir, ws.LogDir, plan, job.ConfigName, secrets, &planTimeOut, job.ActionID)
+	if err != nil {
+		return err
+	}
+	b, err := TerraformShowPlan(confDir, ws.LogDir, plan, &planTimeOut, job.ActionID)
+	if err != nil {
+		return err
+	}
+	report, err := parseDrift(b)
+	if err != nil {
+		return err
+	}
+	// An older terraform reports the drift in its exit code only
+	report.Drifted = report.Drifted || drifted
+
+	previous, err := lastDriftReport(store, job.Tenant, job.ConfigName)
+	if err != nil {
+		return err
+	}
+	actionResponse, err := store.GetAction(job.ActionID)
+	if err != nil {
+		return err
+	}
+	actionResponse.Drift = report
+	err = store.SaveAction(actionResponse)
+	if err != nil {
+		return err
+	}
+
+	if report.Drifted != (previous != nil && previous.Drifted) {
+		event, status := EventDriftCleared, "Drift cleared"
+		if report.Drifted {
+			event, status = EventDriftDetected, fmt.Sprintf("Drift detected on %d resources", len(report.ResourceChanges))
+		}
+		notify(store, job, event, status)
+	}
+	return nil
+}
+
+//lastDriftReport returns the report of the last completed drift action of
+//the configuration, nil when there is none.
+func lastDriftReport(store ActionStore, tenant, configName string) (*DriftReport, error) {
+	drifts, err := store.ListActions(tenant, configName, "drift")
+	if err != nil {
+		return nil, err
+	}
+	var last *ActionResponse
+	for i, drift := range drifts {
+		if drift.Status != StatusCompleted || drift.Drift == nil {
+			continue
+		}
+		if last == nil || drift.Timestamp > last.Timestamp {
+			last = &drifts[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+	return last.Drift, nil
+}
+
+//StartDriftDetection queues a drift action for every configuration every
+//interval.
+func StartDriftDetection(store ActionStore, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			detectDrift(store, interval)
+		}
+	}()
+	log.Printf("Detecting drift every %s\n", interval)
+}
+
+//detectDrift queues a drift action for the configurations that had none in
+//the last interval, so replicas sharing the store do not all queue one. A
+//configuration locked by another action is left for the next interval.
+func detectDrift(store ActionStore, interval time.Duration) {
+	configs, err := store.ListAllConfigs()
+	if err != nil {
+		log.Println("Failed to list the configurations : ", err)
+		return
+	}
+	for _, config := range configs {
+		due, err := driftDue(store, config, interval)
+		if err != nil {
+			log.Println("Failed to list the drift actions : ", err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		job := Job{
+			Tenant:     config.Tenant,
+			ConfigName: config.ID,
+			Action:     "drift",
+			Webhook:    config.SlackWebhook,
+			CreatedBy:  "drift-detection",
+		}
+		_, err = enqueueAction(store, job, publicURL+"/v1/configuration/"+config.ID+"/drift")
+		if _, ok := err.(*LockedError); ok {
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to queue the drift action of "+config.ID+" : ", err)
+		}
+	}
+}
+
+//driftDue tells if the configuration had no drift action in the last
+//interval.
+func driftDue(store ActionStore, config ConfigRecord, interval time.Duration) (bool, error) {
+	drifts, err := store.ListActions(config.Tenant, config.ID, "drift")
+	if err != nil {
+		return false, err
+	}
+	// Leave some room for the ticks of the replicas to drift apart
+	since := time.Now().Add(-interval * 9 / 10).Format("20060102150405")
+	for _, drift := range drifts {
+		if drift.Timestamp > since {
+			return false, nil
+		}
+	}
+	return true, nil
+}
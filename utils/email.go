@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"time"
+)
+
+//errNoSMTP is returned when an email channel is set but the server has no
+//SMTP server to send it through.
+var errNoSMTP = errors.New("email cannot be sent, the server was started without -smtpAddr")
+
+//smtpTimeout is how long sending an email may take.
+var smtpTimeout = 30 * time.Second
+
+//The SMTP server the emails are sent through, the credentials are only read
+//from the environment.
+var (
+	smtpAddr     string
+	smtpFrom     string
+	smtpUsername = os.Getenv("SMTP_USERNAME")
+	smtpPassword = os.Getenv("SMTP_PASSWORD")
+)
+
+//SetupSMTP sets the SMTP server, host:port, and the sender of the emails.
+func SetupSMTP(addr, from string) error {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP server %q, it must be host:port", addr)
+	}
+	_, err = mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %v", from, err)
+	}
+	smtpAddr = addr
+	smtpFrom = from
+	return nil
+}
+
+//sendEmail sends a plain text email to the recipients. The connection is
+//upgraded to TLS when the server supports it.
+func sendEmail(to []string, subject, body string) error {
+	if smtpAddr == "" {
+		return errNoSMTP
+	}
+	// The SMTP commands take the bare addresses, not "Name <address>"
+	from, err := mail.ParseAddress(smtpFrom)
+	if err != nil {
+		return err
+	}
+	rcpts := make([]*mail.Address, len(to))
+	for i, rcpt := range to {
+		rcpts[i], err = mail.ParseAddress(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+	host, _, _ := net.SplitHostPort(smtpAddr)
+	conn, err := net.DialTimeout("tcp", smtpAddr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if smtpUsername != "" {
+		err = c.Auth(smtp.PlainAuth("", smtpUsername, smtpPassword, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		err = c.Rcpt(rcpt.Address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(emailMessage(from, rcpts, subject, body))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//emailMessage returns the headers and the body of the email.
+func emailMessage(from *mail.Address, to []*mail.Address, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\n", from)
+	for i, rcpt := range to {
+		if i == 0 {
+			fmt.Fprintf(&b, "To: %s", rcpt)
+		} else {
+			fmt.Fprintf(&b, ", %s", rcpt)
+		}
+	}
+	fmt.Fprintf(&b, "\nSubject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+//fakeSMTP accepts one email and returns the commands and the data it was
+//sent.
+func fakeSMTP(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var lines []string
+		defer func() { received <- lines }()
+		tp.PrintfLine("220 test")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+			switch {
+			case strings.HasPrefix(line, "DATA"):
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				lines = append(lines, data...)
+				tp.PrintfLine("250 ok")
+			case strings.HasPrefix(line, "QUIT"):
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSendEmail(t *testing.T) {
+	defer func(addr, from, username string) {
+		smtpAddr, smtpFrom, smtpUsername = addr, from, username
+	}(smtpAddr, smtpFrom, smtpUsername)
+	addr, received := fakeSMTP(t)
+	err := SetupSMTP(addr, "Terraform API <tf@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpUsername = ""
+
+	err = sendEmail([]string{"Ops Team <ops@example.com>", "dev@example.com"}, "Plan done", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+	want := map[string]bool{
+		"MAIL FROM:<tf@example.com>":                          true,
+		"RCPT TO:<ops@example.com>":                           true,
+		"RCPT TO:<dev@example.com>":                           true,
+		`From: "Terraform API" <tf@example.com>`:              true,
+		`To: "Ops Team" <ops@example.com>, <dev@example.com>`: true,
+		"Subject: Plan done":                                  true,
+	}
+	for _, line := range lines {
+		// MAIL FROM may have parameters such as BODY=8BITMIME
+		if strings.HasPrefix(line, "MAIL FROM:") {
+			line = strings.Fields(line)[0] + " " + strings.Fields(line)[1]
+		}
+		delete(want, line)
+	}
+	for line := range want {
+		t.Errorf("%q was not sent, the server got %q", line, lines)
+	}
+
+	if sendEmail([]string{"not an address"}, "s", "b") == nil {
+		t.Error("an invalid recipient was accepted")
+	}
+}
@@ -4,7 +4,6 @@
 package utils
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -15,22 +14,23 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var httpClient *http.Client
-var sessionMgo *mgo.Session
-var githubToken string
-var githubIBMToken string
 var planTimeOut = 60 * time.Minute
 var currentOps = make(map[string]chan StatusResponse)
 
 // ConfigRequest -
 type ConfigRequest struct {
-	GitURL        string            `json:"git_url,required" description:"The git url of your configuraltion"`
-	VariableStore *VariablesRequest `json:"variablestore,omitempty" description:"The environments' variable store"`
-	LOGLEVEL      string            `json:"log_level,omitempty" description:"The log level defing by user."`
+	ID            string                `json:"id,omitempty" description:"ID to give the configuration, named after the repo if empty"`
+	GitURL        string                `json:"git_url,required" description:"The git url of your configuraltion"`
+	Ref           string                `json:"ref,omitempty" description:"The branch, tag or commit to check out, the default branch if empty"`
+	Path          string                `json:"path,omitempty" description:"Subdirectory of the repo to run terraform in, the root if empty"`
+	Credentials   *GitCredentials       `json:"credentials,omitempty" description:"Credentials of a private repo, the stored ones are kept if empty"`
+	VariableStore *VariablesRequest     `json:"variablestore,omitempty" description:"The environments' variable store"`
+	SlackWebhook  string                `json:"slack_webhook,omitempty" description:"Slack incoming webhook the server posts the drift of the configuration to, the default one if empty"`
+	Channels      []NotificationChannel `json:"channels,omitempty" description:"Slack, Teams, Mattermost and email channels the events of the actions are sent to"`
+	LOGLEVEL      string                `json:"log_level,omitempty" description:"The log level defing by user."`
 }
 
 // ConfigResponse -
@@ -46,11 +46,60 @@ type StatusResponse struct {
 
 // ActionResponse -
 type ActionResponse struct {
+	Tenant     string `json:"tenant,omitempty" description:"Tenant of the configuration"`
 	ConfigName string `json:"id,required" description:"Name of the configuration"`
 	Action     string `json:"action,required" description:"Action Name"`
 	ActionID   string `json:"action_id"`
 	Timestamp  string `json:"timestamp"`
 	Status     string `json:"status"`
+	Error      string `json:"error,omitempty" description:"Why the action failed"`
+	CreatedBy  string `json:"created_by,omitempty" description:"Who requested the action"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty" description:"When the action started to run"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" description:"When the action ended"`
+
+	Ref          string       `json:"ref,omitempty" description:"The ref the action was asked to run on instead of the one of the configuration"`
+	CommitSHA    string       `json:"commit_sha,omitempty" description:"Commit of the configuration the action ran on"`
+	StateSerial  int64        `json:"state_serial,omitempty" description:"Serial of the state the action started from"`
+	PlanActionID string       `json:"plan_action_id,omitempty" description:"The saved plan applied by the action"`
+	TTL          string       `json:"ttl,omitempty" description:"How long after the apply the server destroys the resources"`
+	PlanSummary  *PlanSummary `json:"plan_summary,omitempty" description:"Resource changes of a plan"`
+	Drift        *DriftReport `json:"drift,omitempty" description:"Resources that drifted from the state, for a drift action"`
+
+	Outputs       map[string]OutputValue `json:"outputs,omitempty" description:"Outputs of the state after an apply, without the sensitive values"`
+	OutputsSerial int64                  `json:"outputs_serial,omitempty" description:"Serial of the state the outputs are of"`
+
+	ApprovalsRequired int        `json:"approvals_required,omitempty" description:"Number of approvals the action needs to run"`
+	Approvals         []Approval `json:"approvals,omitempty" description:"Who approved or rejected the action"`
+}
+
+// ActionRequest -
+type ActionRequest struct {
+	PlanActionID string `json:"plan_action_id,omitempty" description:"Apply the plan saved by this plan action instead of planning again"`
+	Ref          string `json:"ref,omitempty" description:"Branch, tag or commit to run on this time instead of the one of the configuration"`
+	TTL          string `json:"ttl,omitempty" description:"Destroy the resources this long after the apply, e.g. 8h"`
+}
+
+//Action statuses
+const (
+	StatusQueued     = "Queued"
+	StatusInProgress = "In-Progress"
+	StatusCompleted  = "Completed"
+	StatusFailed     = "Failed"
+	StatusCancelled  = "Cancelled"
+
+	StatusPendingApproval = "Pending-Approval"
+	StatusRejected        = "Rejected"
+	StatusTimedOut        = "Timed-out"
+)
+
+//isFinished tells if the action has reached its final status.
+func isFinished(status string) bool {
+	switch status {
+	case StatusPendingApproval, StatusQueued, StatusInProgress:
+		return false
+	}
+	return true
 }
 
 // ActionDetails -
@@ -67,28 +116,21 @@ type VariablesRequest []EnvironmentVariableRequest
 
 // EnvironmentVariableRequest -
 type EnvironmentVariableRequest struct {
-	Name  string `json:"name,required" binding:"required" description:"The variable's name"`
-	Value string `json:"value,required" binding:"required" description:"The variable's value"`
+	Name      string          `json:"name,required" binding:"required" description:"The variable's name"`
+	Value     json.RawMessage `json:"value,required" binding:"required" description:"The variable's value, a string, number, boolean, list or map"`
+	HCL       bool            `json:"hcl,omitempty" description:"The value is a string holding an HCL expression, written as is"`
+	Sensitive bool            `json:"sensitive,omitempty" description:"Store the value encrypted and give it to terraform as a TF_VAR_ environment variable instead of writing it in terraform.tfvars"`
 }
 
 var currentDir = os.Getenv("MOUNT_DIR")
 
-var logDir = currentDir + "/log/"
-
-var stateDir = currentDir + "/state"
-
 func init() {
 
 	if currentDir == "" {
 		panic("MOUNT_DIR is not set. Please set MOUNT_DIR to continue")
 	}
 
-	if _, err := os.Stat(logDir); os.IsNotExist(err) {
-		os.MkdirAll(logDir, os.ModePerm)
-	}
-	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
-		os.MkdirAll(stateDir, os.ModePerm)
-	}
+	tenantWorkspace("").makeDirs()
 
 }
 
@@ -97,12 +139,15 @@ func init() {
 // @Description clone the configuration repo
 // @Accept  json
 // @Produce  json
+// @Param   X-Tenant     header    string     false "tenant to work in"
 // @Param   body     body     ConfigRequest   true "request body"
 // @Success 200 {object} ConfigResponse
 // @Failure 500 {object} string
 // @Failure 400 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
 // @Router /v1/configuration [post]
-func ConfHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func ConfHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// Read body
@@ -128,19 +173,134 @@ func ConfHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		err = checkRef(msg.Ref)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		msg.Path, err = cleanConfigPath(msg.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		credentials, err := sealCredentials(msg.Credentials)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		variables, err := configVariables(msg.VariableStore)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = checkChannels(msg.Channels)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
 		if msg.LOGLEVEL != "" {
 			os.Setenv("TF_LOG", msg.LOGLEVEL)
 		}
 
+		ws := requestWorkspace(r)
+		err = ws.makeDirs()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		configName, err := configID(store, ws, msg)
+		if err == errConfigTaken {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		randomID := newActionID()
+		err = lockConfig(store, ws.Tenant, configName, "configure", randomID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlockConfig(store, ws.Tenant, configName, randomID)
+
+		config, err := store.GetConfig(ws.Tenant, configName)
+		isNew := err == ErrNotFound
+		if isNew {
+			err = checkConfigQuota(store, ws.Tenant)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			config = ConfigRecord{
+				Tenant:    ws.Tenant,
+				ID:        configName,
+				CreatedBy: RequestIdentity(r).Subject,
+				CreatedAt: time.Now(),
+			}
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		oldConfig := config
+		config.GitURL = msg.GitURL
+		config.Ref = msg.Ref
+		config.Path = msg.Path
+		if credentials != nil {
+			config.Credentials = credentials
+		}
+		config.Variables = variables
+		config.SlackWebhook = msg.SlackWebhook
+		config.Channels = msg.Channels
+		config.UpdatedAt = time.Now()
+
 		log.Println("Will clone git repo")
 
-		_, configName, err := cloneRepo(msg)
+		_, statErr := os.Stat(path.Join(ws.Dir, configName))
+		_, err = cloneRepo(ws.Dir, config)
 		if err != nil {
+			if os.IsNotExist(statErr) {
+				removeRepo(ws.Dir, configName)
+			}
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		log.Println("\n", configName)
 
+		err = checkVariables(ws, config)
+		if err != nil {
+			if os.IsNotExist(statErr) {
+				removeRepo(ws.Dir, configName)
+			} else if !isNew {
+				// Put back the checkout and variables of the configuration
+				_, restoreErr := cloneRepo(ws.Dir, oldConfig)
+				if restoreErr != nil {
+					log.Println("Failed to restore the configuration : ", restoreErr)
+				}
+			}
+			writeVariablesError(w, err)
+			return
+		}
+
+		config.CommitSHA, err = gitHead(path.Join(ws.Dir, configName))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if isNew {
+			err = store.InsertConfig(config)
+		} else {
+			err = store.SaveConfig(config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
 		response.ConfigName = configName
 		log.Println(response)
 
@@ -149,13 +309,9 @@ func ConfHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		confDir := path.Join(currentDir, configName)
+		confDir := configDir(ws, config)
 
-		b = make([]byte, 10)
-		rand.Read(b)
-		randomID := fmt.Sprintf("%x", b)
-
-		err = TerraformInit(confDir, configName, &planTimeOut, randomID)
+		err = TerraformInit(confDir, ws.LogDir, configName, &planTimeOut, randomID)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -173,21 +329,51 @@ func ConfHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 // @Produce  json
 // @Success 200 {object} string
 // @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
 // @Router /v1/configuration/{repo_name} [delete]
-func ConfDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "DELETE" {
-		http.Error(w, "Invalid request method.", 405)
-	}
+func ConfDeleteHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Invalid request method.", 405)
+		}
 
-	vars := mux.Vars(r)
-	repoName := vars["repo_name"]
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
 
-	err := removeRepo(currentDir, repoName)
-	if err != nil {
-		w.WriteHeader(404)
-		log.Println(err)
-		w.Write([]byte(fmt.Sprintf("There is no config repo file for this request.")))
-		return
+		if reservedDirs[repoName] {
+			http.Error(w, "There is no config repo file for this request.", 404)
+			return
+		}
+
+		randomID := newActionID()
+		err := lockConfig(store, ws.Tenant, repoName, "delete", randomID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlockConfig(store, ws.Tenant, repoName, randomID)
+
+		err = removeRepo(ws.Dir, repoName)
+		if err != nil {
+			w.WriteHeader(404)
+			log.Println(err)
+			w.Write([]byte(fmt.Sprintf("There is no config repo file for this request.")))
+			return
+		}
+		removePlanFiles(store, ws, repoName)
+		err = store.DeleteConfig(ws.Tenant, repoName)
+		if err != nil && err != ErrNotFound {
+			log.Println("Failed to delete the configuration record : ", err)
+		}
+		err = deleteSchedules(store, ws.Tenant, repoName)
+		if err != nil {
+			log.Println("Failed to delete the schedules : ", err)
+		}
+		err = deleteWebhooks(store, ws.Tenant, repoName)
+		if err != nil {
+			log.Println("Failed to delete the webhooks : ", err)
+		}
 	}
 }
 
@@ -199,75 +385,15 @@ func ConfDeleteHandler(w http.ResponseWriter, r *http.Request) {
 // @Accept  json
 // @Produce  json
 // @Success 202 {object} ActionResponse
+// @Failure 400 {object} VariablesError
 // @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/plan [post]
-func PlanHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func PlanHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		webhook := r.Header.Get("SLACK_WEBHOOK_URL")
-		vars := mux.Vars(r)
-		repoName := vars["repo_name"]
-
-		var actionResponse ActionResponse
-		var statusResponse StatusResponse
-
-		log.Println("Url Param 'repo name' is: " + repoName)
-		confDir := path.Join(currentDir, repoName)
-
-		b := make([]byte, 10)
-		rand.Read(b)
-		randomID := fmt.Sprintf("%x", b)
-
-		outURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".out"
-		errURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".err"
-
-		// Post to slack that the action has started and the link logs
-		ResultToSlack(outURL, errURL, "plan", randomID, "In-Progress", webhook)
-
-		go func() {
-			pullRepo(repoName)
-			err := TerraformPlan(confDir, repoName, &planTimeOut, randomID)
-			if err != nil {
-				statusResponse.Error = err.Error()
-				statusResponse.Status = "Failed"
-
-				// Update the status in the db in case it is failed
-				err = UpdateMongodb(s, randomID, statusResponse.Status)
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-				return
-			}
-			statusResponse.Status = "Completed"
-
-			// Update the status in the db in case it is completed
-			err = UpdateMongodb(s, randomID, statusResponse.Status)
-			ResultToSlack(outURL, errURL, "plan", randomID, "Completed", webhook)
-		}()
-
-		w.WriteHeader(202)
-
-		actionResponse.Action = "plan"
-		actionResponse.ConfigName = repoName
-		actionResponse.ActionID = randomID
-		actionResponse.Timestamp = time.Now().Format("20060102150405")
-		actionResponse.Status = "In-Progress"
-
-		// Make an entry in the db
-		InsertMongodb(s, actionResponse)
-
-		output, err := json.MarshalIndent(actionResponse, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.Header().Set("content-type", "application/json")
-		w.Write(output)
-
+		queueAction(w, r, store, "plan")
 	}
 }
 
@@ -276,71 +402,19 @@ func PlanHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 // @Description Execute apply for the configuration.
 // @Param   SLACK_WEBHOOK_URL     header    string     false "provide slack webhook url"
 // @Param   repo_name     path    string     true "Repo Name"
+// @Param   body     body     ActionRequest   false "request body"
 // @Accept  json
 // @Produce  json
 // @Success 202 {object} ActionResponse
+// @Failure 400 {object} string
 // @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/apply [post]
-func ApplyHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func ApplyHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		webhook := r.Header.Get("SLACK_WEBHOOK_URL")
-
-		var actionResponse ActionResponse
-		var statusResponse StatusResponse
-
-		vars := mux.Vars(r)
-		repoName := vars["repo_name"]
-
-		log.Println("Url Param 'repo name' is: " + repoName)
-		confDir := path.Join(currentDir, repoName)
-
-		b := make([]byte, 10)
-		rand.Read(b)
-		randomID := fmt.Sprintf("%x", b)
-
-		outURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".out"
-		errURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".err"
-		ResultToSlack(outURL, errURL, "apply", randomID, "In-Progress", webhook)
-		go func() {
-
-			pullRepo(repoName)
-			err := TerraformApply(confDir, stateDir, repoName, &planTimeOut, randomID)
-			if err != nil {
-				statusResponse.Error = err.Error()
-				statusResponse.Status = "Failed"
-
-				err = UpdateMongodb(s, randomID, statusResponse.Status)
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-				return
-			}
-			statusResponse.Status = "Completed"
-			ResultToSlack(outURL, errURL, "apply", randomID, statusResponse.Status, webhook)
-			err = UpdateMongodb(s, randomID, statusResponse.Status)
-
-		}()
-		w.WriteHeader(202)
-		actionResponse.Action = "apply"
-		actionResponse.ConfigName = repoName
-		actionResponse.ActionID = randomID
-		actionResponse.Timestamp = time.Now().Format("20060102150405")
-		actionResponse.Status = "In-Progress"
-
-		InsertMongodb(s, actionResponse)
-		output, err := json.MarshalIndent(actionResponse, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.Header().Set("content-type", "application/json")
-		w.Write(output)
-
+		queueAction(w, r, store, "apply")
 	}
 }
 
@@ -352,68 +426,15 @@ func ApplyHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 // @Accept  json
 // @Produce  json
 // @Success 202 {object} ActionResponse
+// @Failure 400 {object} VariablesError
 // @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/destroy [post]
-func DestroyHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
-
+func DestroyHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		var actionResponse ActionResponse
-		var statusResponse StatusResponse
-
-		webhook := r.Header.Get("SLACK_WEBHOOK_URL")
-		vars := mux.Vars(r)
-		repoName := vars["repo_name"]
-
-		log.Println("Url Param 'repo name' is: " + repoName)
-		confDir := path.Join(currentDir, repoName)
-
-		b := make([]byte, 10)
-		rand.Read(b)
-		randomID := fmt.Sprintf("%x", b)
-
-		outURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".out"
-		errURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".err"
-		ResultToSlack(outURL, errURL, "destroy", randomID, "In-Progress", webhook)
-		go func() {
-			err := TerraformDestroy(confDir, stateDir, repoName, &planTimeOut, randomID)
-			if err != nil {
-				statusResponse.Error = err.Error()
-				statusResponse.Status = "Failed"
-
-				err = UpdateMongodb(s, randomID, statusResponse.Status)
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-				return
-			}
-			statusResponse.Status = "Completed"
-			ResultToSlack(outURL, errURL, "destroy", randomID, "Completed", webhook)
-			err = UpdateMongodb(s, randomID, statusResponse.Status)
-
-		}()
-
-		w.WriteHeader(202)
-		actionResponse.Action = "destroy"
-		actionResponse.ConfigName = repoName
-		actionResponse.ActionID = randomID
-		actionResponse.Timestamp = time.Now().Format("20060102150405")
-		actionResponse.Status = "In-Progress"
-
-		InsertMongodb(s, actionResponse)
-
-		output, err := json.MarshalIndent(actionResponse, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.Header().Set("content-type", "application/json")
-		w.Write(output)
-
+		queueAction(w, r, store, "destroy")
 	}
 }
 
@@ -426,73 +447,157 @@ func DestroyHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 // @Produce  json
 // @Success 202 {object} ActionResponse
 // @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/show [post]
-func ShowHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func ShowHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueAction(w, r, store, "show")
+	}
+}
 
+//DriftHandler handles request to check the configuration for drift.
+// @Title DriftHandler
+// @Description Run a refresh-only plan of the configuration and record the resources that drifted from the state.
+// @Param   SLACK_WEBHOOK_URL     header    string     false "provide slack webhook url"
+// @Param   repo_name     path    string     true "Repo Name"
+// @Accept  json
+// @Produce  json
+// @Success 202 {object} ActionResponse
+// @Failure 400 {object} VariablesError
+// @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 429 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/drift [post]
+func DriftHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		queueAction(w, r, store, "drift")
+	}
+}
+
+//refActions are the actions that check out a ref of the configuration.
+var refActions = map[string]bool{
+	"plan":    true,
+	"apply":   true,
+	"destroy": true,
+	"drift":   true,
+}
+
+//queueAction puts the action for the repo on the job queue and responds
+//with the action record.
+func queueAction(w http.ResponseWriter, r *http.Request, store ActionStore, action string) {
+	webhook := r.Header.Get("SLACK_WEBHOOK_URL")
+	vars := mux.Vars(r)
+	repoName := vars["repo_name"]
+	ws := requestWorkspace(r)
 
-		session := s.Copy()
-		defer session.Close()
+	log.Println("Url Param 'repo name' is: " + repoName)
 
-		var actionResponse ActionResponse
-		var statusResponse StatusResponse
+	if _, err := os.Stat(path.Join(ws.Dir, repoName)); reservedDirs[repoName] || err != nil {
+		http.Error(w, "There is no such configuration.", 404)
+		return
+	}
 
-		webhook := r.Header.Get("SLACK_WEBHOOK_URL")
-		vars := mux.Vars(r)
+	// Read body
+	var msg ActionRequest
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
 
-		repoName := vars["repo_name"]
+	if msg.Ref != "" {
+		if !refActions[action] || msg.PlanActionID != "" {
+			http.Error(w, "ref can only be given to plan, apply and destroy, and not with plan_action_id.", 400)
+			return
+		}
+		err = checkRef(msg.Ref)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
 
-		log.Println("Url Param 'repo name' is: " + repoName)
-		confDir := path.Join(currentDir, repoName)
+	if msg.TTL != "" {
+		if action != "apply" {
+			http.Error(w, "ttl can only be given to apply.", 400)
+			return
+		}
+		_, err = parseTTL(msg.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := store.GetConfig(ws.Tenant, repoName); err == ErrNotFound {
+			http.Error(w, "The configuration was cloned before ttls existed, post it again to give it a ttl.", 400)
+			return
+		}
+	}
 
-		b := make([]byte, 10)
-		rand.Read(b)
-		randomID := fmt.Sprintf("%x", b)
+	if msg.PlanActionID != "" {
+		if action != "apply" {
+			http.Error(w, "plan_action_id can only be given to apply.", 400)
+			return
+		}
+		err = checkSavedPlan(store, ws, repoName, msg.PlanActionID)
+		if _, ok := err.(*StalePlanError); ok {
+			removePlanFile(ws, msg.PlanActionID)
+		}
+		if err != nil {
+			writePlanError(w, err)
+			return
+		}
+	}
 
-		outURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".out"
-		errURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".err"
-		ResultToSlack(outURL, errURL, "show", randomID, "In-Progress", webhook)
-		go func() {
-			err := TerraformShow(confDir, stateDir, repoName, &planTimeOut, randomID)
+	// The variables of another ref are only known once it is checked out
+	if refActions[action] && msg.PlanActionID == "" && msg.Ref == "" {
+		config, err := store.GetConfig(ws.Tenant, repoName)
+		if err == nil {
+			err = checkVariables(ws, config)
 			if err != nil {
-				statusResponse.Error = err.Error()
-				statusResponse.Status = "Failed"
-
-				err = UpdateMongodb(s, randomID, statusResponse.Status)
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
+				writeVariablesError(w, err)
 				return
 			}
-			outURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".out"
-			errURL := "http://" + r.Host + "/" + r.URL.Path + "/" + randomID + ".err"
-
-			statusResponse.Status = "Completed"
-			ResultToSlack(outURL, errURL, "show", randomID, statusResponse.Status, webhook)
-			err = UpdateMongodb(s, randomID, statusResponse.Status)
-
-		}()
-		w.WriteHeader(202)
-
-		actionResponse.Action = "show"
-		actionResponse.ConfigName = repoName
-		actionResponse.ActionID = randomID
-		actionResponse.Timestamp = time.Now().Format("20060102150405")
-		actionResponse.Status = "In-Progress"
-
-		InsertMongodb(s, actionResponse)
-
-		output, err := json.MarshalIndent(actionResponse, "", "  ")
-		if err != nil {
+		} else if err != ErrNotFound {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		w.Header().Set("content-type", "application/json")
-		w.Write(output)
+	}
+
+	job := Job{
+		Tenant:       ws.Tenant,
+		ConfigName:   repoName,
+		Action:       action,
+		Webhook:      webhook,
+		PlanActionID: msg.PlanActionID,
+		Ref:          msg.Ref,
+		TTL:          msg.TTL,
+		CreatedBy:    RequestIdentity(r).Subject,
+	}
+	actionResponse, err := enqueueAction(store, job, "http://"+r.Host+"/"+r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
+	output, err := json.MarshalIndent(actionResponse, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(202)
+	w.Write(output)
 }
 
 //LogHandler handles request to get the log.
@@ -520,7 +625,7 @@ func LogHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Url Param 'action' is: " + action)
 	log.Println("Url Param 'actionID' is: " + actionID)
 
-	outFile, errFile, err := readLogFile(actionID)
+	outFile, errFile, err := readLogFile(requestWorkspace(r).LogDir, actionID)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
@@ -554,13 +659,10 @@ func LogHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 404 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/{action_name}/{action_id}/status [get]
-func StatusHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func StatusHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
 
 		var response StatusResponse
-		var actionResponse ActionResponse
 
 		vars := mux.Vars(r)
 		repoName := vars["repo_name"]
@@ -571,13 +673,17 @@ func StatusHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 		log.Println("Url Param 'action' is: " + action)
 		log.Println("Url Param 'actionID' is: " + actionID)
 
-		c := session.DB("action").C("actionDetails")
-		err := c.Find(bson.M{"actionid": actionID}).One(&actionResponse)
+		actionResponse, err := getTenantAction(store, RequestTenant(r), actionID)
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), 404)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		response.Status = actionResponse.Status
+		response.Error = actionResponse.Error
 		output, err := json.MarshalIndent(response, "", "  ")
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -598,7 +704,7 @@ func ViewLogHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	logFile := vars["log_file"]
 
-	body, err := ioutil.ReadFile(path.Join(logDir, logFile))
+	body, err := ioutil.ReadFile(path.Join(requestWorkspace(r).LogDir, logFile))
 	if err != nil {
 		w.WriteHeader(404)
 		log.Println(err)
@@ -620,18 +726,14 @@ func ViewLogHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 404 {object} string
 // @Failure 500 {object} string
 // @Router /v1/configuration/{repo_name}/{action_name} [get]
-func GetActionDetailsHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func GetActionDetailsHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
 
 		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
 		action := vars["action"]
 
-		var actionResponse []ActionResponse
-		c := session.DB("action").C("actionDetails")
-
-		err := c.Find(bson.M{"action": action}).All(&actionResponse)
+		actionResponse, err := store.ListActions(RequestTenant(r), repoName, action)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
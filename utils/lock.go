@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//ErrLocked is returned by a LockStore when the lock is held by another action.
+var ErrLocked = errors.New("locked")
+
+//lockingActions are the actions that change the configuration or its state,
+//or initialize its directory, and so must not run at the same time on a
+//configuration.
+var lockingActions = map[string]bool{
+	"plan":    true,
+	"apply":   true,
+	"destroy": true,
+	"drift":   true,
+	"show":    true,
+}
+
+// ConfigLock -
+type ConfigLock struct {
+	Tenant     string    `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName string    `json:"id" description:"Name of the configuration"`
+	ActionID   string    `json:"action_id" description:"The action holding the lock"`
+	Action     string    `json:"action" description:"Action Name"`
+	LockedAt   time.Time `json:"locked_at"`
+}
+
+//LockStore keeps the configuration locks. As the locks are in the store they
+//are shared by all the servers using it.
+type LockStore interface {
+	//AcquireLock takes lock.ConfigName of lock.Tenant for lock.ActionID. If
+	//another action holds it the current lock is returned with ErrLocked.
+	AcquireLock(lock ConfigLock) (ConfigLock, error)
+	//ReleaseLock releases the lock on the configuration if actionID holds it.
+	ReleaseLock(tenant, configName, actionID string) error
+	//GetLock returns the lock on the configuration or ErrNotFound.
+	GetLock(tenant, configName string) (ConfigLock, error)
+	//ForceUnlock releases the lock on the configuration whoever holds it.
+	ForceUnlock(tenant, configName string) error
+}
+
+//LockedError is returned when the configuration is locked by another action.
+type LockedError struct {
+	Lock ConfigLock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("configuration %s is locked by %s %s", e.Lock.ConfigName, e.Lock.Action, e.Lock.ActionID)
+}
+
+//lockConfig locks the configuration for the action.
+func lockConfig(store ActionStore, tenant, configName, action, actionID string) error {
+	lock := ConfigLock{
+		Tenant:     tenant,
+		ConfigName: configName,
+		ActionID:   actionID,
+		Action:     action,
+		LockedAt:   time.Now(),
+	}
+	holder, err := store.AcquireLock(lock)
+	if err == ErrLocked {
+		return &LockedError{Lock: holder}
+	}
+	return err
+}
+
+func unlockConfig(store ActionStore, tenant, configName, actionID string) {
+	err := store.ReleaseLock(tenant, configName, actionID)
+	if err != nil && err != ErrNotFound {
+		log.Println("Failed to release the lock : ", err)
+	}
+}
+
+//writeError writes err as a 409 with the lock holder when it is a
+//LockedError, as a 429 when it is a QuotaError and as a 500 otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	if lockedErr, ok := err.(*LockedError); ok {
+		output, _ := json.MarshalIndent(lockedErr.Lock, "", "  ")
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(409)
+		w.Write(output)
+		return
+	}
+	if _, ok := err.(*QuotaError); ok {
+		http.Error(w, err.Error(), 429)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+//LockHandler handles request to get the lock on the configuration.
+// @Title LockHandler
+// @Description Get the action holding the lock on the configuration.
+// @Param   repo_name     path    string     true "repo name"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ConfigLock
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/lock [get]
+func LockHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		lock, err := store.GetLock(RequestTenant(r), repoName)
+		if err == ErrNotFound {
+			http.Error(w, "The configuration is not locked.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		output, err := json.MarshalIndent(lock, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(output)
+	}
+}
+
+//UnlockHandler handles request to force unlock the configuration.
+// @Title UnlockHandler
+// @Description Release the lock on the configuration whichever action holds it.
+// @Param   repo_name     path    string     true "repo name"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/lock [delete]
+func UnlockHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		err := store.ForceUnlock(RequestTenant(r), repoName)
+		if err == ErrNotFound {
+			http.Error(w, "The configuration is not locked.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Println("Force unlocked configuration " + repoName)
+		w.WriteHeader(200)
+	}
+}
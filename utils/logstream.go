@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var logPollInterval = 500 * time.Millisecond
+
+// LogEvent -
+type LogEvent struct {
+	Stream    string `json:"stream" description:"stdout, stderr or status"`
+	Line      string `json:"line,omitempty" description:"The log line"`
+	Status    string `json:"status,omitempty" description:"Final status of the action, set on the status event"`
+	OutOffset int64  `json:"out_offset" description:"Offset in the output log after this event"`
+	ErrOffset int64  `json:"err_offset" description:"Offset in the error log after this event"`
+}
+
+//maxLogRead is how much of a log is read at once, a longer line is sent in
+//parts.
+const maxLogRead = 1 << 20
+
+//logTail follows a log file written by run.
+type logTail struct {
+	path   string
+	offset int64
+}
+
+//next returns the complete lines written after the offset, each with its
+//newline. A line that does not fit in maxLogRead is returned in parts, and so
+//is the last line of a finished log without a newline. The caller moves the
+//offset past the lines it used.
+func (t *logTail) next(finished bool) ([]string, error) {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		// The action has not started yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(t.offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxLogRead))
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(b, '\n') + 1
+	switch {
+	case finished && len(b) < maxLogRead:
+		end = len(b)
+	case end == 0 && len(b) == maxLogRead:
+		// A part of a long line, cut before a rune that does not fit
+		end = len(b)
+		for i := len(b) - 1; i >= len(b)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i]) {
+				if !utf8.FullRune(b[i:]) {
+					end = i
+				}
+				break
+			}
+		}
+	}
+	var lines []string
+	for _, line := range strings.SplitAfter(string(b[:end]), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+//streamLog sends the lines of the action logs from the given offsets as they
+//are written, and a status event once the action has finished. It stops
+//early when done is closed or send fails.
+func streamLog(store ActionStore, logDir, actionID string, outOffset, errOffset int64, send func(LogEvent) error, done <-chan struct{}) error {
+	stdout := &logTail{path: path.Join(logDir, actionID+".out"), offset: outOffset}
+	stderr := &logTail{path: path.Join(logDir, actionID+".err"), offset: errOffset}
+
+	for {
+		// Read the status first so the logs are drained once more after the
+		// action has finished.
+		actionResponse, err := store.GetAction(actionID)
+		if err != nil {
+			return err
+		}
+		finished := isFinished(actionResponse.Status)
+
+		for _, tail := range []*logTail{stdout, stderr} {
+			// Read until the end, the log may be longer than one read
+			for {
+				lines, err := tail.next(finished)
+				if err != nil {
+					return err
+				}
+				if len(lines) == 0 {
+					break
+				}
+				for _, line := range lines {
+					tail.offset += int64(len(line))
+					ev := LogEvent{Line: strings.TrimSuffix(line, "\n"), OutOffset: stdout.offset, ErrOffset: stderr.offset}
+					ev.Stream = "stdout"
+					if tail == stderr {
+						ev.Stream = "stderr"
+					}
+					err = send(ev)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if finished {
+			return send(LogEvent{Stream: "status", Status: actionResponse.Status, OutOffset: stdout.offset, ErrOffset: stderr.offset})
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+//streamOffsets returns the offsets to resume the logs from, given by the
+//out_offset and err_offset query parameters or by the Last-Event-ID header
+//sent by an EventSource when it reconnects.
+func streamOffsets(r *http.Request) (outOffset, errOffset int64, err error) {
+	query := r.URL.Query()
+	if id := r.Header.Get("Last-Event-ID"); id != "" && query.Get("out_offset") == "" && query.Get("err_offset") == "" {
+		_, err = fmt.Sscanf(id, "%d:%d", &outOffset, &errOffset)
+		return
+	}
+	if v := query.Get("out_offset"); v != "" {
+		outOffset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	if v := query.Get("err_offset"); v != "" {
+		errOffset, err = strconv.ParseInt(v, 10, 64)
+	}
+	return
+}
+
+//LogStreamHandler handles request to follow the log of an action.
+// @Title LogStreamHandler
+// @Description Stream the logs of the action as Server-Sent Events, or as WebSocket messages when the request is a WebSocket upgrade. The stream ends with a status event once the action has finished.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   action_name     path    string     true "action name"
+// @Param   action_id     path    string     true "action id"
+// @Param   out_offset     query    int     false "offset in the output log to resume from"
+// @Param   err_offset     query    int     false "offset in the error log to resume from"
+// @Produce  text/event-stream
+// @Success 200 {object} LogEvent
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/{action_name}/{action_id}/log/stream [get]
+func LogStreamHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		actionID := vars["actionID"]
+
+		log.Println("Url Param 'actionID' is: " + actionID)
+
+		_, err := getTenantAction(store, RequestTenant(r), actionID)
+		if err == ErrNotFound {
+			http.Error(w, "There is no such action.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		logDir := requestWorkspace(r).LogDir
+		outOffset, errOffset, err := streamOffsets(r)
+		if err != nil {
+			http.Error(w, "Invalid offset: "+err.Error(), 400)
+			return
+		}
+
+		if isWebSocketRequest(r) {
+			ws, err := upgradeWebSocket(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			defer ws.Close()
+
+			err = streamLog(store, logDir, actionID, outOffset, errOffset, func(ev LogEvent) error {
+				b, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				return ws.WriteText(b)
+			}, ws.closed)
+			if err != nil {
+				log.Println("Log stream of", actionID, "ended :", err)
+			}
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported.", 500)
+			return
+		}
+		w.Header().Set("content-type", "text/event-stream")
+		w.Header().Set("cache-control", "no-cache")
+		w.WriteHeader(200)
+		flusher.Flush()
+
+		err = streamLog(store, logDir, actionID, outOffset, errOffset, func(ev LogEvent) error {
+			data := ev.Line
+			if ev.Stream == "status" {
+				data = ev.Status
+			}
+			_, err := fmt.Fprintf(w, "id: %d:%d\nevent: %s\ndata: %s\n\n", ev.OutOffset, ev.ErrOffset, ev.Stream, data)
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}, r.Context().Done())
+		if err != nil {
+			log.Println("Log stream of", actionID, "ended :", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestStreamLog(t *testing.T) {
+	long := strings.Repeat("a", maxLogRead-1) + "é" + strings.Repeat("b", 10)
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{name: "lines", out: "one\ntwo\n", want: []string{"one", "two"}},
+		{name: "empty lines", out: "\n\nx\n", want: []string{"", "", "x"}},
+		{name: "last line without newline", out: "one\ntwo", want: []string{"one", "two"}},
+		{name: "line longer than a read", out: long + "\nafter\n", want: []string{strings.Repeat("a", maxLogRead-1), "é" + strings.Repeat("b", 10), "after"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		err := ioutil.WriteFile(filepath.Join(dir, "a1.out"), []byte(tt.out), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := NewMemoryStore()
+		store.InsertAction(ActionResponse{ActionID: "a1", Status: StatusCompleted})
+
+		var lines []string
+		var last LogEvent
+		err = streamLog(store, dir, "a1", 0, 0, func(ev LogEvent) error {
+			if ev.Stream == "stdout" {
+				lines = append(lines, ev.Line)
+				if !utf8.ValidString(ev.Line) {
+					t.Errorf("%s: invalid UTF-8 in %q", tt.name, ev.Line[len(ev.Line)-4:])
+				}
+			}
+			last = ev
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(lines, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: %d lines, want %d", tt.name, len(lines), len(tt.want))
+		}
+		if last.Stream != "status" || last.OutOffset != int64(len(tt.out)) {
+			t.Errorf("%s: last event %+v, want the status at offset %d", tt.name, last, len(tt.out))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Notification events
+const (
+	EventQueued          = "action.queued"
+	EventPendingApproval = "action.pending_approval"
+	EventStarted         = "action.started"
+	EventCompleted       = "action.completed"
+	EventFailed          = "action.failed"
+	EventCancelled       = "action.cancelled"
+	EventRejected        = "action.rejected"
+	EventTimedOut        = "action.timed_out"
+	EventDriftDetected   = "drift.detected"
+	EventDriftCleared    = "drift.cleared"
+	EventExpiring        = "config.expiring"
+)
+
+//notifyEvents are the events that can be subscribed to.
+var notifyEvents = map[string]bool{
+	EventQueued:          true,
+	EventPendingApproval: true,
+	EventStarted:         true,
+	EventCompleted:       true,
+	EventFailed:          true,
+	EventCancelled:       true,
+	EventRejected:        true,
+	EventTimedOut:        true,
+	EventDriftDetected:   true,
+	EventDriftCleared:    true,
+	EventExpiring:        true,
+}
+
+//statusEvents are the events of the action statuses.
+var statusEvents = map[string]string{
+	StatusPendingApproval: EventPendingApproval,
+	StatusInProgress:      EventStarted,
+	StatusCompleted:       EventCompleted,
+	StatusFailed:          EventFailed,
+	StatusCancelled:       EventCancelled,
+	StatusRejected:        EventRejected,
+	StatusTimedOut:        EventTimedOut,
+}
+
+// ActionEvent -
+type ActionEvent struct {
+	Event       string       `json:"event" description:"What happened, e.g. action.completed"`
+	Time        time.Time    `json:"time" description:"When it happened"`
+	Tenant      string       `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName  string       `json:"id" description:"Name of the configuration"`
+	Action      string       `json:"action" description:"Action Name"`
+	ActionID    string       `json:"action_id"`
+	Status      string       `json:"status" description:"Status of the action"`
+	Message     string       `json:"message,omitempty" description:"What happened, for the events that are not a change of status"`
+	Error       string       `json:"error,omitempty" description:"Why the action failed"`
+	CreatedBy   string       `json:"created_by,omitempty" description:"Who requested the action"`
+	Timestamp   string       `json:"timestamp" description:"When the action was requested"`
+	StartedAt   *time.Time   `json:"started_at,omitempty" description:"When the action started to run"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty" description:"When the action ended"`
+	CommitSHA   string       `json:"commit_sha,omitempty" description:"Commit of the configuration the action ran on"`
+	PlanSummary *PlanSummary `json:"plan_summary,omitempty" description:"Resource changes of a plan"`
+	Drift       *DriftReport `json:"drift,omitempty" description:"Resources that drifted from the state, for a drift action"`
+	OutURL      string       `json:"out_url,omitempty" description:"Output log of the action"`
+	ErrURL      string       `json:"err_url,omitempty" description:"Error log of the action"`
+}
+
+//Notifier sends the events of the actions somewhere.
+type Notifier interface {
+	//Notify sends the event. A notifier ignores the events it is not meant
+	//to send.
+	Notify(event ActionEvent) error
+}
+
+//slackEvents are the events posted to Slack.
+var slackEvents = map[string]bool{
+	EventPendingApproval: true,
+	EventStarted:         true,
+	EventCompleted:       true,
+	EventFailed:          true,
+	EventCancelled:       true,
+	EventRejected:        true,
+	EventTimedOut:        true,
+	EventDriftDetected:   true,
+	EventDriftCleared:    true,
+	EventExpiring:        true,
+}
+
+//slackNotifier posts the events to a Slack incoming webhook, the default one
+//if empty.
+type slackNotifier struct {
+	webhook string
+}
+
+//Notify posts the event to Slack.
+func (n slackNotifier) Notify(event ActionEvent) error {
+	if !slackEvents[event.Event] || (quietActions[event.Action] && strings.HasPrefix(event.Event, "action.")) {
+		return nil
+	}
+	return ResultToSlack(event, n.webhook)
+}
+
+//notifyQueueSize is how many events may wait for a destination before the
+//next ones are dropped.
+const notifyQueueSize = 100
+
+//notifyQueues are the events waiting to be sent, by destination. Each
+//destination sends its events in order in a goroutine of its own, so a dead
+//SMTP server or channel delays neither the jobs nor the other destinations.
+var (
+	notifyQueuesMu sync.Mutex
+	notifyQueues   = map[string]chan func(){}
+)
+
+//notify sends the event of the job to Slack and to the channels and the
+//webhooks of the configuration subscribed to it. message says what happened when the event
+//is not a change of the status of the action. The event is sent in the
+//background.
+func notify(store ActionStore, job Job, event, message string) {
+	actionEvent := newActionEvent(store, job, event, message)
+	for _, notifier := range jobNotifiers(store, job) {
+		notifier := notifier
+		sendInBackground(notifierDestination(notifier), func() {
+			err := notifier.Notify(actionEvent)
+			if err != nil {
+				log.Println("Failed to send the "+event+" event : ", err)
+			}
+		})
+	}
+}
+
+//notifierDestination returns where the notifier sends the events.
+func notifierDestination(notifier Notifier) string {
+	switch n := notifier.(type) {
+	case slackNotifier:
+		return "slack " + n.webhook
+	case channelNotifier:
+		return n.channel.Type + " " + n.channel.URL + " " + strings.Join(n.channel.To, ",")
+	case webhookNotifier:
+		return "webhook " + n.webhook.Tenant + "/" + n.webhook.ConfigName + "/" + n.webhook.WebhookID
+	}
+	return ""
+}
+
+//sendInBackground queues the send to the destination, it is dropped when
+//too many sends are waiting for it already.
+func sendInBackground(destination string, send func()) {
+	notifyQueuesMu.Lock()
+	queue, ok := notifyQueues[destination]
+	if !ok {
+		queue = make(chan func(), notifyQueueSize)
+		notifyQueues[destination] = queue
+		go func() {
+			for send := range queue {
+				send()
+			}
+		}()
+	}
+	notifyQueuesMu.Unlock()
+	select {
+	case queue <- send:
+	default:
+		log.Println("Dropped an event, too many are waiting to be sent to the same destination")
+	}
+}
+
+//newActionEvent returns the event of the job, with the record of its action.
+func newActionEvent(store ActionStore, job Job, event, message string) ActionEvent {
+	actionEvent := ActionEvent{
+		Event:      event,
+		Time:       time.Now().UTC(),
+		Tenant:     job.Tenant,
+		ConfigName: job.ConfigName,
+		Action:     job.Action,
+		ActionID:   job.ActionID,
+		Message:    message,
+		CreatedBy:  job.CreatedBy,
+		OutURL:     job.OutURL,
+		ErrURL:     job.ErrURL,
+	}
+	actionResponse, err := store.GetAction(job.ActionID)
+	if err != nil {
+		log.Println("Failed to get the action of the event : ", err)
+		return actionEvent
+	}
+	actionEvent.Status = actionResponse.Status
+	actionEvent.Error = actionResponse.Error
+	actionEvent.Timestamp = actionResponse.Timestamp
+	actionEvent.StartedAt = actionResponse.StartedAt
+	actionEvent.FinishedAt = actionResponse.FinishedAt
+	actionEvent.CommitSHA = actionResponse.CommitSHA
+	actionEvent.PlanSummary = actionResponse.PlanSummary
+	actionEvent.Drift = actionResponse.Drift
+	if actionEvent.CreatedBy == "" {
+		actionEvent.CreatedBy = actionResponse.CreatedBy
+	}
+	return actionEvent
+}
+
+//jobNotifiers returns the notifiers of the events of the job: Slack, the
+//channels and the enabled webhooks of the configuration.
+func jobNotifiers(store ActionStore, job Job) []Notifier {
+	notifiers := []Notifier{slackNotifier{webhook: job.Webhook}}
+	config, err := store.GetConfig(job.Tenant, job.ConfigName)
+	if err != nil && err != ErrNotFound {
+		log.Println("Failed to get the channels of the configuration : ", err)
+	}
+	for _, channel := range config.Channels {
+		notifiers = append(notifiers, channelNotifier{channel: channel})
+	}
+	webhooks, err := store.ListWebhooks(job.Tenant, job.ConfigName)
+	if err != nil {
+		log.Println("Failed to list the webhooks : ", err)
+		return notifiers
+	}
+	for _, webhook := range webhooks {
+		if webhook.Enabled {
+			notifiers = append(notifiers, webhookNotifier{store: store, webhook: webhook})
+		}
+	}
+	return notifiers
+}
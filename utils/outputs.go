@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+)
+
+// OutputValue -
+type OutputValue struct {
+	Sensitive bool            `json:"sensitive" description:"Terraform hides the value in its output"`
+	Type      json.RawMessage `json:"type,omitempty" description:"The type of the value"`
+	Value     json.RawMessage `json:"value" description:"The value, null for a sensitive output unless the caller is an admin"`
+}
+
+//readOutputs returns the outputs in the state of the configuration.
+func readOutputs(ws Workspace, config ConfigRecord) (map[string]OutputValue, error) {
+	b, err := TerraformOutput(configDir(ws, config), ws.StateDir, config.ID, &planTimeOut)
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]OutputValue{}
+	err = json.Unmarshal(b, &outputs)
+	return outputs, err
+}
+
+//withoutSensitive returns the outputs with the values of the sensitive ones
+//removed.
+func withoutSensitive(outputs map[string]OutputValue) map[string]OutputValue {
+	cleaned := map[string]OutputValue{}
+	for name, output := range outputs {
+		if output.Sensitive {
+			output.Value = json.RawMessage("null")
+		}
+		cleaned[name] = output
+	}
+	return cleaned
+}
+
+//hasSensitive tells if some of the outputs are sensitive.
+func hasSensitive(outputs map[string]OutputValue) bool {
+	for _, output := range outputs {
+		if output.Sensitive {
+			return true
+		}
+	}
+	return false
+}
+
+//saveOutputs records the outputs of the state on the apply action, without
+//the values of the sensitive ones, with the serial of the state they are of.
+func saveOutputs(store ActionStore, ws Workspace, config ConfigRecord, actionID string) error {
+	outputs, err := readOutputs(ws, config)
+	if err != nil {
+		return err
+	}
+	serial, err := stateSerial(store, ws, config.ID)
+	if err != nil {
+		return err
+	}
+
+	actionResponse, err := store.GetAction(actionID)
+	if err != nil {
+		return err
+	}
+	actionResponse.Outputs = withoutSensitive(outputs)
+	actionResponse.OutputsSerial = serial
+	return store.SaveAction(actionResponse)
+}
+
+//cachedOutputs returns the outputs recorded by the last apply, nil when they
+//are not of the current state.
+func cachedOutputs(store ActionStore, ws Workspace, repoName string) (map[string]OutputValue, error) {
+	applies, err := store.ListActions(ws.Tenant, repoName, "apply")
+	if err != nil {
+		return nil, err
+	}
+	var last *ActionResponse
+	for i, apply := range applies {
+		if apply.Status != StatusCompleted || apply.Outputs == nil {
+			continue
+		}
+		if last == nil || apply.Timestamp > last.Timestamp {
+			last = &applies[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+	serial, err := stateSerial(store, ws, repoName)
+	if err != nil || serial != last.OutputsSerial {
+		return nil, err
+	}
+	return last.Outputs, nil
+}
+
+//OutputsHandler handles request to get the outputs of the configuration.
+// @Title OutputsHandler
+// @Description Get the outputs in the state of the configuration. The values of sensitive outputs are only returned to admins.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} OutputValue
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/outputs [get]
+func OutputsHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		if _, err := os.Stat(path.Join(ws.Dir, repoName)); reservedDirs[repoName] || err != nil {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		_, err := readState(store, ws, repoName)
+		if err == ErrNotFound {
+			http.Error(w, "The configuration has not been applied.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		showSensitive := hasRole(r, RoleAdmin)
+
+		outputs, err := cachedOutputs(store, ws, repoName)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if outputs == nil || (showSensitive && hasSensitive(outputs)) {
+			config, err := jobConfig(store, Job{Tenant: ws.Tenant, ConfigName: repoName})
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			outputs, err = readOutputs(ws, config)
+			if err != nil {
+				log.Println("Failed to read the outputs : ", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		if !showSensitive {
+			outputs = withoutSensitive(outputs)
+		}
+		writeJSON(w, outputs)
+	}
+}
@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+)
+
+// PlanSummary -
+type PlanSummary struct {
+	Add             int              `json:"add" description:"Number of resources to add"`
+	Change          int              `json:"change" description:"Number of resources to change"`
+	Destroy         int              `json:"destroy" description:"Number of resources to destroy"`
+	ResourceChanges []ResourceChange `json:"resource_changes" description:"The resources that will change"`
+}
+
+// ResourceChange -
+type ResourceChange struct {
+	Address string   `json:"address" description:"Address of the resource"`
+	Actions []string `json:"actions" description:"create, update, delete or read, a replace is delete and create"`
+}
+
+//planJSON is the part of the output of terraform show -json we need.
+type planJSON struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+	ResourceDrift []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_drift"`
+}
+
+//planFile returns where the plan of the action is saved.
+func planFile(ws Workspace, actionID string) string {
+	return path.Join(ws.PlanDir, actionID+".tfplan")
+}
+
+//removePlanFile removes the saved plan of the action, which holds the
+//sensitive values of the configuration in plain text.
+func removePlanFile(ws Workspace, actionID string) {
+	err := os.Remove(planFile(ws, actionID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove the plan file : ", err)
+	}
+}
+
+//removePlanFiles removes the saved plans of the configuration, once its
+//state changed and they can no longer be applied, or once it is deleted.
+func removePlanFiles(store ActionStore, ws Workspace, configName string) {
+	plans, err := store.ListActions(ws.Tenant, configName, "plan")
+	if err != nil {
+		log.Println("Failed to list the plans : ", err)
+		return
+	}
+	for _, plan := range plans {
+		removePlanFile(ws, plan.ActionID)
+	}
+}
+
+//parsePlan summarises the output of terraform show -json for a saved plan.
+func parsePlan(b []byte) (*PlanSummary, error) {
+	var plan planJSON
+	err := json.Unmarshal(b, &plan)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &PlanSummary{ResourceChanges: []ResourceChange{}}
+	for _, rc := range plan.ResourceChanges {
+		actions := rc.Change.Actions
+		if len(actions) == 0 || (len(actions) == 1 && actions[0] == "no-op") {
+			continue
+		}
+		for _, action := range actions {
+			switch action {
+			case "create":
+				summary.Add++
+			case "update":
+				summary.Change++
+			case "delete":
+				summary.Destroy++
+			}
+		}
+		summary.ResourceChanges = append(summary.ResourceChanges, ResourceChange{Address: rc.Address, Actions: actions})
+	}
+	return summary, nil
+}
+
+//savePlanSummary records the changes of the saved plan on the action.
+func savePlanSummary(store ActionStore, ws Workspace, confDir, actionID string) error {
+	b, err := TerraformShowPlan(confDir, ws.LogDir, planFile(ws, actionID), &planTimeOut, actionID)
+	if err != nil {
+		return err
+	}
+	summary, err := parsePlan(b)
+	if err != nil {
+		return err
+	}
+
+	actionResponse, err := store.GetAction(actionID)
+	if err != nil {
+		return err
+	}
+	actionResponse.PlanSummary = summary
+	return store.SaveAction(actionResponse)
+}
+
+//StalePlanError is returned when the saved plan no longer matches the
+//configuration or its state.
+type StalePlanError struct {
+	Reason string
+}
+
+func (e *StalePlanError) Error() string {
+	return "the plan is stale: " + e.Reason
+}
+
+//stateSerial returns the serial of the state of the configuration, 0 when
+//there is no state yet.
+func stateSerial(store ActionStore, ws Workspace, repoName string) (int64, error) {
+	b, err := readState(store, ws, repoName)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	header, err := parseStateHeader(b)
+	return header.Serial, err
+}
+
+//recordRevision records on the action the commit and the state serial it
+//starts from.
+func recordRevision(store ActionStore, ws Workspace, actionID, repoName string) error {
+	sha, err := gitHead(path.Join(ws.Dir, repoName))
+	if err != nil {
+		return err
+	}
+	serial, err := stateSerial(store, ws, repoName)
+	if err != nil {
+		return err
+	}
+
+	actionResponse, err := store.GetAction(actionID)
+	if err != nil {
+		return err
+	}
+	actionResponse.CommitSHA = sha
+	actionResponse.StateSerial = serial
+	return store.SaveAction(actionResponse)
+}
+
+//checkSavedPlan tells if the saved plan of the plan action can be applied
+//to the configuration. It is a *StalePlanError when the repo commit or the state
+//serial changed since the plan was made.
+func checkSavedPlan(store ActionStore, ws Workspace, repoName, planActionID string) error {
+	plan, err := getTenantAction(store, ws.Tenant, planActionID)
+	if err == ErrNotFound || (err == nil && (plan.Action != "plan" || plan.ConfigName != repoName)) {
+		return fmt.Errorf("there is no plan %s for %s", planActionID, repoName)
+	}
+	if err != nil {
+		return err
+	}
+	if plan.Status != StatusCompleted {
+		return fmt.Errorf("the plan %s is %s, only a completed plan can be applied", planActionID, plan.Status)
+	}
+	if _, err := os.Stat(planFile(ws, planActionID)); err != nil {
+		return fmt.Errorf("the plan file of %s is gone", planActionID)
+	}
+
+	sha, err := gitHead(path.Join(ws.Dir, repoName))
+	if err != nil {
+		return err
+	}
+	if sha != plan.CommitSHA {
+		return &StalePlanError{Reason: fmt.Sprintf("the configuration is at commit %s, the plan was made at %s", sha, plan.CommitSHA)}
+	}
+	serial, err := stateSerial(store, ws, repoName)
+	if err != nil {
+		return err
+	}
+	if serial != plan.StateSerial {
+		return &StalePlanError{Reason: fmt.Sprintf("the state is at serial %d, the plan was made at %d", serial, plan.StateSerial)}
+	}
+	return nil
+}
+
+//writePlanError writes the error of checkSavedPlan, 409 for a stale plan and
+//400 for a plan that cannot be applied at all.
+func writePlanError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*StalePlanError); ok {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	http.Error(w, err.Error(), 400)
+}
+
+//PlanChangesHandler handles request to get the resource changes of a plan.
+// @Title PlanChangesHandler
+// @Description Get the resources the plan will add, change and destroy.
+// @Param   repo_name     path    string     true "repo name"
+// @Param   action_id     path    string     true "action id of the plan"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} PlanSummary
+// @Failure 404 {object} string
+// @Failure 409 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/plan/{action_id}/changes [get]
+func PlanChangesHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		actionID := vars["actionID"]
+
+		log.Println("Url Param 'actionID' is: " + actionID)
+
+		actionResponse, err := getTenantAction(store, RequestTenant(r), actionID)
+		if err == ErrNotFound || (err == nil && actionResponse.Action != "plan") {
+			http.Error(w, "There is no such plan.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if actionResponse.PlanSummary == nil {
+			if !isFinished(actionResponse.Status) {
+				http.Error(w, "The plan has not finished yet.", 409)
+				return
+			}
+			http.Error(w, "The plan has no change summary.", 404)
+			return
+		}
+
+		output, err := json.MarshalIndent(actionResponse.PlanSummary, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(output)
+	}
+}
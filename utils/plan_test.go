@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlan(t *testing.T) {
+	show := `{
+  "format_version": "1.1",
+  "resource_drift": [
+    {"address": "ibm_is_vpc.drifted", "change": {"actions": ["update"]}}
+  ],
+  "resource_changes": [
+    {"address": "ibm_is_vpc.vpc", "change": {"actions": ["no-op"]}},
+    {"address": "ibm_is_subnet.new", "change": {"actions": ["create"]}},
+    {"address": "ibm_is_instance.vsi", "change": {"actions": ["update"]}},
+    {"address": "ibm_is_volume.old", "change": {"actions": ["delete"]}},
+    {"address": "ibm_is_instance.replaced", "change": {"actions": ["delete", "create"]}},
+    {"address": "data.ibm_resource_group.rg", "change": {"actions": ["read"]}}
+  ]
+}`
+	summary, err := parsePlan([]byte(show))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PlanSummary{
+		Add:     2,
+		Change:  1,
+		Destroy: 2,
+		ResourceChanges: []ResourceChange{
+			{Address: "ibm_is_subnet.new", Actions: []string{"create"}},
+			{Address: "ibm_is_instance.vsi", Actions: []string{"update"}},
+			{Address: "ibm_is_volume.old", Actions: []string{"delete"}},
+			{Address: "ibm_is_instance.replaced", Actions: []string{"delete", "create"}},
+			{Address: "data.ibm_resource_group.rg", Actions: []string{"read"}},
+		},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("parsePlan = %+v, want %+v", summary, want)
+	}
+
+	// A plan without changes has an empty list, not null
+	summary, err = parsePlan([]byte(`{"format_version": "1.1"}`))
+	if err != nil || summary.ResourceChanges == nil || summary.Add+summary.Change+summary.Destroy != 0 {
+		t.Errorf("parsePlan of an empty plan = %+v, %v", summary, err)
+	}
+
+	if _, err := parsePlan([]byte("Error: no plan")); err == nil {
+		t.Error("parsePlan accepted output that is not JSON")
+	}
+}
@@ -0,0 +1,10 @@
+package utils
+
+import "syscall"
+
+//runProcAttr puts the terraform process in a process group of its own, and
+//has it stopped when the server dies without stopping its workers, so it
+//cannot run on next to the one of the next server.
+func runProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "syscall"
+
+//runProcAttr puts the terraform process in a process group of its own.
+func runProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
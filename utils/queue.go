@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+)
+
+//Job states
+const (
+	JobPending  = "pending"
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobFinished = "finished"
+)
+
+//Job is a terraform action waiting in the queue or being run by a worker.
+type Job struct {
+	ActionID     string    `json:"action_id"`
+	Tenant       string    `json:"tenant,omitempty"`
+	ConfigName   string    `json:"config_name"`
+	Action       string    `json:"action"`
+	Webhook      string    `json:"webhook,omitempty"`
+	PlanActionID string    `json:"plan_action_id,omitempty"`
+	Ref          string    `json:"ref,omitempty"`
+	TTL          string    `json:"ttl,omitempty"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	OutURL       string    `json:"out_url"`
+	ErrURL       string    `json:"err_url"`
+	State        string    `json:"state"`
+	Owner        string    `json:"owner,omitempty"`
+	EnqueuedAt   time.Time `json:"enqueued_at"`
+	StartedAt    time.Time `json:"started_at,omitempty"`
+	FinishedAt   time.Time `json:"finished_at,omitempty"`
+
+	ApprovalsRequired int       `json:"approvals_required,omitempty"`
+	ApprovalDeadline  time.Time `json:"approval_deadline,omitempty"`
+
+	//CancelRequested asks the worker running the job to cancel it.
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+}
+
+//JobStore persists the job queue next to the action records.
+type JobStore interface {
+	//EnqueueJob adds the job to the end of the queue.
+	EnqueueJob(job Job) error
+	//ClaimJob marks the oldest queued job as running by owner and returns it.
+	//It returns ErrNotFound when the queue is empty.
+	ClaimJob(owner string) (Job, error)
+	//RequeueJob puts a job running by owner back in the queue.
+	RequeueJob(actionID, owner string) error
+	//FinishJob marks the job as finished.
+	FinishJob(actionID string) error
+	//ReleaseJob queues a job pending approval. It returns ErrNotFound when
+	//the job is not pending.
+	ReleaseJob(actionID string) error
+	//CancelJob takes a pending or queued job off the queue. It returns
+	//ErrNotFound when the job is neither.
+	CancelJob(actionID string) error
+	//RequestCancel asks the worker running the job to cancel it. It returns
+	//ErrNotFound when the job is not running.
+	RequestCancel(actionID string) error
+	//GetJob returns the job of the action.
+	GetJob(actionID string) (Job, error)
+	//ListJobs returns the jobs in the given state.
+	ListJobs(state string) ([]Job, error)
+	//Heartbeat records that the workers of owner are alive at the time.
+	Heartbeat(owner string, at time.Time) error
+	//LiveOwners returns the owners with a heartbeat after since.
+	LiveOwners(since time.Time) (map[string]bool, error)
+}
+
+//jobNotify wakes up an idle worker when a job is queued.
+var jobNotify = make(chan struct{}, 1)
+
+func wakeWorkers() {
+	select {
+	case jobNotify <- struct{}{}:
+	default:
+	}
+}
+
+func newActionID() string {
+	b := make([]byte, 10)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+//enqueueAction records a new action for the job and puts the job on the
+//queue. logURL is the base URL under which the log files of the action are
+//served. Actions changing the configuration first take its lock, a
+//*LockedError is returned when another action holds it, a *QuotaError when
+//the tenant has too many actions already. Actions needing approval wait
+//pending approval, holding the lock, instead of being queued.
+func enqueueAction(store ActionStore, job Job, logURL string) (ActionResponse, error) {
+	var actionResponse ActionResponse
+
+	err := checkActionQuota(store, job.Tenant)
+	if err != nil {
+		return actionResponse, err
+	}
+	required, timeout, err := approvalsRequired(store, job.Tenant, job.ConfigName, job.Action)
+	if err != nil {
+		return actionResponse, err
+	}
+
+	if job.ActionID == "" {
+		job.ActionID = newActionID()
+	}
+	if lockingActions[job.Action] {
+		err := lockConfig(store, job.Tenant, job.ConfigName, job.Action, job.ActionID)
+		if err != nil {
+			return actionResponse, err
+		}
+	}
+
+	job.OutURL = logURL + "/" + job.ActionID + ".out"
+	job.ErrURL = logURL + "/" + job.ActionID + ".err"
+	job.State = JobQueued
+	job.EnqueuedAt = time.Now()
+	if required > 0 {
+		job.State = JobPending
+		job.ApprovalsRequired = required
+		job.ApprovalDeadline = job.EnqueuedAt.Add(timeout)
+	}
+
+	actionResponse.Tenant = job.Tenant
+	actionResponse.Action = job.Action
+	actionResponse.ConfigName = job.ConfigName
+	actionResponse.ActionID = job.ActionID
+	actionResponse.Timestamp = job.EnqueuedAt.Format("20060102150405")
+	actionResponse.Status = StatusQueued
+	actionResponse.PlanActionID = job.PlanActionID
+	actionResponse.Ref = job.Ref
+	actionResponse.TTL = job.TTL
+	actionResponse.CreatedBy = job.CreatedBy
+	if job.State == JobPending {
+		actionResponse.Status = StatusPendingApproval
+		actionResponse.ApprovalsRequired = required
+	}
+
+	// Make an entry in the db
+	err = store.InsertAction(actionResponse)
+	if err != nil {
+		unlockConfig(store, job.Tenant, job.ConfigName, job.ActionID)
+		return actionResponse, err
+	}
+	err = store.EnqueueJob(job)
+	if err != nil {
+		log.Println("Failed to queue the action : ", err)
+		store.UpdateActionStatus(job.ActionID, StatusFailed)
+		unlockConfig(store, job.Tenant, job.ConfigName, job.ActionID)
+		return actionResponse, err
+	}
+	if job.State == JobPending {
+		notify(store, job, EventPendingApproval, "")
+		return actionResponse, nil
+	}
+	notify(store, job, EventQueued, "")
+	wakeWorkers()
+	return actionResponse, nil
+}
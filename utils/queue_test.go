@@ -0,0 +1,15 @@
+package utils
+
+import "testing"
+
+func TestShowWaitsForTheLock(t *testing.T) {
+	store := NewMemoryStore()
+	_, err := enqueueAction(store, Job{Tenant: DefaultTenant, ConfigName: "config", Action: "apply"}, "http://logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = enqueueAction(store, Job{Tenant: DefaultTenant, ConfigName: "config", Action: "show"}, "http://logs")
+	if _, ok := err.(*LockedError); !ok {
+		t.Errorf("show of a configuration being applied returned %v, want a *LockedError", err)
+	}
+}
@@ -0,0 +1,424 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//scheduleInterval is how often the scheduler looks for the schedules due.
+var scheduleInterval = 20 * time.Second
+
+//scheduleActions are the actions that can be scheduled.
+var scheduleActions = map[string]bool{
+	"plan":    true,
+	"apply":   true,
+	"destroy": true,
+	"drift":   true,
+}
+
+// Schedule -
+type Schedule struct {
+	Tenant       string     `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName   string     `json:"id" description:"Name of the configuration"`
+	ScheduleID   string     `json:"schedule_id" description:"ID of the schedule"`
+	Cron         string     `json:"cron" description:"When the action runs: minute hour day-of-month month day-of-week, or @hourly, @daily, @weekly, @monthly, @yearly"`
+	Action       string     `json:"action" description:"plan, apply, destroy or drift"`
+	TimeZone     string     `json:"time_zone,omitempty" description:"IANA time zone of the cron expression, e.g. Europe/Paris. UTC if empty"`
+	Enabled      bool       `json:"enabled"`
+	NextRun      *time.Time `json:"next_run,omitempty" description:"When the action runs next"`
+	LastRun      *time.Time `json:"last_run,omitempty" description:"When the action last fell due"`
+	LastActionID string     `json:"last_action_id,omitempty" description:"The action queued by the last run"`
+	LastSkipped  string     `json:"last_skipped,omitempty" description:"Why the last run queued no action"`
+	CreatedBy    string     `json:"created_by,omitempty" description:"Who created the schedule"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// ScheduleRequest -
+type ScheduleRequest struct {
+	Cron     string  `json:"cron,omitempty" description:"When the action runs: minute hour day-of-month month day-of-week, or @hourly, @daily, @weekly, @monthly, @yearly"`
+	Action   string  `json:"action,omitempty" description:"plan, apply, destroy or drift"`
+	TimeZone *string `json:"time_zone,omitempty" description:"IANA time zone of the cron expression, UTC if empty or not given"`
+	Enabled  *bool   `json:"enabled,omitempty" description:"Whether the schedule runs, true if not given"`
+}
+
+//ScheduleStore keeps the schedules of the configurations.
+type ScheduleStore interface {
+	//InsertSchedule adds the schedule.
+	InsertSchedule(schedule Schedule) error
+	//SaveSchedule replaces the schedule or returns ErrNotFound.
+	SaveSchedule(schedule Schedule) error
+	//GetSchedule returns the schedule of the configuration or ErrNotFound.
+	GetSchedule(tenant, configName, scheduleID string) (Schedule, error)
+	//ListSchedules returns the schedules of the configuration.
+	ListSchedules(tenant, configName string) ([]Schedule, error)
+	//ListDueSchedules returns the enabled schedules of all the tenants whose
+	//next run is not after now.
+	ListDueSchedules(now time.Time) ([]Schedule, error)
+	//ClaimSchedule moves the next run of the schedule to next and its last
+	//run to its current next run. It returns ErrNotFound when the next run is
+	//no longer the one of schedule, another server claimed it.
+	ClaimSchedule(schedule Schedule, next *time.Time) error
+	//SetScheduleRun records the outcome of the last run of the schedule.
+	SetScheduleRun(tenant, configName, scheduleID, actionID, skipped string) error
+	//DeleteSchedule removes the schedule or returns ErrNotFound.
+	DeleteSchedule(tenant, configName, scheduleID string) error
+}
+
+//nextRun returns when the schedule runs next after t, nil when it is
+//disabled or never runs.
+func (s Schedule) nextRun(t time.Time) (*time.Time, error) {
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", s.TimeZone)
+	}
+	next := spec.next(t.In(loc)).UTC()
+	if !s.Enabled || next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+//checkSchedule checks the schedule and sets its next run.
+func checkSchedule(s *Schedule) error {
+	if !scheduleActions[s.Action] {
+		return fmt.Errorf("the action of a schedule is plan, apply, destroy or drift, not %q", s.Action)
+	}
+	next, err := s.nextRun(time.Now())
+	if err != nil {
+		return err
+	}
+	if s.Enabled && next == nil {
+		return fmt.Errorf("the cron expression %q never runs", s.Cron)
+	}
+	s.NextRun = next
+	return nil
+}
+
+//StartScheduler runs the actions of the schedules as they fall due.
+func StartScheduler(store ActionStore) {
+	go func() {
+		for range time.Tick(scheduleInterval) {
+			runSchedules(store, time.Now())
+		}
+	}()
+}
+
+func runSchedules(store ActionStore, now time.Time) {
+	schedules, err := store.ListDueSchedules(now)
+	if err != nil {
+		log.Println("Failed to list the schedules : ", err)
+		return
+	}
+	for _, schedule := range schedules {
+		runSchedule(store, schedule, now)
+	}
+}
+
+//runSchedule queues the action of the schedule that fell due. Runs missed,
+//e.g. while the server was down, run once.
+func runSchedule(store ActionStore, schedule Schedule, now time.Time) {
+	next, err := schedule.nextRun(now)
+	if err != nil {
+		log.Println("Failed to read the schedule "+schedule.ScheduleID+" : ", err)
+		return
+	}
+	err = store.ClaimSchedule(schedule, next)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("Failed to claim the schedule : ", err)
+		return
+	}
+
+	actionID, skipped, err := queueScheduledAction(store, schedule)
+	if err != nil {
+		log.Println("Failed to queue the action of the schedule "+schedule.ScheduleID+" : ", err)
+		skipped = err.Error()
+	}
+	if skipped != "" {
+		log.Printf("Skipped the %s of %s scheduled by %s: %s\n", schedule.Action, schedule.ConfigName, schedule.ScheduleID, skipped)
+	}
+	err = store.SetScheduleRun(schedule.Tenant, schedule.ConfigName, schedule.ScheduleID, actionID, skipped)
+	if err != nil && err != ErrNotFound {
+		log.Println("Failed to record the schedule run : ", err)
+	}
+}
+
+//queueScheduledAction queues the action of the schedule. It tells why when
+//the run is skipped because the configuration is locked, the previous run is
+//still going or the tenant has too many actions.
+func queueScheduledAction(store ActionStore, schedule Schedule) (string, string, error) {
+	config, err := store.GetConfig(schedule.Tenant, schedule.ConfigName)
+	if err == ErrNotFound {
+		return "", "the configuration no longer exists", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if schedule.LastActionID != "" {
+		previous, err := store.GetAction(schedule.LastActionID)
+		if err == nil && (previous.Status == StatusQueued || previous.Status == StatusInProgress || previous.Status == StatusPendingApproval) {
+			return "", fmt.Sprintf("the previous run %s is %s", previous.ActionID, previous.Status), nil
+		}
+	}
+
+	job := Job{
+		Tenant:     schedule.Tenant,
+		ConfigName: schedule.ConfigName,
+		Action:     schedule.Action,
+		Webhook:    config.SlackWebhook,
+		CreatedBy:  "schedule/" + schedule.ScheduleID,
+	}
+	actionResponse, err := enqueueAction(store, job, publicURL+"/v1/configuration/"+schedule.ConfigName+"/"+schedule.Action)
+	switch err.(type) {
+	case *LockedError, *QuotaError:
+		return "", err.Error(), nil
+	}
+	return actionResponse.ActionID, "", err
+}
+
+//deleteSchedules removes the schedules of the configuration.
+func deleteSchedules(store ActionStore, tenant, configName string) error {
+	schedules, err := store.ListSchedules(tenant, configName)
+	if err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		err = store.DeleteSchedule(tenant, configName, schedule.ScheduleID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//readScheduleRequest reads the body of a schedule request.
+func readScheduleRequest(r *http.Request) (ScheduleRequest, error) {
+	var msg ScheduleRequest
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(b, &msg)
+	return msg, err
+}
+
+//writeSchedule writes the schedule with the status code.
+func writeSchedule(w http.ResponseWriter, schedule Schedule, code int) {
+	output, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(output)
+}
+
+//SchedulesHandler handles request to list the schedules of the configuration.
+// @Title SchedulesHandler
+// @Description List the schedules of the configuration.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} Schedule
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/schedules [get]
+func SchedulesHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		schedules, err := store.ListSchedules(RequestTenant(r), repoName)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, schedules)
+	}
+}
+
+//CreateScheduleHandler handles request to schedule an action of the configuration.
+// @Title CreateScheduleHandler
+// @Description Run an action of the configuration on a cron schedule. A run is skipped when the configuration is locked or the previous run is still going.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   body     body     ScheduleRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 201 {object} Schedule
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/schedules [post]
+func CreateScheduleHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		if _, err := os.Stat(path.Join(ws.Dir, repoName)); reservedDirs[repoName] || err != nil {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		msg, err := readScheduleRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		schedule := Schedule{
+			Tenant:     ws.Tenant,
+			ConfigName: repoName,
+			ScheduleID: newActionID(),
+			Cron:       msg.Cron,
+			Action:     msg.Action,
+			Enabled:    msg.Enabled == nil || *msg.Enabled,
+			CreatedBy:  RequestIdentity(r).Subject,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+		if msg.TimeZone != nil {
+			schedule.TimeZone = *msg.TimeZone
+		}
+		err = checkSchedule(&schedule)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = store.InsertSchedule(schedule)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeSchedule(w, schedule, 201)
+	}
+}
+
+//ScheduleHandler handles request to get a schedule of the configuration.
+// @Title ScheduleHandler
+// @Description Get the schedule.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   schedule_id     path    string     true "schedule id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} Schedule
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/schedules/{schedule_id} [get]
+func ScheduleHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		schedule, err := store.GetSchedule(RequestTenant(r), vars["repo_name"], vars["schedule_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such schedule.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, schedule)
+	}
+}
+
+//UpdateScheduleHandler handles request to update a schedule of the configuration.
+// @Title UpdateScheduleHandler
+// @Description Change the cron expression, action, time zone or enabled flag of the schedule. The fields not given are kept, an empty time_zone sets it back to UTC.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   schedule_id     path    string     true "schedule id"
+// @Param   body     body     ScheduleRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} Schedule
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/schedules/{schedule_id} [patch]
+func UpdateScheduleHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		msg, err := readScheduleRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		schedule, err := store.GetSchedule(RequestTenant(r), vars["repo_name"], vars["schedule_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such schedule.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if msg.Cron != "" {
+			schedule.Cron = msg.Cron
+		}
+		if msg.Action != "" {
+			schedule.Action = msg.Action
+		}
+		// An empty time zone sets it back to UTC
+		if msg.TimeZone != nil {
+			schedule.TimeZone = *msg.TimeZone
+		}
+		if msg.Enabled != nil {
+			schedule.Enabled = *msg.Enabled
+		}
+		schedule.UpdatedAt = time.Now()
+		err = checkSchedule(&schedule)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = store.SaveSchedule(schedule)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, schedule)
+	}
+}
+
+//DeleteScheduleHandler handles request to delete a schedule of the configuration.
+// @Title DeleteScheduleHandler
+// @Description Delete the schedule. The actions it queued are kept.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   schedule_id     path    string     true "schedule id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/schedules/{schedule_id} [delete]
+func DeleteScheduleHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		err := store.DeleteSchedule(RequestTenant(r), vars["repo_name"], vars["schedule_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such schedule.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+//errNoMasterKey is returned when a secret has to be stored but the server
+//has no master key.
+var errNoMasterKey = errors.New("secrets cannot be stored, the server was started without -masterKey")
+
+//masterKey encrypts the secrets kept in the store, nil when there is none.
+var masterKey []byte
+
+//SetupMasterKey reads the key the secrets are encrypted with from the file at
+//path. The file holds 32 random bytes, base64 encoded.
+func SetupMasterKey(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("the master key is not base64 encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("the master key has %d bytes, it needs 32", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	if masterKey == nil {
+		return nil, errNoMasterKey
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encryptSecret encrypts the secret with the master key. It returns the nonce
+//and the sealed secret, base64 encoded.
+func encryptSecret(secret string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//decryptSecret returns the secret encrypted by encryptSecret.
+func decryptSecret(encrypted string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	secret, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("the secret cannot be decrypted with the master key")
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+//sensitiveValues returns the sensitive variables of the configuration with
+//their values decrypted.
+func (c ConfigRecord) sensitiveValues() ([]ConfigVariable, error) {
+	secrets := []ConfigVariable{}
+	for _, v := range c.Variables {
+		if !v.Sensitive {
+			continue
+		}
+		value, err := decryptSecret(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, ConfigVariable{Name: v.Name, Value: value, Type: v.Type, Sensitive: true})
+	}
+	return secrets, nil
+}
+
+//tfVarEnv returns the environment of a terraform process with the sensitive
+//variables as TF_VAR_ variables, nil when there are none.
+func tfVarEnv(secrets []ConfigVariable) []string {
+	if len(secrets) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for _, v := range secrets {
+		env = append(env, "TF_VAR_"+v.Name+"="+v.envValue())
+	}
+	return env
+}
+
+//minMaskedLen is the length below which the parts of a sensitive value, its
+//lines and the strings inside a JSON value, are not masked: short parts such
+//as "{" or "-----END" would mask every occurrence of them in the logs.
+const minMaskedLen = 8
+
+//newScrubber returns the replacer that masks the sensitive values in the
+//logs, as given and as terraform gets them, and the strings inside a JSON
+//value. The lines of a multi-line value are masked one by one, since the logs
+//are written line by line.
+func newScrubber(secrets []ConfigVariable) *strings.Replacer {
+	values := []string{}
+	parts := []string{}
+	for _, v := range secrets {
+		values = append(values, v.Value, v.envValue())
+		parts = append(parts, v.Value, v.envValue())
+		if v.Type == VarTypeJSON {
+			var value interface{}
+			if err := json.Unmarshal([]byte(v.Value), &value); err == nil {
+				parts = append(parts, jsonStrings(value)...)
+			}
+		}
+	}
+	for _, part := range parts {
+		if strings.Contains(part, "\n") {
+			for _, line := range strings.Split(part, "\n") {
+				parts = append(parts, strings.TrimSpace(line))
+			}
+		}
+	}
+	for _, part := range parts {
+		if len(part) >= minMaskedLen {
+			values = append(values, part)
+		}
+	}
+	// The longest values first, so a value is masked before any part of it
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	oldnew := []string{}
+	for _, value := range values {
+		if value != "" {
+			oldnew = append(oldnew, value, maskedSecret)
+		}
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+//jsonStrings returns the strings in a decoded JSON value.
+func jsonStrings(value interface{}) []string {
+	strs := []string{}
+	switch v := value.(type) {
+	case string:
+		strs = append(strs, v)
+	case []interface{}:
+		for _, item := range v {
+			strs = append(strs, jsonStrings(item)...)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			strs = append(strs, jsonStrings(item)...)
+		}
+	}
+	return strs
+}
@@ -4,62 +4,181 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 //DefaultIncomingWebHook for posting to slack
 var DefaultIncomingWebHook = os.Getenv("SLACK_INCOMING_WEBHOOK")
 
-//Attachments are slack attachments
-type Attachments struct {
-	Text string `json:"text,omitempty"`
+//stderrTailLines is how many of the last lines of the error log of a failed
+//action are posted to Slack.
+const stderrTailLines = 15
+
+//slackStatusEmoji are the emoji of the statuses in the Slack messages.
+var slackStatusEmoji = map[string]string{
+	StatusPendingApproval: ":raised_hand:",
+	StatusInProgress:      ":arrows_counterclockwise:",
+	StatusCompleted:       ":white_check_mark:",
+	StatusFailed:          ":x:",
+	StatusCancelled:       ":no_entry_sign:",
+	StatusRejected:        ":no_entry:",
+	StatusTimedOut:        ":hourglass:",
+}
+
+//slackEscaper escapes the characters Slack reads as markup.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+//SlackText is a text object of a SlackBlock.
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
 }
 
-//SlackMessage encapsulatest the message to send to slack
+//SlackBlock is a Block Kit block of a SlackMessage.
+type SlackBlock struct {
+	Type     string      `json:"type"`
+	Text     *SlackText  `json:"text,omitempty"`
+	Fields   []SlackText `json:"fields,omitempty"`
+	Elements []SlackText `json:"elements,omitempty"`
+}
+
+//SlackMessage encapsulatest the message to send to slack. Text is shown in
+//the notifications, the blocks in the channel.
 type SlackMessage struct {
-	Text        string        `json:"text,omitempty"`
-	Attachments []Attachments `json:"attachments,omitempty"`
+	Text   string       `json:"text,omitempty"`
+	Blocks []SlackBlock `json:"blocks,omitempty"`
 }
 
-//ComposeSlackMessage  composes the mesage to slack
-func ComposeSlackMessage(outputURL, errorURL, action, id, actionStatus string) SlackMessage {
-	//SlackMessage encapsulatest the message to send to slack
-	//id = fmt.Sprintf("%s", id)
-	//action = fmt.Sprintf("%s", action)
+func mrkdwn(text string) SlackText {
+	return SlackText{Type: "mrkdwn", Text: text}
+}
 
-	topLevelMessage := fmt.Sprintf(`Status for %s %s : %s`, action, id, actionStatus)
+//ComposeSlackMessage  composes the mesage to slack: the status of the
+//action, its duration once it has ended, the changes of a plan, the end of
+//the error log of a failed action and the links to the logs.
+func ComposeSlackMessage(event ActionEvent) SlackMessage {
+	status := event.Status
+	if event.Message != "" {
+		status = event.Message
+	}
+	topLevelMessage := fmt.Sprintf(`Status for %s %s : %s`, event.Action, event.ActionID, status)
+	blocks := []SlackBlock{{
+		Type: "section",
+		Text: &SlackText{Type: "mrkdwn", Text: fmt.Sprintf("%s *%s* of `%s` : *%s*",
+			slackEmoji(event), event.Action, event.ConfigName, slackEscaper.Replace(status))},
+	}}
 
-	doc := Attachments{Text: fmt.Sprintf(`<%s|See Output Logs for %s id %s>`, outputURL, action, id)}
-	doc1 := Attachments{Text: fmt.Sprintf(`<%s|See Error Logs for %s id %s>`, errorURL, action, id)}
+	fields := []SlackText{mrkdwn("*Action ID*\n" + event.ActionID)}
+	if event.StartedAt != nil && event.FinishedAt != nil {
+		fields = append(fields, mrkdwn("*Duration*\n"+event.FinishedAt.Sub(*event.StartedAt).Round(time.Second).String()))
+	}
+	if event.PlanSummary != nil {
+		fields = append(fields, mrkdwn(fmt.Sprintf("*Changes*\n%d to add, %d to change, %d to destroy",
+			event.PlanSummary.Add, event.PlanSummary.Change, event.PlanSummary.Destroy)))
+	}
+	if event.CreatedBy != "" {
+		fields = append(fields, mrkdwn("*Requested by*\n"+slackEscaper.Replace(event.CreatedBy)))
+	}
+	if len(event.CommitSHA) >= 7 {
+		fields = append(fields, mrkdwn("*Commit*\n`"+event.CommitSHA[:7]+"`"))
+	}
+	blocks = append(blocks, SlackBlock{Type: "section", Fields: fields})
 
-	attachements := []Attachments{doc, doc1}
+	if event.Event == EventDriftDetected && event.Drift != nil {
+		blocks = append(blocks, SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: driftText(event.Drift)}})
+	}
+	if event.Status == StatusFailed || event.Status == StatusTimedOut {
+		text := "*Error* " + slackEscaper.Replace(event.Error)
+		if tail := stderrTail(event); tail != "" {
+			text += "\n```" + slackEscaper.Replace(tail) + "```"
+		}
+		blocks = append(blocks, SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}})
+	}
 
-	message := SlackMessage{Text: topLevelMessage, Attachments: attachements}
-	return message
+	if event.OutURL != "" {
+		blocks = append(blocks, SlackBlock{Type: "context", Elements: []SlackText{
+			mrkdwn(fmt.Sprintf(`<%s|See Output Logs> · <%s|See Error Logs>`, event.OutURL, event.ErrURL)),
+		}})
+	}
+	return SlackMessage{Text: topLevelMessage, Blocks: blocks}
 }
 
-//PostToSlack post the message to slack
-func (m SlackMessage) PostToSlack(webhook string) {
-	slackIt, err := json.Marshal(m)
+//slackEmoji returns the emoji of the event.
+func slackEmoji(event ActionEvent) string {
+	switch event.Event {
+	case EventDriftDetected, EventExpiring:
+		return ":warning:"
+	case EventDriftCleared:
+		return ":white_check_mark:"
+	}
+	return slackStatusEmoji[event.Status]
+}
+
+//driftText lists the first resources that drifted.
+func driftText(drift *DriftReport) string {
+	var b strings.Builder
+	b.WriteString("*Drifted resources*")
+	for i, rc := range drift.ResourceChanges {
+		if i == 10 {
+			fmt.Fprintf(&b, "\n_and %d more_", len(drift.ResourceChanges)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n`%s` %s", rc.Address, strings.Join(rc.Actions, ", "))
+	}
+	return b.String()
+}
+
+//stderrTail returns the last lines of the error log of the action. A
+//section of a message holds 3000 characters at most, so long lines are cut.
+func stderrTail(event ActionEvent) string {
+	b, err := ioutil.ReadFile(path.Join(tenantWorkspace(event.Tenant).LogDir, event.ActionID+".err"))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > stderrTailLines {
+		lines = lines[len(lines)-stderrTailLines:]
+	}
+	for i, line := range lines {
+		if len(line) > 160 {
+			// Cut before a rune, Slack refuses invalid UTF-8
+			end := 160
+			for !utf8.RuneStart(line[end]) {
+				end--
+			}
+			lines[i] = line[:end] + "…"
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
 
-	log.Printf("message %s", slackIt)
+//PostToSlack post the message to slack. Nothing is posted when there is no
+//webhook, neither given nor the default one.
+func (m SlackMessage) PostToSlack(webhook string) error {
+	slackIt, err := json.Marshal(m)
 	if err != nil {
-		fmt.Printf("Error occured %v", err)
-		return
+		return err
 	}
 	if webhook == "" {
 		webhook = DefaultIncomingWebHook
 	}
+	if webhook == "" {
+		return nil
+	}
 
 	resp, err := http.Post(webhook, "application/json", bytes.NewBuffer(slackIt))
 	if err != nil {
-		fmt.Printf("Error occured while invoking callback URL %s, Error is  %v", webhook, err)
-		return
+		return err
 	}
-	fmt.Printf("Posted successfully to %s\n", webhook)
-	fmt.Printf("Status code is %d\n", resp.StatusCode)
 	defer resp.Body.Close()
-
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("slack answered %s", resp.Status)
+	}
+	return nil
 }
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestStderrTail(t *testing.T) {
+	logDir := tenantWorkspace("").LogDir
+	err := os.MkdirAll(logDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		err  string
+		want string
+	}{
+		{name: "short", err: "Error: one\n\n", want: "Error: one"},
+		{name: "last lines", err: strings.Repeat("skipped\n", 3) + strings.Repeat("kept\n", stderrTailLines), want: strings.TrimSpace(strings.Repeat("kept\n", stderrTailLines))},
+		{name: "long line", err: strings.Repeat("x", 200), want: strings.Repeat("x", 160) + "…"},
+		{name: "long line cut before a rune", err: strings.Repeat("x", 159) + strings.Repeat("é", 10), want: strings.Repeat("x", 159) + "…"},
+		{name: "long line of runes", err: strings.Repeat("✓", 60), want: strings.Repeat("✓", 53) + "…"},
+	}
+	for _, tt := range tests {
+		actionID := "stderr-tail-test"
+		err := ioutil.WriteFile(path.Join(logDir, actionID+".err"), []byte(tt.err), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := stderrTail(ActionEvent{ActionID: actionID})
+		os.Remove(path.Join(logDir, actionID+".err"))
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("%s: stderrTail = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPostToSlack(t *testing.T) {
+	status := http.StatusOK
+	var received SlackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	m := SlackMessage{Text: "plan of config completed"}
+	err := m.PostToSlack(server.URL)
+	if err != nil || received.Text != m.Text {
+		t.Errorf("PostToSlack = %v, Slack got %+v", err, received)
+	}
+
+	for _, status = range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		err = m.PostToSlack(server.URL)
+		if err == nil || !strings.Contains(err.Error(), http.StatusText(status)) {
+			t.Errorf("PostToSlack answered %d = %v, want an error", status, err)
+		}
+	}
+
+	// Without any webhook nothing is posted
+	defer func(webhook string) { DefaultIncomingWebHook = webhook }(DefaultIncomingWebHook)
+	DefaultIncomingWebHook = ""
+	if err := m.PostToSlack(""); err != nil {
+		t.Errorf("PostToSlack without webhook = %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StateVersion -
+type StateVersion struct {
+	Tenant       string    `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName   string    `json:"id" description:"Name of the configuration"`
+	VersionID    string    `json:"version_id" description:"ID of the version, the ID of the action that made it"`
+	Action       string    `json:"action" description:"apply, destroy or restore"`
+	Serial       int64     `json:"serial" description:"Serial of the state"`
+	Lineage      string    `json:"lineage" description:"Lineage of the state"`
+	Size         int64     `json:"size" description:"Size of the state file in bytes"`
+	RestoredFrom string    `json:"restored_from,omitempty" description:"The version a restore put back"`
+	CreatedBy    string    `json:"created_by,omitempty" description:"Who requested the action"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+//StateStore keeps the versions of the states of the configurations.
+type StateStore interface {
+	//AddStateVersion records a version of the state.
+	AddStateVersion(version StateVersion) error
+	//ListStateVersions returns the versions of the state of the configuration.
+	ListStateVersions(tenant, configName string) ([]StateVersion, error)
+	//GetStateVersion returns the version of the state of the configuration or
+	//ErrNotFound.
+	GetStateVersion(tenant, configName, versionID string) (StateVersion, error)
+}
+
+//stateFile returns where the state of the configuration is kept.
+func stateFile(ws Workspace, repoName string) string {
+	return path.Join(ws.StateDir, repoName+".tfstate")
+}
+
+//stateVersionFile returns where the version of the state is kept.
+func stateVersionFile(ws Workspace, repoName, versionID string) string {
+	return path.Join(ws.StateDir, "history", repoName, versionID+".tfstate")
+}
+
+//stateHeader is the part of a state file that identifies it.
+type stateHeader struct {
+	Serial  int64  `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+func parseStateHeader(b []byte) (stateHeader, error) {
+	var header stateHeader
+	err := json.Unmarshal(b, &header)
+	return header, err
+}
+
+//readState returns the current state of the configuration, from the store
+//when the server is the state backend. It returns ErrNotFound when there is
+//no state yet.
+func readState(store ActionStore, ws Workspace, repoName string) ([]byte, error) {
+	if stateBackendURL != "" {
+		state, err := store.GetState(ws.Tenant, repoName)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(state.Data), nil
+	}
+	b, err := ioutil.ReadFile(stateFile(ws, repoName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+//writeState replaces the current state of the configuration. The local
+//state is kept as a backup, as terraform does.
+func writeState(store ActionStore, ws Workspace, repoName string, b []byte) error {
+	header, err := parseStateHeader(b)
+	if err != nil {
+		return err
+	}
+	if stateBackendURL != "" {
+		return store.PutState(RemoteState{
+			Tenant:     ws.Tenant,
+			ConfigName: repoName,
+			Data:       string(b),
+			Serial:     header.Serial,
+			Lineage:    header.Lineage,
+			UpdatedAt:  time.Now(),
+		}, "")
+	}
+
+	current, err := ioutil.ReadFile(stateFile(ws, repoName))
+	if err == nil {
+		err = ioutil.WriteFile(stateFile(ws, repoName)+".backup", current, 0600)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmp := stateFile(ws, repoName) + ".restore"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile(ws, repoName))
+}
+
+//snapshotState copies the state of the configuration into its history and
+//records the version.
+func snapshotState(store ActionStore, ws Workspace, version StateVersion) error {
+	b, err := readState(store, ws, version.ConfigName)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header, err := parseStateHeader(b)
+	if err != nil {
+		return err
+	}
+
+	versionFile := stateVersionFile(ws, version.ConfigName, version.VersionID)
+	err = os.MkdirAll(path.Dir(versionFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(versionFile, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	version.Tenant = ws.Tenant
+	version.Serial = header.Serial
+	version.Lineage = header.Lineage
+	version.Size = int64(len(b))
+	version.CreatedAt = time.Now()
+	return store.AddStateVersion(version)
+}
+
+//recordStateVersion snapshots the state made by the job. The action has
+//succeeded anyway, so a failure is only logged.
+func recordStateVersion(store ActionStore, ws Workspace, job Job) {
+	err := snapshotState(store, ws, StateVersion{
+		ConfigName: job.ConfigName,
+		VersionID:  job.ActionID,
+		Action:     job.Action,
+		CreatedBy:  job.CreatedBy,
+	})
+	if err != nil {
+		log.Println("Failed to snapshot the state : ", err)
+	}
+}
+
+//restoreState makes the version the current state of the configuration. The
+//serial is moved past the current one, so terraform and the saved plans see
+//a new state.
+func restoreState(store ActionStore, ws Workspace, repoName string, version StateVersion) error {
+	b, err := ioutil.ReadFile(stateVersionFile(ws, repoName, version.VersionID))
+	if err != nil {
+		return err
+	}
+	current, err := readState(store, ws, repoName)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	serial := int64(0)
+	if err == nil {
+		header, err := parseStateHeader(current)
+		if err != nil {
+			return err
+		}
+		if header.Lineage != version.Lineage {
+			return &LineageError{Current: header.Lineage, Version: version.Lineage}
+		}
+		serial = header.Serial
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var state map[string]interface{}
+	err = d.Decode(&state)
+	if err != nil {
+		return err
+	}
+	state["serial"] = serial + 1
+	restored, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeState(store, ws, repoName, restored)
+}
+
+//LineageError is returned when a version of another state is restored.
+type LineageError struct {
+	Current string
+	Version string
+}
+
+func (e *LineageError) Error() string {
+	return fmt.Sprintf("the version is of lineage %s, the state is of lineage %s", e.Version, e.Current)
+}
+
+//StateVersionsHandler handles request to list the versions of the state.
+// @Title StateVersionsHandler
+// @Description List the versions of the state of the configuration, the latest first.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} StateVersion
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/state/versions [get]
+func StateVersionsHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		versions, err := store.ListStateVersions(RequestTenant(r), repoName)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		sort.SliceStable(versions, func(i, j int) bool { return versions[i].CreatedAt.After(versions[j].CreatedAt) })
+		writeJSON(w, versions)
+	}
+}
+
+//StateVersionHandler handles request to download a version of the state.
+// @Title StateVersionHandler
+// @Description Download the version of the state.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   version_id     path    string     true "version id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/state/versions/{version_id} [get]
+func StateVersionHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		version, err := store.GetStateVersion(ws.Tenant, repoName, vars["version_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such state version.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		b, err := ioutil.ReadFile(stateVersionFile(ws, repoName, version.VersionID))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%d.tfstate", repoName, version.Serial))
+		w.Write(b)
+	}
+}
+
+//RestoreStateHandler handles request to restore a version of the state.
+// @Title RestoreStateHandler
+// @Description Make the version the current state of the configuration. It must be of the same lineage as the current state.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   version_id     path    string     true "version id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} StateVersion
+// @Failure 404 {object} string
+// @Failure 409 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/state/versions/{version_id}/restore [post]
+func RestoreStateHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		randomID := newActionID()
+		err := lockConfig(store, ws.Tenant, repoName, "restore", randomID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlockConfig(store, ws.Tenant, repoName, randomID)
+
+		version, err := store.GetStateVersion(ws.Tenant, repoName, vars["version_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such state version.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		err = restoreState(store, ws, repoName, version)
+		if _, ok := err.(*LineageError); ok {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err == ErrLocked {
+			http.Error(w, "Terraform holds the lock on the state.", 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("Restored the state of %s to %s\n", repoName, version.VersionID)
+
+		restored := StateVersion{
+			ConfigName:   repoName,
+			VersionID:    randomID,
+			Action:       "restore",
+			RestoredFrom: version.VersionID,
+			CreatedBy:    RequestIdentity(r).Subject,
+		}
+		err = snapshotState(store, ws, restored)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		restored, err = store.GetStateVersion(ws.Tenant, repoName, randomID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, restored)
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestoreState(t *testing.T) {
+	defer func(url string) { stateBackendURL = url }(stateBackendURL)
+	for _, backend := range []string{"", "http://localhost:9080"} {
+		stateBackendURL = backend
+		store := NewMemoryStore()
+		ws := Workspace{Tenant: "team-a", StateDir: t.TempDir()}
+		state := func(serial int, lineage, resource string) []byte {
+			return []byte(fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": %q, "resources": [{"name": %q}]}`, serial, lineage, resource))
+		}
+		current := func() stateHeader {
+			b, err := readState(store, ws, "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, err := parseStateHeader(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return header
+		}
+
+		// The state made by an apply, then changed by another one
+		err := writeState(store, ws, "config", state(3, "lineage-a", "first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = snapshotState(store, ws, StateVersion{ConfigName: "config", VersionID: "first", Action: "apply"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeState(store, ws, "config", state(7, "lineage-a", "second"))
+
+		first, err := store.GetStateVersion("team-a", "config", "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Serial != 3 || first.Lineage != "lineage-a" {
+			t.Errorf("%s: version recorded with serial %d and lineage %s", backend, first.Serial, first.Lineage)
+		}
+		err = restoreState(store, ws, "config", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header := current(); header.Serial != 8 || header.Lineage != "lineage-a" {
+			t.Errorf("%s: restored state has serial %d and lineage %s, want 8 and lineage-a", backend, header.Serial, header.Lineage)
+		}
+		b, _ := readState(store, ws, "config")
+		if !strings.Contains(string(b), `"first"`) {
+			t.Errorf("%s: restored state %s, want the resources of the version", backend, b)
+		}
+
+		// A version of another state is refused and the state is left alone
+		writeState(store, ws, "config", state(1, "lineage-b", "other"))
+		err = restoreState(store, ws, "config", first)
+		if _, ok := err.(*LineageError); !ok {
+			t.Errorf("%s: restore of another lineage = %v, want a *LineageError", backend, err)
+		}
+		if header := current(); header.Serial != 1 || header.Lineage != "lineage-b" {
+			t.Errorf("%s: state after the refused restore has serial %d and lineage %s", backend, header.Serial, header.Lineage)
+		}
+
+		// Without a state the version is restored as the first serial
+		if backend == "" {
+			os.Remove(stateFile(ws, "config"))
+			err = restoreState(store, ws, "config", first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header := current(); header.Serial != 1 {
+				t.Errorf("state restored over no state has serial %d, want 1", header.Serial)
+			}
+		}
+	}
+}
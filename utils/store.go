@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+//ErrNotFound is returned by an ActionStore when the requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+//ErrDuplicate is returned by an ActionStore when the record already exists.
+var ErrDuplicate = errors.New("already exists")
+
+//ActionStore persists the action records of the terraform operations.
+type ActionStore interface {
+	//InsertAction makes a new entry for the action.
+	InsertAction(actionResponse ActionResponse) error
+	//UpdateActionStatus updates the status of the action.
+	UpdateActionStatus(actionID, status string) error
+	//SaveAction replaces the record of the action.
+	SaveAction(actionResponse ActionResponse) error
+	//GetAction returns the action with the given action ID.
+	GetAction(actionID string) (ActionResponse, error)
+	//ListActions returns the actions of the tenant for the configuration and
+	//action name. An empty configName or action matches all.
+	ListActions(tenant, configName, action string) ([]ActionResponse, error)
+
+	ConfigStore
+	JobStore
+	LockStore
+	ApprovalStore
+	StateStore
+	RemoteStateStore
+	ScheduleStore
+	WebhookStore
+
+	//Close releases the resources held by the store.
+	Close()
+}
+
+//NewActionStore returns the ActionStore of the given kind: mongo, file or memory.
+func NewActionStore(kind, mongoURL string) (ActionStore, error) {
+	switch kind {
+	case "mongo":
+		return NewMongoStore(mongoURL)
+	case "file":
+		return NewFileStore(path.Join(currentDir, "actions.json"))
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown action store %q, must be one of mongo, file or memory", kind)
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+//NewFileStore returns a MemoryStore that writes every change through to the
+//JSON file at path and loads it back on start, so the action records survive
+//a restart without a MongoDB server.
+func NewFileStore(path string) (*MemoryStore, error) {
+	m := NewMemoryStore()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &m.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.persist = func(data *memoryData) error {
+		return writeStoreFile(path, data)
+	}
+	return m, nil
+}
+
+//writeStoreFile replaces the file at path atomically so a crash never leaves
+//a half written store behind.
+func writeStoreFile(path string, data *memoryData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
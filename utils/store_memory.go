@@ -0,0 +1,946 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//memoryData is everything held by a MemoryStore. It is what the file store
+//writes to disk, so all the fields must survive a JSON round trip.
+type memoryData struct {
+	Actions []ActionResponse `json:"actions"`
+	Jobs    []Job            `json:"jobs"`
+	Locks   []ConfigLock     `json:"locks"`
+	Configs []ConfigRecord   `json:"configs"`
+
+	ApprovalPolicies []ApprovalPolicy  `json:"approval_policies"`
+	StateVersions    []StateVersion    `json:"state_versions"`
+	RemoteStates     []RemoteState     `json:"remote_states"`
+	Schedules        []Schedule        `json:"schedules"`
+	Webhooks         []Webhook         `json:"webhooks"`
+	Deliveries       []WebhookDelivery `json:"deliveries"`
+}
+
+//MemoryStore keeps the action records in memory. It is meant for tests and
+//for running the API without a database.
+type MemoryStore struct {
+	mu      sync.Mutex
+	data    memoryData
+	persist func(data *memoryData) error
+
+	// The heartbeats are not persisted, the owners that wrote them are gone
+	// once the store is reloaded
+	heartbeats map[string]time.Time
+}
+
+//NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+//changed is called with the lock held after every modification.
+func (m *MemoryStore) changed() error {
+	if m.persist == nil {
+		return nil
+	}
+	return m.persist(&m.data)
+}
+
+func (m *MemoryStore) findAction(actionID string) int {
+	for i := range m.data.Actions {
+		if m.data.Actions[i].ActionID == actionID {
+			return i
+		}
+	}
+	return -1
+}
+
+//InsertAction makes a new entry for the action.
+func (m *MemoryStore) InsertAction(actionResponse ActionResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findAction(actionResponse.ActionID) >= 0 {
+		return nil
+	}
+	m.data.Actions = append(m.data.Actions, actionResponse)
+	return m.changed()
+}
+
+//UpdateActionStatus updates the status of the action.
+func (m *MemoryStore) UpdateActionStatus(actionID, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAction(actionID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Actions[i].Status = status
+	return m.changed()
+}
+
+//SaveAction replaces the record of the action.
+func (m *MemoryStore) SaveAction(actionResponse ActionResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAction(actionResponse.ActionID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Actions[i] = actionResponse
+	return m.changed()
+}
+
+//GetAction returns the action with the given action ID.
+func (m *MemoryStore) GetAction(actionID string) (ActionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAction(actionID)
+	if i < 0 {
+		return ActionResponse{}, ErrNotFound
+	}
+	return m.data.Actions[i], nil
+}
+
+//ListActions returns the actions of the tenant for the configuration and action name.
+func (m *MemoryStore) ListActions(tenant, configName, action string) ([]ActionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	actionResponse := []ActionResponse{}
+	for _, a := range m.data.Actions {
+		if a.Tenant != tenant {
+			continue
+		}
+		if configName != "" && a.ConfigName != configName {
+			continue
+		}
+		if action != "" && a.Action != action {
+			continue
+		}
+		actionResponse = append(actionResponse, a)
+	}
+	return actionResponse, nil
+}
+
+func (m *MemoryStore) findConfig(tenant, id string) int {
+	for i := range m.data.Configs {
+		if m.data.Configs[i].Tenant == tenant && m.data.Configs[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+//InsertConfig adds the configuration.
+func (m *MemoryStore) InsertConfig(config ConfigRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findConfig(config.Tenant, config.ID) >= 0 {
+		return ErrDuplicate
+	}
+	m.data.Configs = append(m.data.Configs, config)
+	return m.changed()
+}
+
+//SaveConfig replaces the record of the configuration but its expiry.
+func (m *MemoryStore) SaveConfig(config ConfigRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findConfig(config.Tenant, config.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	config.Expiry = m.data.Configs[i].Expiry
+	m.data.Configs[i] = config
+	return m.changed()
+}
+
+//SwapExpiry replaces the expiry of the configuration if it is still old.
+func (m *MemoryStore) SwapExpiry(tenant, id string, old, expiry *ConfigExpiry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findConfig(tenant, id)
+	if i < 0 || !sameExpiry(m.data.Configs[i].Expiry, old) {
+		return ErrNotFound
+	}
+	m.data.Configs[i].Expiry = expiry
+	return m.changed()
+}
+
+//GetConfig returns the configuration of the tenant.
+func (m *MemoryStore) GetConfig(tenant, id string) (ConfigRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findConfig(tenant, id)
+	if i < 0 {
+		return ConfigRecord{}, ErrNotFound
+	}
+	return m.data.Configs[i], nil
+}
+
+//ListConfigs returns the configurations of the tenant.
+func (m *MemoryStore) ListConfigs(tenant string) ([]ConfigRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	configs := []ConfigRecord{}
+	for _, config := range m.data.Configs {
+		if config.Tenant == tenant {
+			configs = append(configs, config)
+		}
+	}
+	return configs, nil
+}
+
+//ListAllConfigs returns the configurations of all the tenants.
+func (m *MemoryStore) ListAllConfigs() ([]ConfigRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	configs := make([]ConfigRecord, len(m.data.Configs))
+	copy(configs, m.data.Configs)
+	return configs, nil
+}
+
+//DeleteConfig removes the configuration.
+func (m *MemoryStore) DeleteConfig(tenant, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findConfig(tenant, id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Configs = append(m.data.Configs[:i], m.data.Configs[i+1:]...)
+	return m.changed()
+}
+
+func (m *MemoryStore) findJob(actionID string) int {
+	for i := range m.data.Jobs {
+		if m.data.Jobs[i].ActionID == actionID {
+			return i
+		}
+	}
+	return -1
+}
+
+//EnqueueJob adds the job to the end of the queue.
+func (m *MemoryStore) EnqueueJob(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.Jobs = append(m.data.Jobs, job)
+	return m.changed()
+}
+
+//ClaimJob marks the oldest queued job as running by owner and returns it.
+func (m *MemoryStore) ClaimJob(owner string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.data.Jobs {
+		job := &m.data.Jobs[i]
+		if job.State != JobQueued {
+			continue
+		}
+		job.State = JobRunning
+		job.Owner = owner
+		job.StartedAt = time.Now()
+		return *job, m.changed()
+	}
+	return Job{}, ErrNotFound
+}
+
+//RequeueJob puts a job running by owner back in the queue.
+func (m *MemoryStore) RequeueJob(actionID, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 || m.data.Jobs[i].State != JobRunning || m.data.Jobs[i].Owner != owner {
+		return ErrNotFound
+	}
+	m.data.Jobs[i].State = JobQueued
+	m.data.Jobs[i].Owner = ""
+	return m.changed()
+}
+
+//FinishJob marks the job as finished.
+func (m *MemoryStore) FinishJob(actionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Jobs[i].State = JobFinished
+	m.data.Jobs[i].FinishedAt = time.Now()
+	return m.changed()
+}
+
+//ReleaseJob queues a job pending approval.
+func (m *MemoryStore) ReleaseJob(actionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 || m.data.Jobs[i].State != JobPending {
+		return ErrNotFound
+	}
+	m.data.Jobs[i].State = JobQueued
+	return m.changed()
+}
+
+//CancelJob takes a pending or queued job off the queue.
+func (m *MemoryStore) CancelJob(actionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 || (m.data.Jobs[i].State != JobPending && m.data.Jobs[i].State != JobQueued) {
+		return ErrNotFound
+	}
+	m.data.Jobs[i].State = JobFinished
+	m.data.Jobs[i].FinishedAt = time.Now()
+	return m.changed()
+}
+
+//RequestCancel asks the worker running the job to cancel it.
+func (m *MemoryStore) RequestCancel(actionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 || m.data.Jobs[i].State != JobRunning {
+		return ErrNotFound
+	}
+	m.data.Jobs[i].CancelRequested = true
+	return m.changed()
+}
+
+//GetJob returns the job of the action.
+func (m *MemoryStore) GetJob(actionID string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findJob(actionID)
+	if i < 0 {
+		return Job{}, ErrNotFound
+	}
+	return m.data.Jobs[i], nil
+}
+
+//ListJobs returns the jobs in the given state.
+func (m *MemoryStore) ListJobs(state string) ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := []Job{}
+	for _, job := range m.data.Jobs {
+		if job.State == state {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+//Heartbeat records that the workers of owner are alive at the time.
+func (m *MemoryStore) Heartbeat(owner string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.heartbeats == nil {
+		m.heartbeats = make(map[string]time.Time)
+	}
+	m.heartbeats[owner] = at
+	return nil
+}
+
+//LiveOwners returns the owners with a heartbeat after since.
+func (m *MemoryStore) LiveOwners(since time.Time) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owners := make(map[string]bool)
+	for owner, at := range m.heartbeats {
+		if at.After(since) {
+			owners[owner] = true
+		}
+	}
+	return owners, nil
+}
+
+func (m *MemoryStore) findLock(tenant, configName string) int {
+	for i := range m.data.Locks {
+		if m.data.Locks[i].Tenant == tenant && m.data.Locks[i].ConfigName == configName {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryStore) removeLock(i int) error {
+	m.data.Locks = append(m.data.Locks[:i], m.data.Locks[i+1:]...)
+	return m.changed()
+}
+
+//AcquireLock takes lock.ConfigName of lock.Tenant for lock.ActionID.
+func (m *MemoryStore) AcquireLock(lock ConfigLock) (ConfigLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findLock(lock.Tenant, lock.ConfigName)
+	if i >= 0 {
+		if m.data.Locks[i].ActionID == lock.ActionID {
+			return m.data.Locks[i], nil
+		}
+		return m.data.Locks[i], ErrLocked
+	}
+	m.data.Locks = append(m.data.Locks, lock)
+	return lock, m.changed()
+}
+
+//ReleaseLock releases the lock on the configuration if actionID holds it.
+func (m *MemoryStore) ReleaseLock(tenant, configName, actionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findLock(tenant, configName)
+	if i < 0 || m.data.Locks[i].ActionID != actionID {
+		return ErrNotFound
+	}
+	return m.removeLock(i)
+}
+
+//GetLock returns the lock on the configuration.
+func (m *MemoryStore) GetLock(tenant, configName string) (ConfigLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findLock(tenant, configName)
+	if i < 0 {
+		return ConfigLock{}, ErrNotFound
+	}
+	return m.data.Locks[i], nil
+}
+
+//ForceUnlock releases the lock on the configuration whoever holds it.
+func (m *MemoryStore) ForceUnlock(tenant, configName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findLock(tenant, configName)
+	if i < 0 {
+		return ErrNotFound
+	}
+	return m.removeLock(i)
+}
+
+//SetApprovalPolicy saves the approval policy of policy.ConfigName of policy.Tenant.
+func (m *MemoryStore) SetApprovalPolicy(policy ApprovalPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.data.ApprovalPolicies {
+		p := m.data.ApprovalPolicies[i]
+		if p.Tenant == policy.Tenant && p.ConfigName == policy.ConfigName {
+			m.data.ApprovalPolicies[i] = policy
+			return m.changed()
+		}
+	}
+	m.data.ApprovalPolicies = append(m.data.ApprovalPolicies, policy)
+	return m.changed()
+}
+
+//GetApprovalPolicy returns the approval policy of the configuration.
+func (m *MemoryStore) GetApprovalPolicy(tenant, configName string) (ApprovalPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, policy := range m.data.ApprovalPolicies {
+		if policy.Tenant == tenant && policy.ConfigName == configName {
+			return policy, nil
+		}
+	}
+	return ApprovalPolicy{}, ErrNotFound
+}
+
+//AddApproval adds the approval to an action pending approval.
+func (m *MemoryStore) AddApproval(actionID string, approval Approval) (ActionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAction(actionID)
+	if i < 0 || m.data.Actions[i].Status != StatusPendingApproval {
+		return ActionResponse{}, ErrNotFound
+	}
+	a := &m.data.Actions[i]
+	for _, other := range a.Approvals {
+		if other.Approver == approval.Approver {
+			return *a, ErrDuplicate
+		}
+	}
+	a.Approvals = append(a.Approvals, approval)
+	return *a, m.changed()
+}
+
+//Close is a no-op for the MemoryStore.
+func (m *MemoryStore) Close() {
+}
+
+//AddStateVersion records a version of the state.
+func (m *MemoryStore) AddStateVersion(version StateVersion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.StateVersions = append(m.data.StateVersions, version)
+	return m.changed()
+}
+
+//ListStateVersions returns the versions of the state of the configuration.
+func (m *MemoryStore) ListStateVersions(tenant, configName string) ([]StateVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := []StateVersion{}
+	for _, version := range m.data.StateVersions {
+		if version.Tenant == tenant && version.ConfigName == configName {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+//GetStateVersion returns the version of the state of the configuration.
+func (m *MemoryStore) GetStateVersion(tenant, configName, versionID string) (StateVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, version := range m.data.StateVersions {
+		if version.Tenant == tenant && version.ConfigName == configName && version.VersionID == versionID {
+			return version, nil
+		}
+	}
+	return StateVersion{}, ErrNotFound
+}
+
+func (m *MemoryStore) findState(tenant, configName string) int {
+	for i := range m.data.RemoteStates {
+		if m.data.RemoteStates[i].Tenant == tenant && m.data.RemoteStates[i].ConfigName == configName {
+			return i
+		}
+	}
+	return -1
+}
+
+//GetState returns the state of the configuration.
+func (m *MemoryStore) GetState(tenant, configName string) (RemoteState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findState(tenant, configName)
+	if i < 0 {
+		return RemoteState{}, ErrNotFound
+	}
+	if m.data.RemoteStates[i].Data == "" {
+		return m.data.RemoteStates[i], ErrNotFound
+	}
+	return m.data.RemoteStates[i], nil
+}
+
+//PutState saves the state unless it is locked with another lock.
+func (m *MemoryStore) PutState(state RemoteState, lockID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findState(state.Tenant, state.ConfigName)
+	if i < 0 {
+		state.Lock = nil
+		m.data.RemoteStates = append(m.data.RemoteStates, state)
+		return m.changed()
+	}
+	lock := m.data.RemoteStates[i].Lock
+	if lock != nil && lock.ID != lockID {
+		return ErrLocked
+	}
+	state.Lock = lock
+	m.data.RemoteStates[i] = state
+	return m.changed()
+}
+
+//LockState locks the state of the configuration.
+func (m *MemoryStore) LockState(tenant, configName string, lock StateLock) (StateLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findState(tenant, configName)
+	if i < 0 {
+		m.data.RemoteStates = append(m.data.RemoteStates, RemoteState{Tenant: tenant, ConfigName: configName})
+		i = len(m.data.RemoteStates) - 1
+	}
+	if current := m.data.RemoteStates[i].Lock; current != nil {
+		return *current, ErrLocked
+	}
+	m.data.RemoteStates[i].Lock = &lock
+	return lock, m.changed()
+}
+
+//UnlockState releases the lock on the state.
+func (m *MemoryStore) UnlockState(tenant, configName, lockID string) (StateLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findState(tenant, configName)
+	if i < 0 || m.data.RemoteStates[i].Lock == nil {
+		return StateLock{}, nil
+	}
+	current := m.data.RemoteStates[i].Lock
+	if lockID != "" && current.ID != lockID {
+		return *current, ErrLocked
+	}
+	m.data.RemoteStates[i].Lock = nil
+	return StateLock{}, m.changed()
+}
+
+//DeleteState removes the state of the configuration.
+func (m *MemoryStore) DeleteState(tenant, configName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findState(tenant, configName)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.RemoteStates = append(m.data.RemoteStates[:i], m.data.RemoteStates[i+1:]...)
+	return m.changed()
+}
+
+func (m *MemoryStore) findSchedule(tenant, configName, scheduleID string) int {
+	for i, s := range m.data.Schedules {
+		if s.Tenant == tenant && s.ConfigName == configName && s.ScheduleID == scheduleID {
+			return i
+		}
+	}
+	return -1
+}
+
+//InsertSchedule adds the schedule.
+func (m *MemoryStore) InsertSchedule(schedule Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findSchedule(schedule.Tenant, schedule.ConfigName, schedule.ScheduleID) >= 0 {
+		return ErrDuplicate
+	}
+	m.data.Schedules = append(m.data.Schedules, schedule)
+	return m.changed()
+}
+
+//SaveSchedule replaces the schedule.
+func (m *MemoryStore) SaveSchedule(schedule Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(schedule.Tenant, schedule.ConfigName, schedule.ScheduleID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Schedules[i] = schedule
+	return m.changed()
+}
+
+//GetSchedule returns the schedule of the configuration.
+func (m *MemoryStore) GetSchedule(tenant, configName, scheduleID string) (Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(tenant, configName, scheduleID)
+	if i < 0 {
+		return Schedule{}, ErrNotFound
+	}
+	return m.data.Schedules[i], nil
+}
+
+//ListSchedules returns the schedules of the configuration.
+func (m *MemoryStore) ListSchedules(tenant, configName string) ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, s := range m.data.Schedules {
+		if s.Tenant == tenant && s.ConfigName == configName {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
+//ListDueSchedules returns the enabled schedules whose next run is not after
+//now.
+func (m *MemoryStore) ListDueSchedules(now time.Time) ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, s := range m.data.Schedules {
+		if s.Enabled && s.NextRun != nil && !s.NextRun.After(now) {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
+//ClaimSchedule moves the next run of the schedule to next.
+func (m *MemoryStore) ClaimSchedule(schedule Schedule, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(schedule.Tenant, schedule.ConfigName, schedule.ScheduleID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	current := m.data.Schedules[i].NextRun
+	if current == nil || schedule.NextRun == nil || !current.Equal(*schedule.NextRun) {
+		return ErrNotFound
+	}
+	m.data.Schedules[i].LastRun = m.data.Schedules[i].NextRun
+	m.data.Schedules[i].NextRun = next
+	return m.changed()
+}
+
+//SetScheduleRun records the outcome of the last run of the schedule.
+func (m *MemoryStore) SetScheduleRun(tenant, configName, scheduleID, actionID, skipped string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(tenant, configName, scheduleID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if actionID != "" {
+		m.data.Schedules[i].LastActionID = actionID
+	}
+	m.data.Schedules[i].LastSkipped = skipped
+	return m.changed()
+}
+
+//DeleteSchedule removes the schedule.
+func (m *MemoryStore) DeleteSchedule(tenant, configName, scheduleID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findSchedule(tenant, configName, scheduleID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Schedules = append(m.data.Schedules[:i], m.data.Schedules[i+1:]...)
+	return m.changed()
+}
+
+func (m *MemoryStore) findWebhook(tenant, configName, webhookID string) int {
+	for i, w := range m.data.Webhooks {
+		if w.Tenant == tenant && w.ConfigName == configName && w.WebhookID == webhookID {
+			return i
+		}
+	}
+	return -1
+}
+
+//InsertWebhook adds the webhook.
+func (m *MemoryStore) InsertWebhook(webhook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findWebhook(webhook.Tenant, webhook.ConfigName, webhook.WebhookID) >= 0 {
+		return ErrDuplicate
+	}
+	m.data.Webhooks = append(m.data.Webhooks, webhook)
+	return m.changed()
+}
+
+//SaveWebhook replaces the webhook.
+func (m *MemoryStore) SaveWebhook(webhook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findWebhook(webhook.Tenant, webhook.ConfigName, webhook.WebhookID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Webhooks[i] = webhook
+	return m.changed()
+}
+
+//GetWebhook returns the webhook of the configuration.
+func (m *MemoryStore) GetWebhook(tenant, configName, webhookID string) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findWebhook(tenant, configName, webhookID)
+	if i < 0 {
+		return Webhook{}, ErrNotFound
+	}
+	return m.data.Webhooks[i], nil
+}
+
+//ListWebhooks returns the webhooks of the configuration.
+func (m *MemoryStore) ListWebhooks(tenant, configName string) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := []Webhook{}
+	for _, w := range m.data.Webhooks {
+		if w.Tenant == tenant && w.ConfigName == configName {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks, nil
+}
+
+//DeleteWebhook removes the webhook and its deliveries.
+func (m *MemoryStore) DeleteWebhook(tenant, configName, webhookID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findWebhook(tenant, configName, webhookID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Webhooks = append(m.data.Webhooks[:i], m.data.Webhooks[i+1:]...)
+	deliveries := m.data.Deliveries[:0]
+	for _, d := range m.data.Deliveries {
+		if d.Tenant != tenant || d.ConfigName != configName || d.WebhookID != webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.data.Deliveries = deliveries
+	return m.changed()
+}
+
+func (m *MemoryStore) findDelivery(deliveryID string) int {
+	for i := range m.data.Deliveries {
+		if m.data.Deliveries[i].DeliveryID == deliveryID {
+			return i
+		}
+	}
+	return -1
+}
+
+//InsertDelivery adds the delivery and drops the oldest finished deliveries
+//of the webhook beyond maxDeliveries.
+func (m *MemoryStore) InsertDelivery(delivery WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findDelivery(delivery.DeliveryID) >= 0 {
+		return ErrDuplicate
+	}
+	m.data.Deliveries = append(m.data.Deliveries, delivery)
+
+	// The deliveries are appended, so the oldest come first
+	count := 0
+	for _, d := range m.data.Deliveries {
+		if d.WebhookID == delivery.WebhookID {
+			count++
+		}
+	}
+	deliveries := m.data.Deliveries[:0]
+	for _, d := range m.data.Deliveries {
+		if count > maxDeliveries && d.WebhookID == delivery.WebhookID && d.Status != DeliveryPending {
+			count--
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	m.data.Deliveries = deliveries
+	return m.changed()
+}
+
+//SaveDelivery replaces the delivery.
+func (m *MemoryStore) SaveDelivery(delivery WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findDelivery(delivery.DeliveryID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Deliveries[i] = delivery
+	return m.changed()
+}
+
+//DeleteDelivery removes the delivery.
+func (m *MemoryStore) DeleteDelivery(deliveryID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findDelivery(deliveryID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.data.Deliveries = append(m.data.Deliveries[:i], m.data.Deliveries[i+1:]...)
+	return m.changed()
+}
+
+//ListDeliveries returns the last deliveries of the webhook, the newest
+//first.
+func (m *MemoryStore) ListDeliveries(tenant, configName, webhookID string) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, d := range m.data.Deliveries {
+		if d.Tenant == tenant && d.ConfigName == configName && d.WebhookID == webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	if len(deliveries) > maxDeliveries {
+		deliveries = deliveries[:maxDeliveries]
+	}
+	return deliveries, nil
+}
+
+//ListDueDeliveries returns the pending deliveries whose next attempt is not
+//after now.
+func (m *MemoryStore) ListDueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, d := range m.data.Deliveries {
+		if d.Status == DeliveryPending && d.NextAttempt != nil && !d.NextAttempt.After(now) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+//ClaimDelivery moves the next attempt of the delivery to next.
+func (m *MemoryStore) ClaimDelivery(delivery WebhookDelivery, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findDelivery(delivery.DeliveryID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	current := m.data.Deliveries[i].NextAttempt
+	if current == nil || delivery.NextAttempt == nil || !current.Equal(*delivery.NextAttempt) {
+		return ErrNotFound
+	}
+	m.data.Deliveries[i].NextAttempt = next
+	return m.changed()
+}
@@ -0,0 +1,967 @@
+package utils
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//MongoStore keeps the action records in MongoDB.
+type MongoStore struct {
+	session *mgo.Session
+}
+
+//NewMongoStore dials MongoDB at url and makes sure the indexes exist.
+func NewMongoStore(url string) (*MongoStore, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mgo.Monotonic, true)
+
+	m := &MongoStore{session: session}
+	err = m.ensureIndex()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MongoStore) ensureIndex() error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	for _, name := range []string{"actionDetails", "jobs"} {
+		c := session.DB("action").C(name)
+		index := mgo.Index{
+			Key:        []string{"actionid"},
+			Unique:     true,
+			DropDups:   true,
+			Background: true,
+			Sparse:     true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			return err
+		}
+	}
+
+	c := session.DB("action").C("jobs")
+	err := c.EnsureIndexKey("state", "enqueuedat")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"locks", "approvalPolicies"} {
+		c = session.DB("action").C(name)
+		// Configuration names are only unique within a tenant
+		c.DropIndex("configname")
+		err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "configname"}, Unique: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	c = session.DB("action").C("configurations")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "id"}, Unique: true})
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("stateVersions")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "configname", "versionid"}, Unique: true})
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("states")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "configname"}, Unique: true})
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("schedules")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "configname", "scheduleid"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndexKey("enabled", "nextrun")
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("webhooks")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"tenant", "configname", "webhookid"}, Unique: true})
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("workers")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"owner"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	// The owners gone for a day are forgotten
+	err = c.EnsureIndex(mgo.Index{Key: []string{"heartbeat"}, ExpireAfter: 24 * time.Hour})
+	if err != nil {
+		return err
+	}
+
+	c = session.DB("action").C("webhookDeliveries")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"deliveryid"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndexKey("tenant", "configname", "webhookid", "-createdat")
+	if err != nil {
+		return err
+	}
+	err = c.EnsureIndexKey("status", "nextattempt")
+	if err != nil {
+		return err
+	}
+	// The delivery log is kept for a month
+	return c.EnsureIndex(mgo.Index{Key: []string{"createdat"}, ExpireAfter: 30 * 24 * time.Hour})
+}
+
+//tenantQuery matches the records of the tenant. The records made before
+//tenants existed have no tenant and belong to the default tenant.
+func tenantQuery(tenant string) interface{} {
+	if tenant == "" {
+		return bson.M{"$in": []interface{}{"", nil}}
+	}
+	return tenant
+}
+
+//InsertAction makes a new entry for the action.
+func (m *MongoStore) InsertAction(actionResponse ActionResponse) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("actionDetails")
+	err := c.Insert(actionResponse)
+	if err != nil && !mgo.IsDup(err) {
+		return err
+	}
+	return nil
+}
+
+//UpdateActionStatus updates the status of the action.
+func (m *MongoStore) UpdateActionStatus(actionID, status string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("actionDetails")
+	err := c.Update(bson.M{"actionid": actionID}, bson.M{"$set": bson.M{"status": status}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//SaveAction replaces the record of the action.
+func (m *MongoStore) SaveAction(actionResponse ActionResponse) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("actionDetails")
+	err := c.Update(bson.M{"actionid": actionResponse.ActionID}, actionResponse)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetAction returns the action with the given action ID.
+func (m *MongoStore) GetAction(actionID string) (ActionResponse, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var actionResponse ActionResponse
+	c := session.DB("action").C("actionDetails")
+	err := c.Find(bson.M{"actionid": actionID}).One(&actionResponse)
+	if err == mgo.ErrNotFound {
+		return actionResponse, ErrNotFound
+	}
+	return actionResponse, err
+}
+
+//ListActions returns the actions of the tenant for the configuration and action name.
+func (m *MongoStore) ListActions(tenant, configName, action string) ([]ActionResponse, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	query := bson.M{"tenant": tenantQuery(tenant)}
+	if configName != "" {
+		query["configname"] = configName
+	}
+	if action != "" {
+		query["action"] = action
+	}
+
+	actionResponse := []ActionResponse{}
+	c := session.DB("action").C("actionDetails")
+	err := c.Find(query).All(&actionResponse)
+	return actionResponse, err
+}
+
+//InsertConfig adds the configuration.
+func (m *MongoStore) InsertConfig(config ConfigRecord) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("configurations")
+	err := c.Insert(config)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+//SaveConfig replaces the record of the configuration but its expiry.
+func (m *MongoStore) SaveConfig(config ConfigRecord) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	b, err := bson.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var set bson.M
+	err = bson.Unmarshal(b, &set)
+	if err != nil {
+		return err
+	}
+	delete(set, "expiry")
+	c := session.DB("action").C("configurations")
+	err = c.Update(bson.M{"tenant": config.Tenant, "id": config.ID}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//SwapExpiry replaces the expiry of the configuration if it is still old.
+//The old expiry is part of the query, so only one server or request updates
+//it, and only the expiry is set.
+func (m *MongoStore) SwapExpiry(tenant, id string, old, expiry *ConfigExpiry) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	query := bson.M{"tenant": tenant, "id": id}
+	if old == nil {
+		query["expiry"] = nil
+	} else {
+		query["expiry.expiresat"] = old.ExpiresAt
+		query["expiry.actionid"] = old.ActionID
+		query["expiry.warned"] = old.Warned
+		// Older expiries have no destroyid
+		if old.DestroyID == "" {
+			query["expiry.destroyid"] = bson.M{"$in": []interface{}{"", nil}}
+		} else {
+			query["expiry.destroyid"] = old.DestroyID
+		}
+	}
+	c := session.DB("action").C("configurations")
+	err := c.Update(query, bson.M{"$set": bson.M{"expiry": expiry}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetConfig returns the configuration of the tenant.
+func (m *MongoStore) GetConfig(tenant, id string) (ConfigRecord, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var config ConfigRecord
+	c := session.DB("action").C("configurations")
+	err := c.Find(bson.M{"tenant": tenant, "id": id}).One(&config)
+	if err == mgo.ErrNotFound {
+		return config, ErrNotFound
+	}
+	return config, err
+}
+
+//ListConfigs returns the configurations of the tenant.
+func (m *MongoStore) ListConfigs(tenant string) ([]ConfigRecord, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	configs := []ConfigRecord{}
+	c := session.DB("action").C("configurations")
+	err := c.Find(bson.M{"tenant": tenant}).Sort("id").All(&configs)
+	return configs, err
+}
+
+//ListAllConfigs returns the configurations of all the tenants.
+func (m *MongoStore) ListAllConfigs() ([]ConfigRecord, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	configs := []ConfigRecord{}
+	c := session.DB("action").C("configurations")
+	err := c.Find(nil).Sort("tenant", "id").All(&configs)
+	return configs, err
+}
+
+//DeleteConfig removes the configuration.
+func (m *MongoStore) DeleteConfig(tenant, id string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("configurations")
+	err := c.Remove(bson.M{"tenant": tenant, "id": id})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//EnqueueJob adds the job to the end of the queue.
+func (m *MongoStore) EnqueueJob(job Job) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	return c.Insert(job)
+}
+
+//ClaimJob marks the oldest queued job as running by owner and returns it.
+func (m *MongoStore) ClaimJob(owner string) (Job, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var job Job
+	c := session.DB("action").C("jobs")
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"state": JobRunning, "owner": owner, "startedat": time.Now()}},
+		ReturnNew: true,
+	}
+	_, err := c.Find(bson.M{"state": JobQueued}).Sort("enqueuedat").Apply(change, &job)
+	if err == mgo.ErrNotFound {
+		return job, ErrNotFound
+	}
+	return job, err
+}
+
+//RequeueJob puts a job running by owner back in the queue.
+func (m *MongoStore) RequeueJob(actionID, owner string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	err := c.Update(bson.M{"actionid": actionID, "state": JobRunning, "owner": owner},
+		bson.M{"$set": bson.M{"state": JobQueued, "owner": ""}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//FinishJob marks the job as finished.
+func (m *MongoStore) FinishJob(actionID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	err := c.Update(bson.M{"actionid": actionID}, bson.M{"$set": bson.M{"state": JobFinished, "finishedat": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//ReleaseJob queues a job pending approval.
+func (m *MongoStore) ReleaseJob(actionID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	err := c.Update(bson.M{"actionid": actionID, "state": JobPending}, bson.M{"$set": bson.M{"state": JobQueued}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//CancelJob takes a pending or queued job off the queue.
+func (m *MongoStore) CancelJob(actionID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	err := c.Update(bson.M{"actionid": actionID, "state": bson.M{"$in": []string{JobPending, JobQueued}}},
+		bson.M{"$set": bson.M{"state": JobFinished, "finishedat": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//RequestCancel asks the worker running the job to cancel it.
+func (m *MongoStore) RequestCancel(actionID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("jobs")
+	err := c.Update(bson.M{"actionid": actionID, "state": JobRunning}, bson.M{"$set": bson.M{"cancelrequested": true}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetJob returns the job of the action.
+func (m *MongoStore) GetJob(actionID string) (Job, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var job Job
+	c := session.DB("action").C("jobs")
+	err := c.Find(bson.M{"actionid": actionID}).One(&job)
+	if err == mgo.ErrNotFound {
+		return job, ErrNotFound
+	}
+	return job, err
+}
+
+//ListJobs returns the jobs in the given state.
+func (m *MongoStore) ListJobs(state string) ([]Job, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	jobs := []Job{}
+	c := session.DB("action").C("jobs")
+	err := c.Find(bson.M{"state": state}).Sort("enqueuedat").All(&jobs)
+	return jobs, err
+}
+
+//ownerHeartbeat is the record of the last heartbeat of an owner.
+type ownerHeartbeat struct {
+	Owner     string
+	Heartbeat time.Time
+}
+
+//Heartbeat records that the workers of owner are alive at the time.
+func (m *MongoStore) Heartbeat(owner string, at time.Time) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("workers")
+	_, err := c.Upsert(bson.M{"owner": owner}, ownerHeartbeat{Owner: owner, Heartbeat: at})
+	return err
+}
+
+//LiveOwners returns the owners with a heartbeat after since.
+func (m *MongoStore) LiveOwners(since time.Time) (map[string]bool, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var heartbeats []ownerHeartbeat
+	c := session.DB("action").C("workers")
+	err := c.Find(bson.M{"heartbeat": bson.M{"$gt": since}}).All(&heartbeats)
+	owners := make(map[string]bool)
+	for _, h := range heartbeats {
+		owners[h.Owner] = true
+	}
+	return owners, err
+}
+
+//AcquireLock takes lock.ConfigName of lock.Tenant for lock.ActionID. The
+//unique index on tenant and configname makes sure only one action gets it.
+func (m *MongoStore) AcquireLock(lock ConfigLock) (ConfigLock, error) {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("locks")
+
+	err := c.Insert(lock)
+	if err == nil {
+		return lock, nil
+	}
+	if !mgo.IsDup(err) {
+		return lock, err
+	}
+
+	var holder ConfigLock
+	err = c.Find(bson.M{"tenant": tenantQuery(lock.Tenant), "configname": lock.ConfigName}).One(&holder)
+	if err == mgo.ErrNotFound {
+		// Released in the meantime
+		return m.AcquireLock(lock)
+	}
+	if err != nil {
+		return holder, err
+	}
+	if holder.ActionID == lock.ActionID {
+		return holder, nil
+	}
+	return holder, ErrLocked
+}
+
+//ReleaseLock releases the lock on the configuration if actionID holds it.
+func (m *MongoStore) ReleaseLock(tenant, configName, actionID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("locks")
+	err := c.Remove(bson.M{"tenant": tenantQuery(tenant), "configname": configName, "actionid": actionID})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetLock returns the lock on the configuration.
+func (m *MongoStore) GetLock(tenant, configName string) (ConfigLock, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var lock ConfigLock
+	c := session.DB("action").C("locks")
+	err := c.Find(bson.M{"tenant": tenantQuery(tenant), "configname": configName}).One(&lock)
+	if err == mgo.ErrNotFound {
+		return lock, ErrNotFound
+	}
+	return lock, err
+}
+
+//ForceUnlock releases the lock on the configuration whoever holds it.
+func (m *MongoStore) ForceUnlock(tenant, configName string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("locks")
+	err := c.Remove(bson.M{"tenant": tenantQuery(tenant), "configname": configName})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//SetApprovalPolicy saves the approval policy of policy.ConfigName of policy.Tenant.
+func (m *MongoStore) SetApprovalPolicy(policy ApprovalPolicy) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("approvalPolicies")
+	_, err := c.Upsert(bson.M{"tenant": tenantQuery(policy.Tenant), "configname": policy.ConfigName}, policy)
+	return err
+}
+
+//GetApprovalPolicy returns the approval policy of the configuration.
+func (m *MongoStore) GetApprovalPolicy(tenant, configName string) (ApprovalPolicy, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var policy ApprovalPolicy
+	c := session.DB("action").C("approvalPolicies")
+	err := c.Find(bson.M{"tenant": tenantQuery(tenant), "configname": configName}).One(&policy)
+	if err == mgo.ErrNotFound {
+		return policy, ErrNotFound
+	}
+	return policy, err
+}
+
+//AddApproval adds the approval to an action pending approval. The approver
+//is part of the query so two votes of the same approver cannot both land.
+func (m *MongoStore) AddApproval(actionID string, approval Approval) (ActionResponse, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var actionResponse ActionResponse
+	c := session.DB("action").C("actionDetails")
+	change := mgo.Change{
+		Update:    bson.M{"$push": bson.M{"approvals": approval}},
+		ReturnNew: true,
+	}
+	query := bson.M{
+		"actionid":           actionID,
+		"status":             StatusPendingApproval,
+		"approvals.approver": bson.M{"$ne": approval.Approver},
+	}
+	_, err := c.Find(query).Apply(change, &actionResponse)
+	if err != mgo.ErrNotFound {
+		return actionResponse, err
+	}
+
+	err = c.Find(bson.M{"actionid": actionID}).One(&actionResponse)
+	if err != nil || actionResponse.Status != StatusPendingApproval {
+		return actionResponse, ErrNotFound
+	}
+	return actionResponse, ErrDuplicate
+}
+
+//AddStateVersion records a version of the state.
+func (m *MongoStore) AddStateVersion(version StateVersion) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("stateVersions")
+	return c.Insert(version)
+}
+
+//ListStateVersions returns the versions of the state of the configuration.
+func (m *MongoStore) ListStateVersions(tenant, configName string) ([]StateVersion, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	versions := []StateVersion{}
+	c := session.DB("action").C("stateVersions")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName}).Sort("createdat").All(&versions)
+	return versions, err
+}
+
+//GetStateVersion returns the version of the state of the configuration.
+func (m *MongoStore) GetStateVersion(tenant, configName, versionID string) (StateVersion, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var version StateVersion
+	c := session.DB("action").C("stateVersions")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName, "versionid": versionID}).One(&version)
+	if err == mgo.ErrNotFound {
+		return version, ErrNotFound
+	}
+	return version, err
+}
+
+//GetState returns the state of the configuration.
+func (m *MongoStore) GetState(tenant, configName string) (RemoteState, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var state RemoteState
+	c := session.DB("action").C("states")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName}).One(&state)
+	if err == mgo.ErrNotFound || (err == nil && state.Data == "") {
+		return state, ErrNotFound
+	}
+	return state, err
+}
+
+//PutState saves the state unless it is locked with another lock. The lock
+//is part of the query, so a state locked by another lock does not match and
+//the upsert fails on the unique index.
+func (m *MongoStore) PutState(state RemoteState, lockID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	query := bson.M{"tenant": state.Tenant, "configname": state.ConfigName, "lock": nil}
+	if lockID != "" {
+		delete(query, "lock")
+		query["$or"] = []bson.M{{"lock": nil}, {"lock.id": lockID}}
+	}
+	update := bson.M{"$set": bson.M{
+		"data":      state.Data,
+		"serial":    state.Serial,
+		"lineage":   state.Lineage,
+		"updatedat": state.UpdatedAt,
+	}}
+	c := session.DB("action").C("states")
+	_, err := c.Upsert(query, update)
+	if mgo.IsDup(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+//LockState locks the state of the configuration.
+func (m *MongoStore) LockState(tenant, configName string, lock StateLock) (StateLock, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	c := session.DB("action").C("states")
+	_, err := c.Upsert(bson.M{"tenant": tenant, "configname": configName, "lock": nil}, bson.M{"$set": bson.M{"lock": lock}})
+	if mgo.IsDup(err) {
+		var state RemoteState
+		err = c.Find(bson.M{"tenant": tenant, "configname": configName}).One(&state)
+		if err != nil {
+			return StateLock{}, err
+		}
+		if state.Lock == nil {
+			return StateLock{}, ErrLocked
+		}
+		return *state.Lock, ErrLocked
+	}
+	return lock, err
+}
+
+//UnlockState releases the lock on the state.
+func (m *MongoStore) UnlockState(tenant, configName, lockID string) (StateLock, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	query := bson.M{"tenant": tenant, "configname": configName}
+	if lockID != "" {
+		query["lock.id"] = lockID
+	}
+	c := session.DB("action").C("states")
+	err := c.Update(query, bson.M{"$unset": bson.M{"lock": ""}})
+	if err != mgo.ErrNotFound {
+		return StateLock{}, err
+	}
+
+	var state RemoteState
+	err = c.Find(bson.M{"tenant": tenant, "configname": configName}).One(&state)
+	if err == mgo.ErrNotFound || (err == nil && state.Lock == nil) {
+		return StateLock{}, nil
+	}
+	if err != nil {
+		return StateLock{}, err
+	}
+	return *state.Lock, ErrLocked
+}
+
+//DeleteState removes the state of the configuration.
+func (m *MongoStore) DeleteState(tenant, configName string) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	c := session.DB("action").C("states")
+	err := c.Remove(bson.M{"tenant": tenant, "configname": configName})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//Close closes the MongoDB session.
+func (m *MongoStore) Close() {
+	m.session.Close()
+}
+
+//InsertSchedule adds the schedule.
+func (m *MongoStore) InsertSchedule(schedule Schedule) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("schedules")
+	err := c.Insert(schedule)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+//SaveSchedule replaces the schedule.
+func (m *MongoStore) SaveSchedule(schedule Schedule) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("schedules")
+	err := c.Update(bson.M{"tenant": schedule.Tenant, "configname": schedule.ConfigName, "scheduleid": schedule.ScheduleID}, schedule)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetSchedule returns the schedule of the configuration.
+func (m *MongoStore) GetSchedule(tenant, configName, scheduleID string) (Schedule, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var schedule Schedule
+	c := session.DB("action").C("schedules")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName, "scheduleid": scheduleID}).One(&schedule)
+	if err == mgo.ErrNotFound {
+		return schedule, ErrNotFound
+	}
+	return schedule, err
+}
+
+//ListSchedules returns the schedules of the configuration.
+func (m *MongoStore) ListSchedules(tenant, configName string) ([]Schedule, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	schedules := []Schedule{}
+	c := session.DB("action").C("schedules")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName}).Sort("createdat").All(&schedules)
+	return schedules, err
+}
+
+//ListDueSchedules returns the enabled schedules whose next run is not after
+//now.
+func (m *MongoStore) ListDueSchedules(now time.Time) ([]Schedule, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	schedules := []Schedule{}
+	c := session.DB("action").C("schedules")
+	err := c.Find(bson.M{"enabled": true, "nextrun": bson.M{"$lte": now}}).All(&schedules)
+	return schedules, err
+}
+
+//ClaimSchedule moves the next run of the schedule to next. The current next
+//run is part of the query, so only one server claims a run.
+func (m *MongoStore) ClaimSchedule(schedule Schedule, next *time.Time) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("schedules")
+	err := c.Update(
+		bson.M{"tenant": schedule.Tenant, "configname": schedule.ConfigName, "scheduleid": schedule.ScheduleID, "nextrun": schedule.NextRun},
+		bson.M{"$set": bson.M{"lastrun": schedule.NextRun, "nextrun": next}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//SetScheduleRun records the outcome of the last run of the schedule.
+func (m *MongoStore) SetScheduleRun(tenant, configName, scheduleID, actionID, skipped string) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	set := bson.M{"lastskipped": skipped}
+	if actionID != "" {
+		set["lastactionid"] = actionID
+	}
+	c := session.DB("action").C("schedules")
+	err := c.Update(bson.M{"tenant": tenant, "configname": configName, "scheduleid": scheduleID}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//DeleteSchedule removes the schedule.
+func (m *MongoStore) DeleteSchedule(tenant, configName, scheduleID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("schedules")
+	err := c.Remove(bson.M{"tenant": tenant, "configname": configName, "scheduleid": scheduleID})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//InsertWebhook adds the webhook.
+func (m *MongoStore) InsertWebhook(webhook Webhook) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhooks")
+	err := c.Insert(webhook)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+//SaveWebhook replaces the webhook.
+func (m *MongoStore) SaveWebhook(webhook Webhook) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhooks")
+	err := c.Update(bson.M{"tenant": webhook.Tenant, "configname": webhook.ConfigName, "webhookid": webhook.WebhookID}, webhook)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//GetWebhook returns the webhook of the configuration.
+func (m *MongoStore) GetWebhook(tenant, configName, webhookID string) (Webhook, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var webhook Webhook
+	c := session.DB("action").C("webhooks")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName, "webhookid": webhookID}).One(&webhook)
+	if err == mgo.ErrNotFound {
+		return webhook, ErrNotFound
+	}
+	return webhook, err
+}
+
+//ListWebhooks returns the webhooks of the configuration.
+func (m *MongoStore) ListWebhooks(tenant, configName string) ([]Webhook, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	webhooks := []Webhook{}
+	c := session.DB("action").C("webhooks")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName}).Sort("createdat").All(&webhooks)
+	return webhooks, err
+}
+
+//DeleteWebhook removes the webhook and its deliveries.
+func (m *MongoStore) DeleteWebhook(tenant, configName, webhookID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhooks")
+	err := c.Remove(bson.M{"tenant": tenant, "configname": configName, "webhookid": webhookID})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	c = session.DB("action").C("webhookDeliveries")
+	_, err = c.RemoveAll(bson.M{"tenant": tenant, "configname": configName, "webhookid": webhookID})
+	return err
+}
+
+//InsertDelivery adds the delivery. The old deliveries expire through the
+//index on createdat.
+func (m *MongoStore) InsertDelivery(delivery WebhookDelivery) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Insert(delivery)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+//SaveDelivery replaces the delivery.
+func (m *MongoStore) SaveDelivery(delivery WebhookDelivery) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Update(bson.M{"deliveryid": delivery.DeliveryID}, delivery)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//DeleteDelivery removes the delivery.
+func (m *MongoStore) DeleteDelivery(deliveryID string) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Remove(bson.M{"deliveryid": deliveryID})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+//ListDeliveries returns the last deliveries of the webhook, the newest
+//first.
+func (m *MongoStore) ListDeliveries(tenant, configName, webhookID string) ([]WebhookDelivery, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	deliveries := []WebhookDelivery{}
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Find(bson.M{"tenant": tenant, "configname": configName, "webhookid": webhookID}).Sort("-createdat").Limit(maxDeliveries).All(&deliveries)
+	return deliveries, err
+}
+
+//ListDueDeliveries returns the pending deliveries whose next attempt is not
+//after now.
+func (m *MongoStore) ListDueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	deliveries := []WebhookDelivery{}
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Find(bson.M{"status": DeliveryPending, "nextattempt": bson.M{"$lte": now}}).All(&deliveries)
+	return deliveries, err
+}
+
+//ClaimDelivery moves the next attempt of the delivery to next. The current
+//next attempt is part of the query, so only one server makes an attempt.
+func (m *MongoStore) ClaimDelivery(delivery WebhookDelivery, next *time.Time) error {
+	session := m.session.Copy()
+	defer session.Close()
+	c := session.DB("action").C("webhookDeliveries")
+	err := c.Update(
+		bson.M{"deliveryid": delivery.DeliveryID, "nextattempt": delivery.NextAttempt},
+		bson.M{"$set": bson.M{"nextattempt": next}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//storeTests are run on each kind of ActionStore, each one in a tenant of its
+//own.
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, store ActionStore, tenant string)
+}{
+	{"ClaimJob", testClaimJob},
+	{"ClaimJobOnce", testClaimJobOnce},
+	{"AcquireLock", testAcquireLock},
+	{"AddApproval", testAddApproval},
+	{"SwapExpiry", testSwapExpiry},
+	{"Heartbeat", testHeartbeat},
+	{"RequestCancel", testRequestCancel},
+}
+
+func runStoreTests(t *testing.T, store ActionStore) {
+	for _, tt := range storeTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, store, "test-"+newActionID()[:8])
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "actions.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStoreTests(t, store)
+
+	// The records are loaded back from the file
+	err = store.InsertAction(ActionResponse{ActionID: "reloaded", Status: StatusQueued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action, err := reloaded.GetAction("reloaded")
+	if err != nil || action.Status != StatusQueued {
+		t.Errorf("GetAction after reload = %+v, %v", action, err)
+	}
+}
+
+//TestMongoStore runs on the MongoDB server of TEST_MONGO_URL. The tests
+//claim the queued jobs of the server, so it must not be one in use.
+func TestMongoStore(t *testing.T) {
+	url := os.Getenv("TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("TEST_MONGO_URL is not set")
+	}
+	store, err := NewMongoStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	runStoreTests(t, store)
+}
+
+func testClaimJob(t *testing.T, store ActionStore, tenant string) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	jobs := []Job{
+		{ActionID: tenant + "-pending", State: JobPending},
+		{ActionID: tenant + "-first", State: JobQueued},
+		{ActionID: tenant + "-second", State: JobQueued},
+		{ActionID: tenant + "-running", State: JobRunning, Owner: "other"},
+	}
+	for i, job := range jobs {
+		job.Tenant = tenant
+		job.ConfigName = "config"
+		job.Action = "plan"
+		job.EnqueuedAt = start.Add(time.Duration(i) * time.Minute)
+		err := store.EnqueueJob(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name     string
+		requeue  string
+		owner    string
+		actionID string
+		err      error
+	}{
+		{name: "oldest queued job first", owner: "w1", actionID: tenant + "-first"},
+		{name: "then the next one", owner: "w2", actionID: tenant + "-second"},
+		{name: "pending and running jobs are left", owner: "w3", err: ErrNotFound},
+		{name: "requeue by another owner", requeue: tenant + "-first", owner: "w2", err: ErrNotFound},
+		{name: "requeue by its owner", requeue: tenant + "-first", owner: "w1"},
+		{name: "requeued job is claimed again", owner: "w3", actionID: tenant + "-first"},
+	}
+	for _, step := range steps {
+		if step.requeue != "" {
+			err := store.RequeueJob(step.requeue, step.owner)
+			if err != step.err {
+				t.Errorf("%s: RequeueJob = %v, want %v", step.name, err, step.err)
+			}
+			continue
+		}
+		job, err := store.ClaimJob(step.owner)
+		if err != step.err {
+			t.Errorf("%s: ClaimJob error = %v, want %v", step.name, err, step.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if job.ActionID != step.actionID || job.State != JobRunning || job.Owner != step.owner {
+			t.Errorf("%s: ClaimJob = %s %s by %q, want %s running by %q", step.name, job.ActionID, job.State, job.Owner, step.actionID, step.owner)
+		}
+	}
+
+	for _, job := range jobs {
+		store.FinishJob(job.ActionID)
+	}
+}
+
+func testClaimJobOnce(t *testing.T, store ActionStore, tenant string) {
+	err := store.EnqueueJob(Job{ActionID: tenant, Tenant: tenant, ConfigName: "config", Action: "plan", State: JobQueued, EnqueuedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of the workers racing for the job gets it
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			job, err := store.ClaimJob(owner)
+			if err == nil && job.ActionID == tenant {
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			}
+		}(newActionID())
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("the job was claimed %d times, want 1", claimed)
+	}
+	store.FinishJob(tenant)
+}
+
+func testAcquireLock(t *testing.T, store ActionStore, tenant string) {
+	steps := []struct {
+		name     string
+		op       string
+		config   string
+		actionID string
+		err      error
+		holder   string
+	}{
+		{name: "free lock", op: "acquire", config: "a", actionID: "1", holder: "1"},
+		{name: "same action again", op: "acquire", config: "a", actionID: "1", holder: "1"},
+		{name: "held by another action", op: "acquire", config: "a", actionID: "2", err: ErrLocked, holder: "1"},
+		{name: "another configuration", op: "acquire", config: "b", actionID: "2", holder: "2"},
+		{name: "release by another action", op: "release", config: "a", actionID: "2", err: ErrNotFound},
+		{name: "release by the holder", op: "release", config: "a", actionID: "1"},
+		{name: "released lock", op: "acquire", config: "a", actionID: "2", holder: "2"},
+		{name: "force unlock", op: "force", config: "a"},
+		{name: "after force unlock", op: "acquire", config: "a", actionID: "3", holder: "3"},
+	}
+	for _, step := range steps {
+		var err error
+		var lock ConfigLock
+		switch step.op {
+		case "acquire":
+			lock, err = store.AcquireLock(ConfigLock{Tenant: tenant, ConfigName: step.config, ActionID: step.actionID, Action: "apply", LockedAt: time.Now()})
+		case "release":
+			err = store.ReleaseLock(tenant, step.config, step.actionID)
+		case "force":
+			err = store.ForceUnlock(tenant, step.config)
+			if err == nil {
+				_, err = store.GetLock(tenant, step.config)
+				if err == ErrNotFound {
+					err = nil
+				}
+			}
+		}
+		if err != step.err {
+			t.Errorf("%s: error = %v, want %v", step.name, err, step.err)
+		}
+		if step.op == "acquire" && lock.ActionID != step.holder {
+			t.Errorf("%s: lock held by %q, want %q", step.name, lock.ActionID, step.holder)
+		}
+	}
+
+	// The locks are per tenant
+	_, err := store.AcquireLock(ConfigLock{Tenant: tenant + "-other", ConfigName: "a", ActionID: "4"})
+	if err != nil {
+		t.Errorf("lock of another tenant: %v", err)
+	}
+	store.ForceUnlock(tenant, "a")
+	store.ForceUnlock(tenant, "b")
+	store.ForceUnlock(tenant+"-other", "a")
+}
+
+func testAddApproval(t *testing.T, store ActionStore, tenant string) {
+	pending := tenant + "-pending"
+	queued := tenant + "-queued"
+	for _, action := range []ActionResponse{
+		{Tenant: tenant, ConfigName: "config", Action: "apply", ActionID: pending, Status: StatusPendingApproval},
+		{Tenant: tenant, ConfigName: "config", Action: "apply", ActionID: queued, Status: StatusQueued},
+	} {
+		err := store.InsertAction(action)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		actionID  string
+		approver  string
+		approved  bool
+		err       error
+		approvals int
+	}{
+		{name: "first approval", actionID: pending, approver: "alice", approved: true, approvals: 1},
+		{name: "second vote of an approver", actionID: pending, approver: "alice", approved: false, err: ErrDuplicate, approvals: 1},
+		{name: "rejection", actionID: pending, approver: "bob", approved: false, approvals: 2},
+		{name: "action not pending approval", actionID: queued, approver: "carol", approved: true, err: ErrNotFound},
+		{name: "unknown action", actionID: tenant + "-unknown", approver: "carol", approved: true, err: ErrNotFound},
+	}
+	for _, tt := range tests {
+		action, err := store.AddApproval(tt.actionID, Approval{Approver: tt.approver, Approved: tt.approved, At: time.Now()})
+		if err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && len(action.Approvals) != tt.approvals {
+			t.Errorf("%s: %d approvals, want %d", tt.name, len(action.Approvals), tt.approvals)
+		}
+	}
+
+	action, err := store.GetAction(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(action.Approvals) != 2 || action.Approvals[0].Approver != "alice" || !action.Approvals[0].Approved || action.Approvals[1].Approved {
+		t.Errorf("recorded approvals = %+v", action.Approvals)
+	}
+}
+
+func testSwapExpiry(t *testing.T, store ActionStore, tenant string) {
+	err := store.InsertConfig(ConfigRecord{Tenant: tenant, ID: "config", Variables: []ConfigVariable{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	set := &ConfigExpiry{ExpiresAt: expiresAt, ActionID: "apply"}
+	warned := &ConfigExpiry{ExpiresAt: expiresAt, ActionID: "apply", Warned: true}
+	extended := &ConfigExpiry{ExpiresAt: expiresAt.Add(time.Hour), ActionID: "apply"}
+
+	steps := []struct {
+		name     string
+		old, new *ConfigExpiry
+		err      error
+	}{
+		{name: "set", old: nil, new: set},
+		{name: "set again from none", old: nil, new: extended, err: ErrNotFound},
+		{name: "warn", old: set, new: warned},
+		{name: "extend from the unwarned expiry", old: set, new: extended, err: ErrNotFound},
+		{name: "extend", old: warned, new: extended},
+		{name: "clear", old: extended, new: nil},
+		{name: "clear again", old: extended, new: nil, err: ErrNotFound},
+	}
+	for _, step := range steps {
+		err := store.SwapExpiry(tenant, "config", step.old, step.new)
+		if err != step.err {
+			t.Errorf("%s: SwapExpiry = %v, want %v", step.name, err, step.err)
+		}
+	}
+
+	// SaveConfig keeps the expiry
+	err = store.SwapExpiry(tenant, "config", nil, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SaveConfig(ConfigRecord{Tenant: tenant, ID: "config", GitURL: "updated", Variables: []ConfigVariable{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := store.GetConfig(tenant, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GitURL != "updated" || !sameExpiry(config.Expiry, set) {
+		t.Errorf("after SaveConfig: git url %q, expiry %+v", config.GitURL, config.Expiry)
+	}
+	store.DeleteConfig(tenant, "config")
+}
+
+func testHeartbeat(t *testing.T, store ActionStore, tenant string) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	owners := []string{tenant + ":1:old", tenant + ":2:new"}
+	store.Heartbeat(owners[0], now.Add(-time.Hour))
+	store.Heartbeat(owners[1], now.Add(-time.Hour))
+	err := store.Heartbeat(owners[1], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := store.LiveOwners(now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live[owners[0]] || !live[owners[1]] {
+		t.Errorf("LiveOwners = %v, want %s but not %s", live, owners[1], owners[0])
+	}
+}
+
+func testRequestCancel(t *testing.T, store ActionStore, tenant string) {
+	for _, state := range []string{JobQueued, JobRunning, JobFinished} {
+		err := store.EnqueueJob(Job{ActionID: tenant + "-" + state, Tenant: tenant, State: state, EnqueuedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, state := range []string{JobQueued, JobFinished} {
+		if err := store.RequestCancel(tenant + "-" + state); err != ErrNotFound {
+			t.Errorf("RequestCancel of a %s job = %v, want ErrNotFound", state, err)
+		}
+	}
+	err := store.RequestCancel(tenant + "-" + JobRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.GetJob(tenant + "-" + JobRunning)
+	if err != nil || !job.CancelRequested {
+		t.Errorf("GetJob after RequestCancel = %+v, %v", job, err)
+	}
+}
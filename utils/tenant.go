@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+//DefaultTenant is the tenant of the requests without an X-Tenant header. Its
+//workspace is MOUNT_DIR itself so the configurations made before tenants
+//existed stay where they are. It is stored as the empty tenant.
+const DefaultTenant = "default"
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+//reservedDirs are the directories of a workspace that are not configurations.
+var reservedDirs = map[string]bool{
+	"log":     true,
+	"state":   true,
+	"plan":    true,
+	"tenants": true,
+}
+
+// TenantQuota -
+type TenantQuota struct {
+	MaxConfigurations int `json:"max_configurations,omitempty" description:"Number of configurations the tenant can have, 0 for no limit"`
+	MaxActiveActions  int `json:"max_active_actions,omitempty" description:"Number of actions of the tenant that can be pending approval, queued or running at once, 0 for no limit"`
+}
+
+//tenantQuotas are the tenants allowed by SetupTenants, nil when any tenant
+//is allowed.
+var tenantQuotas map[string]TenantQuota
+
+//SetupTenants only allows the tenants in the file at path, a JSON object
+//from tenant name to its quota.
+func SetupTenants(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var quotas map[string]TenantQuota
+	err = json.Unmarshal(b, &quotas)
+	if err != nil {
+		return err
+	}
+
+	tenantQuotas = make(map[string]TenantQuota)
+	for name, quota := range quotas {
+		if !tenantNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid tenant name %q", name)
+		}
+		tenantQuotas[tenantKey(name)] = quota
+	}
+	if _, ok := tenantQuotas[""]; !ok {
+		tenantQuotas[""] = TenantQuota{}
+	}
+	return nil
+}
+
+//tenantKey returns how the tenant is stored, "" for the default tenant.
+func tenantKey(name string) string {
+	if name == DefaultTenant {
+		return ""
+	}
+	return name
+}
+
+//Workspace is the directory tree of a tenant.
+type Workspace struct {
+	Tenant   string
+	Dir      string
+	LogDir   string
+	StateDir string
+	PlanDir  string
+}
+
+//tenantWorkspace returns the workspace of the tenant. The default tenant
+//works in MOUNT_DIR, the others in MOUNT_DIR/tenants/<tenant>.
+func tenantWorkspace(tenant string) Workspace {
+	dir := currentDir
+	if tenant != "" {
+		dir = path.Join(currentDir, "tenants", tenant)
+	}
+	return Workspace{
+		Tenant:   tenant,
+		Dir:      dir,
+		LogDir:   path.Join(dir, "log"),
+		StateDir: path.Join(dir, "state"),
+		PlanDir:  path.Join(dir, "plan"),
+	}
+}
+
+//makeDirs creates the directories of the workspace.
+func (ws Workspace) makeDirs() error {
+	for _, dir := range []string{ws.LogDir, ws.StateDir, ws.PlanDir} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//gitRemote returns the url the repo was cloned from.
+func gitRemote(confDir string) string {
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = confDir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+//QuotaError is returned when the tenant has used up its quota.
+type QuotaError struct {
+	Tenant string
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	tenant := e.Tenant
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	return fmt.Sprintf("tenant %s is over its quota: %s", tenant, e.Reason)
+}
+
+//checkConfigQuota tells if the tenant can add a configuration.
+func checkConfigQuota(store ActionStore, tenant string) error {
+	quota := tenantQuotas[tenant]
+	if quota.MaxConfigurations == 0 {
+		return nil
+	}
+	configs, err := store.ListConfigs(tenant)
+	if err != nil {
+		return err
+	}
+	if len(configs) >= quota.MaxConfigurations {
+		return &QuotaError{Tenant: tenant, Reason: fmt.Sprintf("it has %d of %d configurations", len(configs), quota.MaxConfigurations)}
+	}
+	return nil
+}
+
+//checkActionQuota tells if the tenant can queue another action.
+func checkActionQuota(store ActionStore, tenant string) error {
+	quota := tenantQuotas[tenant]
+	if quota.MaxActiveActions == 0 {
+		return nil
+	}
+	active := 0
+	for _, state := range []string{JobPending, JobQueued, JobRunning} {
+		jobs, err := store.ListJobs(state)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if job.Tenant == tenant {
+				active++
+			}
+		}
+	}
+	if active >= quota.MaxActiveActions {
+		return &QuotaError{Tenant: tenant, Reason: fmt.Sprintf("it has %d of %d actions pending, queued or running", active, quota.MaxActiveActions)}
+	}
+	return nil
+}
+
+type tenantContextKey struct{}
+
+//requestTenant returns the tenant the caller works in. It is the tenant of
+//the identity, if it has one, or else the one in the X-Tenant header. With
+//authentication on, an identity without a tenant is pinned to the default
+//tenant unless it is an admin. The status code to answer with is returned
+//with the error.
+func requestTenant(r *http.Request, id Identity) (string, int, error) {
+	name := r.Header.Get("X-Tenant")
+	if id.Tenant != "" {
+		if name != "" && name != id.Tenant {
+			return "", 403, fmt.Errorf("%s cannot work in tenant %s", id.Subject, name)
+		}
+		name = id.Tenant
+	} else if authConfig != nil && id.Role != RoleAdmin && name != "" && name != DefaultTenant {
+		return "", 403, fmt.Errorf("%s can only work in tenant %s", id.Subject, DefaultTenant)
+	}
+	if name == "" {
+		return "", 0, nil
+	}
+	if !tenantNameRegexp.MatchString(name) {
+		return "", 400, fmt.Errorf("invalid tenant %q", name)
+	}
+	tenant := tenantKey(name)
+	if tenantQuotas != nil {
+		if _, ok := tenantQuotas[tenant]; !ok {
+			return "", 404, fmt.Errorf("unknown tenant %s", name)
+		}
+	}
+	return tenant, 0, nil
+}
+
+//RequestTenant returns the tenant of the request resolved by Authorize, ""
+//for the default tenant.
+func RequestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+func requestWorkspace(r *http.Request) Workspace {
+	return tenantWorkspace(RequestTenant(r))
+}
+
+//getTenantAction returns the action if it belongs to the tenant and
+//ErrNotFound otherwise.
+func getTenantAction(store ActionStore, tenant, actionID string) (ActionResponse, error) {
+	actionResponse, err := store.GetAction(actionID)
+	if err == nil && actionResponse.Tenant != tenant {
+		return ActionResponse{}, ErrNotFound
+	}
+	return actionResponse, err
+}
+
+//getTenantJob returns the job if it belongs to the tenant and ErrNotFound
+//otherwise.
+func getTenantJob(store ActionStore, tenant, actionID string) (Job, error) {
+	job, err := store.GetJob(actionID)
+	if err == nil && job.Tenant != tenant {
+		return Job{}, ErrNotFound
+	}
+	return job, err
+}
@@ -2,48 +2,103 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
-//TerraformInit ...
-func TerraformInit(configDir string, scenario string, timeout *time.Duration, randomID string) error {
+//stateArgs returns the arguments that point terraform to the local state
+//file of the scenario, none when the server is its state backend.
+func stateArgs(stateDir, scenario string) []string {
+	if stateBackendURL != "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("-state=%s", stateDir+"/"+scenario+".tfstate")}
+}
 
-	return run("terraform", []string{"init"}, configDir, scenario, timeout, randomID)
+//TerraformInit ...
+func TerraformInit(configDir, logDir string, scenario string, timeout *time.Duration, randomID string) error {
+	args := []string{"init", "-input=false"}
+	if stateBackendURL != "" {
+		args = append(args, "-reconfigure")
+	}
+	return run("terraform", args, configDir, logDir, scenario, nil, timeout, randomID)
 }
 
 //TerraformApply ...
-func TerraformApply(configDir, stateDir string, scenario string, timeout *time.Duration, randomID string) error {
-	return run("terraform", []string{"apply", fmt.Sprintf("-state=%s", stateDir+"/"+scenario+".tfstate"), "-auto-approve"}, configDir, scenario, timeout, randomID)
+func TerraformApply(configDir, stateDir, logDir string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
+	return run("terraform", append([]string{"apply"}, append(stateArgs(stateDir, scenario), "-auto-approve")...), configDir, logDir, scenario, secrets, timeout, randomID)
+}
+
+//TerraformApplyPlan applies the saved plan.
+func TerraformApplyPlan(configDir, stateDir, logDir, planFile string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
+	return run("terraform", append([]string{"apply"}, append(stateArgs(stateDir, scenario), "-auto-approve", planFile)...), configDir, logDir, scenario, secrets, timeout, randomID)
 }
 
 //TerraformPlan ...
-func TerraformPlan(configDir string, scenario string, timeout *time.Duration, randomID string) error {
-	return run("terraform", []string{"plan"}, configDir, scenario, timeout, randomID)
+func TerraformPlan(configDir, stateDir, logDir, planFile string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
+	return run("terraform", append([]string{"plan"}, append(stateArgs(stateDir, scenario), fmt.Sprintf("-out=%s", planFile))...), configDir, logDir, scenario, secrets, timeout, randomID)
+}
+
+//TerraformShowPlan returns the JSON representation of the saved plan.
+func TerraformShowPlan(configDir, logDir, planFile string, timeout *time.Duration, randomID string) ([]byte, error) {
+	return output("terraform", []string{"show", "-json", planFile}, configDir, logDir, timeout, randomID)
 }
 
 //TerraformDestroy ...
-func TerraformDestroy(configDir, stateDir string, scenario string, timeout *time.Duration, randomID string) error {
+func TerraformDestroy(configDir, stateDir, logDir string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
 
-	return run("terraform", []string{"destroy", "-force", fmt.Sprintf("-state=%s", stateDir+"/"+scenario+".tfstate")}, configDir, scenario, timeout, randomID)
+	return run("terraform", append([]string{"destroy", "-force"}, stateArgs(stateDir, scenario)...), configDir, logDir, scenario, secrets, timeout, randomID)
 }
 
 //TerraformShow ...
-func TerraformShow(configDir, stateDir string, scenario string, timeout *time.Duration, randomID string) error {
+func TerraformShow(configDir, stateDir, logDir string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
+
+	args := []string{"show"}
+	if stateBackendURL == "" {
+		args = append(args, stateDir+"/"+scenario+".tfstate")
+	}
+	return run("terraform", args, configDir, logDir, scenario, secrets, timeout, randomID)
+}
 
-	return run("terraform", []string{"show", fmt.Sprintf("%s", stateDir+"/"+scenario+".tfstate")}, configDir, scenario, timeout, randomID)
+//TerraformOutput returns the outputs in the state as JSON. It is not an
+//action, so nothing is logged.
+func TerraformOutput(configDir, stateDir string, scenario string, timeout *time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "terraform", append([]string{"output", "-json"}, stateArgs(stateDir, scenario)...)...)
+	cmd.Dir = configDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("terraform output failed: %v %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
 }
 
-func run(cmdName string, args []string, configDir string, scenario string, timeout *time.Duration, randomID string) error {
+//run runs the command with the sensitive variables in its environment and
+//writes its output, without their values, to the log files of the action.
+func run(cmdName string, args []string, configDir, logDir string, scenario string, secrets []ConfigVariable, timeout *time.Duration, randomID string) error {
 	cmd := exec.Command(cmdName, args...)
+	ctx := context.Background()
 	if timeout != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
 		cmd = exec.CommandContext(ctx, cmdName, args...)
+		cmd.Cancel = func() error { return killGroup(cmd) }
 		defer cancel()
 	}
 
@@ -55,6 +110,8 @@ func run(cmdName string, args []string, configDir string, scenario string, timeo
 	defer stderrFile.Close()
 
 	cmd.Dir = configDir
+	cmd.Env = tfVarEnv(secrets)
+	scrubber := newScrubber(secrets)
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -66,36 +123,61 @@ func run(cmdName string, args []string, configDir string, scenario string, timeo
 		return err
 	}
 
-	//Write the stdout to log file
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			fmt.Fprintln(stdoutFile, scanner.Text())
-		}
-	}()
+	// The log files are only closed once all the output is in them
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go copyLog(stdoutFile, stdout, scrubber, &copying)
+	go copyLog(stderrFile, stderr, scrubber, &copying)
 
-	//Write the stderr to log file
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			fmt.Fprintln(stderrFile, scanner.Text())
+	//Start the command and wait for it to finish
+	fmt.Println("Starting command", cmd.Path, cmd.Args)
+	return timedOut(ctx, runCmd(randomID, cmd, &copying))
+}
 
+//copyLog writes the lines read from r to the log file, without the
+//sensitive values, until r is closed.
+func copyLog(logFile io.Writer, r io.Reader, scrubber *strings.Replacer, copying *sync.WaitGroup) {
+	defer copying.Done()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			fmt.Fprintln(logFile, scrubber.Replace(strings.TrimSuffix(line, "\n")))
+		}
+		if err != nil {
+			return
 		}
-	}()
+	}
+}
 
-	//Start the command
-	fmt.Println("Starting command", cmd.Path, cmd.Args)
-	err = cmd.Start()
-	if err != nil {
-		return err
+//output runs the command like run but returns its stdout instead of
+//writing it to the log.
+func output(cmdName string, args []string, configDir, logDir string, timeout *time.Duration, randomID string) ([]byte, error) {
+	cmd := exec.Command(cmdName, args...)
+	ctx := context.Background()
+	if timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		cmd = exec.CommandContext(ctx, cmdName, args...)
+		cmd.Cancel = func() error { return killGroup(cmd) }
+		defer cancel()
 	}
 
-	//Wait for command to finish
-	err = cmd.Wait()
+	stdoutFile, stderrFile, err := getLogFiles(logDir, randomID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer stdoutFile.Close()
+	defer stderrFile.Close()
+
+	var stdout bytes.Buffer
+	cmd.Dir = configDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderrFile
+
+	fmt.Println("Starting command", cmd.Path, cmd.Args)
+	err = timedOut(ctx, runCmd(randomID, cmd, nil))
+	return stdout.Bytes(), err
 }
 
 func getLogFiles(logDir, scenario string) (stdoutFile, stderrFile *os.File, err error) {
@@ -119,7 +201,7 @@ func getLogFiles(logDir, scenario string) (stdoutFile, stderrFile *os.File, err
 	return
 }
 
-func readLogFile(logID string) (stdout, stderr string, err error) {
+func readLogFile(logDir, logID string) (stdout, stderr string, err error) {
 	stdoutPath := path.Join(logDir, logID+".out")
 	stderrPath := path.Join(logDir, logID+".err")
 
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunWritesTheWholeLog(t *testing.T) {
+	logDir := t.TempDir()
+	secrets := []ConfigVariable{{Name: "token", Value: "s3cr3t-t0ken", Sensitive: true}}
+	script := `for i in $(seq 2000); do echo "line $i $TF_VAR_token"; done
+head -c 100000 /dev/zero | tr '\0' x; echo
+printf 'Error: the last line' >&2`
+	err := run("sh", []string{"-c", script}, logDir, logDir, "config", secrets, nil, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(logDir, "a1.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != 2001 || lines[1999] != fmt.Sprintf("line 2000 %s", maskedSecret) || len(lines[2000]) != 100000 {
+		t.Errorf("the output log has %d lines, ending with %.40q", len(lines), lines[len(lines)-1])
+	}
+	if strings.Contains(string(out), "s3cr3t-t0ken") {
+		t.Error("the secret is in the output log")
+	}
+	errLog, err := ioutil.ReadFile(filepath.Join(logDir, "a1.err"))
+	if err != nil || string(errLog) != "Error: the last line\n" {
+		t.Errorf("the error log is %q, %v", errLog, err)
+	}
+}
@@ -0,0 +1,476 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+//The kinds of token of a terraform file
+const (
+	tokenIdent = iota
+	tokenString
+	tokenHeredoc
+	tokenNumber
+	tokenNewline
+	tokenPunct
+)
+
+type tfToken struct {
+	kind       int
+	text       string
+	start, end int
+}
+
+//tokenizeTF splits a terraform file into the tokens needed to find its
+//blocks and attributes. Comments are dropped, strings, templates and
+//heredocs are single tokens.
+func tokenizeTF(src string) ([]tfToken, error) {
+	tokens := []tfToken{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case c == '\n':
+			i++
+			tokens = append(tokens, tfToken{tokenNewline, "\n", start, i})
+			continue
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", start)
+			}
+			i += end + 4
+			continue
+		case c == '"':
+			end, err := scanTFString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, tfToken{tokenString, src[start:i], start, i})
+			continue
+		case strings.HasPrefix(src[i:], "<<"):
+			end, err := scanHeredoc(src, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, tfToken{tokenHeredoc, src[start:i], start, i})
+			continue
+		case isIdentStart(c):
+			for i < len(src) && (isIdentStart(src[i]) || isDigit(src[i]) || src[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, tfToken{tokenIdent, src[start:i], start, i})
+			continue
+		case isDigit(c):
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.' || src[i] == 'e' || src[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, tfToken{tokenNumber, src[start:i], start, i})
+			continue
+		}
+		i++
+		tokens = append(tokens, tfToken{tokenPunct, src[start:i], start, i})
+	}
+	return tokens, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+//scanTFString returns the end of the quoted string starting at i, after the
+//templates it holds, which can hold strings too.
+func scanTFString(src string, i int) (int, error) {
+	start := i
+	i++
+	for i < len(src) {
+		switch {
+		case src[i] == '\\':
+			i += 2
+		case src[i] == '"':
+			return i + 1, nil
+		case src[i] == '\n':
+			return 0, fmt.Errorf("unterminated string at offset %d", start)
+		case strings.HasPrefix(src[i:], "$${") || strings.HasPrefix(src[i:], "%%{"):
+			i += 3
+		case strings.HasPrefix(src[i:], "${") || strings.HasPrefix(src[i:], "%{"):
+			i += 2
+			depth := 1
+			for i < len(src) && depth > 0 {
+				switch src[i] {
+				case '"':
+					end, err := scanTFString(src, i)
+					if err != nil {
+						return 0, err
+					}
+					i = end
+					continue
+				case '{':
+					depth++
+				case '}':
+					depth--
+				}
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+//scanHeredoc returns the end of the heredoc starting at i.
+func scanHeredoc(src string, i int) (int, error) {
+	start := i
+	i += 2
+	if i < len(src) && src[i] == '-' {
+		i++
+	}
+	nl := strings.IndexByte(src[i:], '\n')
+	if nl < 0 {
+		return 0, fmt.Errorf("unterminated heredoc at offset %d", start)
+	}
+	marker := strings.TrimSpace(src[i : i+nl])
+	i += nl + 1
+	for i < len(src) {
+		end := strings.IndexByte(src[i:], '\n')
+		if end < 0 {
+			end = len(src) - i
+		}
+		if strings.TrimSpace(src[i:i+end]) == marker {
+			return i + end, nil
+		}
+		i += end + 1
+	}
+	return 0, fmt.Errorf("unterminated heredoc %s at offset %d", marker, start)
+}
+
+//tfBody is the parser of the body of a terraform file or block.
+type tfBody struct {
+	src    string
+	tokens []tfToken
+	pos    int
+}
+
+func (b *tfBody) skipNewlines() {
+	for b.pos < len(b.tokens) && b.tokens[b.pos].kind == tokenNewline {
+		b.pos++
+	}
+}
+
+func (b *tfBody) peek(offset int) *tfToken {
+	if b.pos+offset < len(b.tokens) {
+		return &b.tokens[b.pos+offset]
+	}
+	return nil
+}
+
+//expression returns the text of the expression at pos, up to the end of the
+//line or the closing brace of the block it is in.
+func (b *tfBody) expression() string {
+	depth := 0
+	start := b.pos
+	for b.pos < len(b.tokens) {
+		t := b.tokens[b.pos]
+		if depth == 0 && (t.kind == tokenNewline || t.text == "}" || t.text == ",") {
+			break
+		}
+		if t.kind == tokenPunct {
+			switch t.text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+		}
+		b.pos++
+	}
+	if start == b.pos {
+		return ""
+	}
+	return strings.TrimSpace(b.src[b.tokens[start].start:b.tokens[b.pos-1].end])
+}
+
+//block skips the labels of the block at pos and returns them, with pos after
+//its opening brace.
+func (b *tfBody) block() ([]string, error) {
+	labels := []string{}
+	for b.pos < len(b.tokens) {
+		t := b.tokens[b.pos]
+		b.pos++
+		switch {
+		case t.text == "{":
+			return labels, nil
+		case t.kind == tokenString:
+			labels = append(labels, unquoteTF(t.text))
+		case t.kind == tokenIdent:
+			labels = append(labels, t.text)
+		default:
+			return nil, fmt.Errorf("unexpected %q in a block header at offset %d", t.text, t.start)
+		}
+	}
+	return nil, fmt.Errorf("unterminated block header")
+}
+
+//skipBlock moves pos after the closing brace of the block it is in.
+func (b *tfBody) skipBlock() error {
+	depth := 1
+	for b.pos < len(b.tokens) {
+		t := b.tokens[b.pos]
+		b.pos++
+		if t.kind != tokenPunct {
+			continue
+		}
+		switch t.text {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unterminated block")
+}
+
+//items calls attribute for the attributes and block for the blocks of the
+//body, up to its closing brace when inBlock. block is called with pos after
+//the opening brace and must leave it after the closing one.
+func (b *tfBody) items(inBlock bool, attribute func(name, expr string), block func(typ string, labels []string) error) error {
+	for {
+		b.skipNewlines()
+		t := b.peek(0)
+		if t == nil {
+			if inBlock {
+				return fmt.Errorf("unterminated block")
+			}
+			return nil
+		}
+		if t.text == "}" && inBlock {
+			b.pos++
+			return nil
+		}
+		if t.text == "," {
+			b.pos++
+			continue
+		}
+		if t.kind != tokenIdent && t.kind != tokenString {
+			return fmt.Errorf("unexpected %q at offset %d", t.text, t.start)
+		}
+		name := unquoteTF(t.text)
+		if next := b.peek(1); next != nil && (next.text == "=" || next.text == ":") {
+			b.pos += 2
+			attribute(name, b.expression())
+			continue
+		}
+		b.pos++
+		labels, err := b.block()
+		if err != nil {
+			return err
+		}
+		err = block(name, labels)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//unquoteTF returns the value of a quoted string, or the text when it is not
+//a plain string.
+func unquoteTF(text string) string {
+	if len(text) < 2 || text[0] != '"' {
+		return text
+	}
+	var s string
+	if err := json.Unmarshal([]byte(text), &s); err == nil {
+		return s
+	}
+	return text[1 : len(text)-1]
+}
+
+// VariableSchema -
+type VariableSchema struct {
+	Name        string  `json:"name" description:"The variable's name"`
+	Type        string  `json:"type,omitempty" description:"The type constraint of the variable, any type if empty"`
+	Default     *string `json:"default,omitempty" description:"The default value, as written in the configuration"`
+	Description string  `json:"description,omitempty" description:"The variable's description"`
+	Sensitive   bool    `json:"sensitive,omitempty" description:"Terraform hides the value in its output"`
+	Required    bool    `json:"required" description:"The variable has no default, so it must be given"`
+	Given       bool    `json:"given" description:"The configuration gives the variable a value"`
+}
+
+//parseTFVariables returns the variables declared in a terraform file.
+func parseTFVariables(src string) ([]VariableSchema, error) {
+	tokens, err := tokenizeTF(src)
+	if err != nil {
+		return nil, err
+	}
+	body := &tfBody{src: src, tokens: tokens}
+	schemas := []VariableSchema{}
+	err = body.items(false, func(string, string) {}, func(typ string, labels []string) error {
+		if typ != "variable" || len(labels) != 1 {
+			return body.skipBlock()
+		}
+		schema := VariableSchema{Name: labels[0]}
+		err := body.items(true, func(name, expr string) {
+			switch name {
+			case "type":
+				schema.Type = unquoteTF(expr)
+			case "default":
+				def := expr
+				schema.Default = &def
+			case "description":
+				schema.Description = unquoteTF(expr)
+			case "sensitive":
+				schema.Sensitive = expr == "true"
+			}
+		}, func(string, []string) error {
+			return body.skipBlock()
+		})
+		schemas = append(schemas, schema)
+		return err
+	})
+	return schemas, err
+}
+
+//parseTFJSONVariables returns the variables declared in a .tf.json file.
+func parseTFJSONVariables(src []byte) ([]VariableSchema, error) {
+	var file struct {
+		Variable map[string]struct {
+			Type        string           `json:"type"`
+			Default     *json.RawMessage `json:"default"`
+			Description string           `json:"description"`
+			Sensitive   bool             `json:"sensitive"`
+		} `json:"variable"`
+	}
+	err := json.Unmarshal(src, &file)
+	if err != nil {
+		return nil, err
+	}
+	schemas := []VariableSchema{}
+	for name, v := range file.Variable {
+		schema := VariableSchema{Name: name, Type: v.Type, Description: v.Description, Sensitive: v.Sensitive}
+		if v.Default != nil {
+			def := string(*v.Default)
+			schema.Default = &def
+		}
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Name < schemas[j].Name })
+	return schemas, nil
+}
+
+//autoTFVars returns the names of the variables set by the *.auto.tfvars
+//files of the directory, which terraform loads on its own.
+func autoTFVars(dir string) (map[string]bool, error) {
+	names := map[string]bool{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasSuffix(f.Name(), ".auto.tfvars"):
+			tokens, err := tokenizeTF(string(b))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			body := &tfBody{src: string(b), tokens: tokens}
+			err = body.items(false, func(name, expr string) {
+				names[name] = true
+			}, func(string, []string) error {
+				return body.skipBlock()
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+		case strings.HasSuffix(f.Name(), ".auto.tfvars.json"):
+			var values map[string]json.RawMessage
+			err = json.Unmarshal(b, &values)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			for name := range values {
+				names[name] = true
+			}
+		}
+	}
+	return names, nil
+}
+
+//readVariableSchema returns the variables declared in the terraform files of
+//the directory, in the order of the files.
+func readVariableSchema(dir string) ([]VariableSchema, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	schemas := []VariableSchema{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		var fileSchemas []VariableSchema
+		switch {
+		case strings.HasSuffix(f.Name(), ".tf"):
+			b, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			fileSchemas, err = parseTFVariables(string(b))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+		case strings.HasSuffix(f.Name(), ".tf.json"):
+			b, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			fileSchemas, err = parseTFJSONVariables(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+		}
+		for _, schema := range fileSchemas {
+			if schema.Type == "" && schema.Default != nil {
+				// Terraform 0.11 infers a list or map from the default
+				def := strings.TrimSpace(*schema.Default)
+				if strings.HasPrefix(def, "[") {
+					schema.Type = "list"
+				} else if strings.HasPrefix(def, "{") {
+					schema.Type = "map"
+				}
+			}
+			schema.Required = schema.Default == nil
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas, nil
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTFVariables(t *testing.T) {
+	src := `# The network of the cluster
+variable "zones" {
+  type    = list(string) // one subnet per zone
+  default = ["us-south-1", "us-south-2"]
+}
+
+/* The workers, by pool
+   name = "not an attribute" */
+variable "pools" {
+  description = "Worker pools { by name }"
+  type = map(object({
+    flavor = string
+    count  = number
+  }))
+  default = {
+    default = { flavor = "bx2.4x16", count = 3 }
+  }
+}
+
+variable "user_data" {
+  default = <<-EOT
+    #!/bin/sh
+    echo "${var.zones}" }
+  EOT
+  sensitive = true
+}
+
+variable "api_key" {
+  # No default, it must be given
+  type = string
+  validation {
+    condition     = length(var.api_key) > 0
+    error_message = "The api key cannot be empty."
+  }
+}
+
+resource "ibm_is_vpc" "vpc" {
+  name = "vpc"
+}
+`
+	schemas, err := parseTFVariables(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	want := []VariableSchema{
+		{Name: "zones", Type: "list(string)", Default: str(`["us-south-1", "us-south-2"]`)},
+		{Name: "pools", Type: "map(object({\n    flavor = string\n    count  = number\n  }))", Description: "Worker pools { by name }", Default: str("{\n    default = { flavor = \"bx2.4x16\", count = 3 }\n  }")},
+		{Name: "user_data", Default: str("<<-EOT\n    #!/bin/sh\n    echo \"${var.zones}\" }\n  EOT"), Sensitive: true},
+		{Name: "api_key", Type: "string"},
+	}
+	if len(schemas) != len(want) {
+		t.Fatalf("parseTFVariables returned %d variables, want %d: %+v", len(schemas), len(want), schemas)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(schemas[i], want[i]) {
+			t.Errorf("variable %d = %+v, want %+v", i, describeSchema(schemas[i]), describeSchema(want[i]))
+		}
+	}
+}
+
+//describeSchema returns the schema with its default as a string, for the
+//error messages.
+func describeSchema(schema VariableSchema) map[string]interface{} {
+	d := map[string]interface{}{"name": schema.Name, "type": schema.Type, "description": schema.Description, "sensitive": schema.Sensitive}
+	if schema.Default != nil {
+		d["default"] = *schema.Default
+	}
+	return d
+}
+
+func TestParseTFVariablesErrors(t *testing.T) {
+	for _, src := range []string{
+		`variable "a" {`,
+		`variable "a" { default = "unterminated }`,
+		"variable \"a\" {\n  default = <<EOT\n  no end\n}\n",
+	} {
+		if _, err := parseTFVariables(src); err == nil {
+			t.Errorf("parseTFVariables(%q) did not fail", src)
+		}
+	}
+}
+
+func TestMissingRequiredVariable(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"variables.tf":         "variable \"region\" {}\nvariable \"api_key\" {\n  type = string\n}\nvariable \"zone\" {\n  default = \"us-south-1\"\n}\nvariable \"prefix\" {}\n",
+		"defaults.auto.tfvars": "prefix = \"dev\"\n",
+		"variables.tf.json":    `{"variable": {"count": {"type": "number"}}}`,
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	schemas, err := readVariableSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auto, err := autoTFVars(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compareVariables(schemas, auto, []ConfigVariable{{Name: "region", Value: "us-south", Type: VarTypeString}})
+	verr, ok := err.(*VariablesError)
+	if !ok {
+		t.Fatalf("compareVariables = %v, want a *VariablesError", err)
+	}
+	want := []string{"api_key", "count"}
+	if !reflect.DeepEqual(verr.Missing, want) {
+		t.Errorf("missing variables = %q, want %q", verr.Missing, want)
+	}
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Types of variable values
+const (
+	VarTypeString = ""
+	VarTypeJSON   = "json"
+	VarTypeHCL    = "hcl"
+)
+
+var variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+//hclEscaper escapes a string for a quoted HCL string, including the
+//template sequences terraform would otherwise interpolate.
+var hclEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"${", "$${",
+	"%{", "%%{",
+)
+
+//parseVariableValue returns the value of a variable of a request as stored,
+//with its type. A JSON string is stored as is, any other JSON value as JSON
+//and the value of an hcl variable as the HCL expression.
+func parseVariableValue(name string, raw json.RawMessage, hcl bool) (string, string, error) {
+	if !variableNameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("invalid variable name %q", name)
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		if hcl {
+			return "", "", fmt.Errorf("the hcl variable %s has no expression", name)
+		}
+		return "", VarTypeString, nil
+	}
+
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid value of %s: %v", name, err)
+		}
+		if hcl {
+			if strings.TrimSpace(s) == "" {
+				return "", "", fmt.Errorf("the hcl variable %s has no expression", name)
+			}
+			return s, VarTypeHCL, nil
+		}
+		return s, VarTypeString, nil
+	}
+	if hcl {
+		return "", "", fmt.Errorf("the value of the hcl variable %s must be a string holding the expression", name)
+	}
+
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid value of %s: %v", name, err)
+	}
+	var compact bytes.Buffer
+	err = json.Compact(&compact, raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid value of %s: %v", name, err)
+	}
+	return compact.String(), VarTypeJSON, nil
+}
+
+//hcl returns the value of the variable as an HCL expression. The value is
+//the decrypted one for a sensitive variable.
+func (v ConfigVariable) hcl() string {
+	switch v.Type {
+	case VarTypeHCL:
+		return v.Value
+	case VarTypeJSON:
+		d := json.NewDecoder(strings.NewReader(v.Value))
+		d.UseNumber()
+		var value interface{}
+		if err := d.Decode(&value); err == nil {
+			return hclValue(value)
+		}
+	}
+	return hclString(v.Value)
+}
+
+//envValue returns the value of the variable as given in a TF_VAR_ variable,
+//which terraform reads raw for a string and as HCL for the other types.
+func (v ConfigVariable) envValue() string {
+	if v.Type == VarTypeString {
+		return v.Value
+	}
+	return v.hcl()
+}
+
+func hclString(s string) string {
+	return `"` + hclEscaper.Replace(s) + `"`
+}
+
+//hclValue renders a decoded JSON value as an HCL expression.
+func hclValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprint(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return hclString(v)
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, hclValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := []string{}
+		for _, key := range keys {
+			items = append(items, hclString(key)+" = "+hclValue(v[key]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return hclString(fmt.Sprint(value))
+}
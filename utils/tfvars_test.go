@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHCLString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: `""`},
+		{in: "plain", want: `"plain"`},
+		{in: `say "hi"`, want: `"say \"hi\""`},
+		{in: `C:\path`, want: `"C:\\path"`},
+		{in: "two\nlines\r\tend", want: `"two\nlines\r\tend"`},
+		{in: "${var.x}", want: `"$${var.x}"`},
+		{in: "%{ if true }", want: `"%%{ if true }"`},
+		{in: "$5 and 100%", want: `"$5 and 100%"`},
+		{in: "ünïcode ✓", want: `"ünïcode ✓"`},
+	}
+	for _, tt := range tests {
+		got := hclString(tt.in)
+		if got != tt.want {
+			t.Errorf("hclString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseVariableValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		variable  string
+		raw       string
+		hcl       bool
+		wantValue string
+		wantType  string
+		wantErr   bool
+	}{
+		{name: "string", variable: "a", raw: `"x"`, wantValue: "x", wantType: VarTypeString},
+		{name: "empty", variable: "a", raw: ``, wantValue: "", wantType: VarTypeString},
+		{name: "number", variable: "a", raw: `42`, wantValue: "42", wantType: VarTypeJSON},
+		{name: "bool", variable: "a", raw: `true`, wantValue: "true", wantType: VarTypeJSON},
+		{name: "list compacted", variable: "a", raw: `[ 1, "two" ]`, wantValue: `[1,"two"]`, wantType: VarTypeJSON},
+		{name: "map", variable: "a", raw: `{"k": {"n": null}}`, wantValue: `{"k":{"n":null}}`, wantType: VarTypeJSON},
+		{name: "hcl expression", variable: "a", raw: `"[for s in var.l : upper(s)]"`, hcl: true, wantValue: "[for s in var.l : upper(s)]", wantType: VarTypeHCL},
+		{name: "hcl without expression", variable: "a", raw: `"  "`, hcl: true, wantErr: true},
+		{name: "hcl not a string", variable: "a", raw: `1`, hcl: true, wantErr: true},
+		{name: "invalid json", variable: "a", raw: `[1,`, wantErr: true},
+		{name: "invalid name", variable: "1a", raw: `"x"`, wantErr: true},
+		{name: "name with a quote", variable: `a"b`, raw: `"x"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		value, typ, err := parseVariableValue(tt.variable, json.RawMessage(tt.raw), tt.hcl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (value != tt.wantValue || typ != tt.wantType) {
+			t.Errorf("%s: = %q %q, want %q %q", tt.name, value, typ, tt.wantValue, tt.wantType)
+		}
+	}
+}
+
+func TestVariableHCL(t *testing.T) {
+	tests := []struct {
+		name     string
+		variable ConfigVariable
+		hcl      string
+		env      string
+	}{
+		{name: "string", variable: ConfigVariable{Value: `a "b" ${c}`}, hcl: `"a \"b\" $${c}"`, env: `a "b" ${c}`},
+		{name: "number keeps its digits", variable: ConfigVariable{Value: "12345678901234567890", Type: VarTypeJSON}, hcl: "12345678901234567890", env: "12345678901234567890"},
+		{name: "null", variable: ConfigVariable{Value: "null", Type: VarTypeJSON}, hcl: "null", env: "null"},
+		{name: "list", variable: ConfigVariable{Value: `[1,"x",true]`, Type: VarTypeJSON}, hcl: `[1, "x", true]`, env: `[1, "x", true]`},
+		{name: "map sorted and escaped", variable: ConfigVariable{Value: `{"z":"${x}","a b":[]}`, Type: VarTypeJSON}, hcl: `{"a b" = [], "z" = "$${x}"}`, env: `{"a b" = [], "z" = "$${x}"}`},
+		{name: "invalid json is a string", variable: ConfigVariable{Value: `{`, Type: VarTypeJSON}, hcl: `"{"`, env: `"{"`},
+		{name: "hcl as is", variable: ConfigVariable{Value: `merge(var.a, {b = 1})`, Type: VarTypeHCL}, hcl: `merge(var.a, {b = 1})`, env: `merge(var.a, {b = 1})`},
+	}
+	for _, tt := range tests {
+		if got := tt.variable.hcl(); got != tt.hcl {
+			t.Errorf("%s: hcl() = %s, want %s", tt.name, got, tt.hcl)
+		}
+		if got := tt.variable.envValue(); got != tt.env {
+			t.Errorf("%s: envValue() = %s, want %s", tt.name, got, tt.env)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//expiryWarning is how long before the expiry of a configuration Slack is
+//warned.
+var expiryWarning = time.Hour
+
+// ConfigExpiry -
+type ConfigExpiry struct {
+	ExpiresAt time.Time `json:"expires_at" description:"When the server destroys the resources of the configuration"`
+	ActionID  string    `json:"action_id" description:"The apply that set the ttl"`
+	Warned    bool      `json:"warned,omitempty" description:"Slack was warned the expiry is near"`
+	DestroyID string    `json:"destroy_id,omitempty" description:"The destroy queued once the configuration expired"`
+}
+
+// ExtendRequest -
+type ExtendRequest struct {
+	TTL string `json:"ttl" description:"How much longer the resources are kept, e.g. 4h"`
+}
+
+//errNoExpiry is returned when a configuration without a ttl is extended.
+var errNoExpiry = errors.New("The configuration has no ttl, apply it with one.")
+
+//expiryRetries is how many times an expiry changed by another request or
+//server is read again before giving up.
+const expiryRetries = 5
+
+//parseTTL parses the ttl of an apply request.
+func parseTTL(ttl string) (time.Duration, error) {
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q, it must be a positive duration like 8h", ttl)
+	}
+	return d, nil
+}
+
+//sameExpiry tells if the two expiries are the same.
+func sameExpiry(a, b *ConfigExpiry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ExpiresAt.Equal(b.ExpiresAt) && a.ActionID == b.ActionID && a.Warned == b.Warned && a.DestroyID == b.DestroyID
+}
+
+//updateExpiry replaces the expiry of the configuration with the one update
+//returns from the current one, reading it again if another request or server
+//changed it meanwhile. update returns the current expiry to leave it as is.
+func updateExpiry(store ActionStore, tenant, configName string, update func(expiry *ConfigExpiry) (*ConfigExpiry, error)) (*ConfigExpiry, error) {
+	for i := 0; i < expiryRetries; i++ {
+		config, err := store.GetConfig(tenant, configName)
+		if err != nil {
+			return nil, err
+		}
+		expiry, err := update(config.Expiry)
+		if err != nil || sameExpiry(expiry, config.Expiry) {
+			return expiry, err
+		}
+		err = store.SwapExpiry(tenant, configName, config.Expiry, expiry)
+		if err != ErrNotFound {
+			return expiry, err
+		}
+	}
+	return nil, fmt.Errorf("the expiry of %s keeps changing", configName)
+}
+
+//recordExpiry sets the expiry of the configuration after an apply with a
+//ttl. The apply has succeeded anyway, so a failure is only logged.
+func recordExpiry(store ActionStore, job Job) {
+	ttl, err := parseTTL(job.TTL)
+	if err == nil {
+		_, err = updateExpiry(store, job.Tenant, job.ConfigName, func(*ConfigExpiry) (*ConfigExpiry, error) {
+			return &ConfigExpiry{ExpiresAt: time.Now().Add(ttl), ActionID: job.ActionID}, nil
+		})
+	}
+	if err != nil {
+		log.Println("Failed to record the expiry of the configuration : ", err)
+	}
+}
+
+//clearExpiry removes the expiry of the configuration once it is destroyed.
+func clearExpiry(store ActionStore, job Job) {
+	_, err := updateExpiry(store, job.Tenant, job.ConfigName, func(*ConfigExpiry) (*ConfigExpiry, error) {
+		return nil, nil
+	})
+	if err != nil && err != ErrNotFound {
+		log.Println("Failed to clear the expiry of the configuration : ", err)
+	}
+}
+
+//expireConfigs warns Slack of the configurations expiring within the hour
+//and queues a destroy of the expired ones.
+func expireConfigs(store ActionStore) {
+	configs, err := store.ListAllConfigs()
+	if err != nil {
+		log.Println("Failed to list the configurations : ", err)
+		return
+	}
+	now := time.Now()
+	for _, config := range configs {
+		if config.Expiry == nil {
+			continue
+		}
+		var err error
+		switch {
+		case !now.Before(config.Expiry.ExpiresAt):
+			err = destroyExpired(store, config)
+		case !config.Expiry.Warned && now.Add(expiryWarning).After(config.Expiry.ExpiresAt):
+			err = warnExpiry(store, config)
+		}
+		if err != nil {
+			log.Println("Failed to expire the configuration "+config.ID+" : ", err)
+		}
+	}
+}
+
+//expiryJob returns the apply job that set the expiry, for the logs and the
+//Slack webhook of the messages about it.
+func expiryJob(store ActionStore, config ConfigRecord) Job {
+	job, err := store.GetJob(config.Expiry.ActionID)
+	if err != nil {
+		job = Job{Tenant: config.Tenant, ConfigName: config.ID, ActionID: config.Expiry.ActionID, Action: "apply"}
+	}
+	if job.Webhook == "" {
+		job.Webhook = config.SlackWebhook
+	}
+	return job
+}
+
+//warnExpiry tells Slack the resources of the configuration are about to be
+//destroyed. The expiry is marked as warned first, so only the server that
+//marks it warns.
+func warnExpiry(store ActionStore, config ConfigRecord) error {
+	warned := *config.Expiry
+	warned.Warned = true
+	err := store.SwapExpiry(config.Tenant, config.ID, config.Expiry, &warned)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	job := expiryJob(store, config)
+	left := time.Until(config.Expiry.ExpiresAt).Round(time.Minute)
+	status := fmt.Sprintf("%s expires at %s, it is destroyed in %s unless extended", config.ID, config.Expiry.ExpiresAt.UTC().Format(time.RFC3339), left)
+	notify(store, job, EventExpiring, status)
+	return nil
+}
+
+//destroyExpired queues the destroy of the expired configuration, unless one
+//was queued already. The destroy is recorded on the expiry before it is
+//queued, so only the server that records it queues it. A configuration
+//locked by another action is left for the next round, a failed destroy is
+//not retried before the expiry is extended.
+func destroyExpired(store ActionStore, config ConfigRecord) error {
+	if config.Expiry.DestroyID != "" {
+		return nil
+	}
+	applyJob := expiryJob(store, config)
+	job := Job{
+		Tenant:     config.Tenant,
+		ConfigName: config.ID,
+		ActionID:   newActionID(),
+		Action:     "destroy",
+		Webhook:    applyJob.Webhook,
+		CreatedBy:  "ttl",
+	}
+	queued := *config.Expiry
+	queued.DestroyID = job.ActionID
+	err := store.SwapExpiry(config.Tenant, config.ID, config.Expiry, &queued)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	actionResponse, err := enqueueAction(store, job, publicURL+"/v1/configuration/"+config.ID+"/destroy")
+	if err != nil {
+		// Leave the destroy to the next round
+		swapErr := store.SwapExpiry(config.Tenant, config.ID, &queued, config.Expiry)
+		if swapErr != nil && swapErr != ErrNotFound {
+			log.Println("Failed to release the destroy of the configuration : ", swapErr)
+		}
+	}
+	switch err.(type) {
+	case *LockedError, *QuotaError:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued destroy %s of %s, expired at %s\n", actionResponse.ActionID, config.ID, config.Expiry.ExpiresAt)
+	return nil
+}
+
+//ExtendHandler handles request to extend the ttl of the configuration.
+// @Title ExtendHandler
+// @Description Keep the resources of the configuration longer before the server destroys them. The ttl is added to the current expiry, or to now once it has passed.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   body     body     ExtendRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ConfigExpiry
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 409 {object} ConfigLock
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/expiry/extend [post]
+func ExtendHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		tenant := RequestTenant(r)
+
+		// Read body
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var msg ExtendRequest
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		ttl, err := parseTTL(msg.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// A destroy of the expired configuration holds the lock
+		randomID := newActionID()
+		err = lockConfig(store, tenant, repoName, "extend", randomID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlockConfig(store, tenant, repoName, randomID)
+
+		expiry, err := updateExpiry(store, tenant, repoName, func(expiry *ConfigExpiry) (*ConfigExpiry, error) {
+			if expiry == nil {
+				return nil, errNoExpiry
+			}
+			from := expiry.ExpiresAt
+			if from.Before(time.Now()) {
+				from = time.Now()
+			}
+			return &ConfigExpiry{ExpiresAt: from.Add(ttl), ActionID: expiry.ActionID}, nil
+		})
+		if err == ErrNotFound {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		if err == errNoExpiry {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("Extended the expiry of %s to %s\n", repoName, expiry.ExpiresAt)
+		writeJSON(w, expiry)
+	}
+}
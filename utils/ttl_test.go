@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireConfigs(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	expiries := map[string]*ConfigExpiry{
+		"no-ttl":    nil,
+		"later":     {ExpiresAt: now.Add(3 * time.Hour), ActionID: "apply-later"},
+		"expiring":  {ExpiresAt: now.Add(30 * time.Minute), ActionID: "apply-expiring"},
+		"expired":   {ExpiresAt: now.Add(-time.Minute), ActionID: "apply-expired"},
+		"destroyed": {ExpiresAt: now.Add(-time.Hour), ActionID: "apply-destroyed", Warned: true, DestroyID: "earlier-destroy"},
+		"locked":    {ExpiresAt: now.Add(-time.Minute), ActionID: "apply-locked"},
+	}
+	for id, expiry := range expiries {
+		err := store.InsertConfig(ConfigRecord{ID: id, Variables: []ConfigVariable{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expiry != nil {
+			err = store.SwapExpiry("", id, nil, expiry)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := lockConfig(store, "", "locked", "plan", "running-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expireConfigs(store)
+
+	config := func(id string) ConfigRecord {
+		config, err := store.GetConfig("", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	if config("no-ttl").Expiry != nil {
+		t.Error("a configuration without ttl was given an expiry")
+	}
+	if e := config("later").Expiry; e.Warned || e.DestroyID != "" {
+		t.Errorf("configuration expiring later = %+v, want it untouched", e)
+	}
+	if e := config("expiring").Expiry; !e.Warned || e.DestroyID != "" {
+		t.Errorf("configuration expiring within the hour = %+v, want it warned only", e)
+	}
+	if e := config("destroyed").Expiry; e.DestroyID != "earlier-destroy" {
+		t.Errorf("configuration destroyed already = %+v, want no new destroy", e)
+	}
+	if e := config("locked").Expiry; e.DestroyID != "" {
+		t.Errorf("locked configuration = %+v, want the destroy left for the next round", e)
+	}
+
+	expired := config("expired").Expiry
+	if expired.DestroyID == "" {
+		t.Fatal("no destroy was queued for the expired configuration")
+	}
+	job, err := store.GetJob(expired.DestroyID)
+	if err != nil || job.Action != "destroy" || job.ConfigName != "expired" || job.State != JobQueued || job.CreatedBy != "ttl" {
+		t.Errorf("destroy of the expired configuration = %+v, %v", job, err)
+	}
+
+	// The next round queues no other destroy
+	expireConfigs(store)
+	if e := config("expired").Expiry; e.DestroyID != expired.DestroyID {
+		t.Errorf("the next round replaced destroy %s with %s", expired.DestroyID, e.DestroyID)
+	}
+	jobs, _ := store.ListJobs(JobQueued)
+	if len(jobs) != 1 {
+		t.Errorf("%d jobs queued, want the one destroy", len(jobs))
+	}
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//VariablesError is returned when the configuration misses required
+//variables or gives values of the wrong type.
+type VariablesError struct {
+	Message  string             `json:"error"`
+	Missing  []string           `json:"missing,omitempty" description:"Required variables without a value"`
+	Mistyped []MistypedVariable `json:"mistyped,omitempty" description:"Variables with a value of the wrong type"`
+}
+
+// MistypedVariable -
+type MistypedVariable struct {
+	Name   string `json:"name" description:"The variable's name"`
+	Type   string `json:"type" description:"The type the configuration declares"`
+	Reason string `json:"reason" description:"What is wrong with the value"`
+}
+
+func (e *VariablesError) Error() string {
+	return e.Message
+}
+
+//typeKind returns the kind of value a type constraint takes: string, number,
+//bool, list or map, "" for any.
+func typeKind(typ string) string {
+	typ = strings.TrimSpace(typ)
+	if i := strings.IndexByte(typ, '('); i >= 0 {
+		typ = typ[:i]
+	}
+	switch strings.TrimSpace(typ) {
+	case "string", "number", "bool":
+		return typ
+	case "list", "set", "tuple":
+		return "list"
+	case "map", "object":
+		return "map"
+	}
+	return ""
+}
+
+//checkVariableType tells why the value of the variable cannot be given to a
+//variable of the type, "" when it can.
+func checkVariableType(v ConfigVariable, typ string) string {
+	kind := typeKind(typ)
+	if kind == "" || v.Type == VarTypeHCL {
+		return ""
+	}
+
+	if v.Type == VarTypeString {
+		switch kind {
+		case "list", "map":
+			return fmt.Sprintf("a string is not a %s", kind)
+		case "number":
+			if _, err := strconv.ParseFloat(v.Value, 64); err != nil && !v.Sensitive {
+				return "the string is not a number"
+			}
+		case "bool":
+			if v.Value != "true" && v.Value != "false" && !v.Sensitive {
+				return "the string is not true or false"
+			}
+		}
+		return ""
+	}
+
+	// The type of a sensitive JSON value is kept in the clear
+	value := v.Value
+	if v.Sensitive {
+		decrypted, err := decryptSecret(v.Value)
+		if err != nil {
+			return ""
+		}
+		value = decrypted
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return ""
+	}
+	given := ""
+	switch decoded.(type) {
+	case nil:
+		return ""
+	case string:
+		given = "string"
+	case float64:
+		given = "number"
+	case bool:
+		given = "bool"
+	case []interface{}:
+		given = "list"
+	case map[string]interface{}:
+		given = "map"
+	}
+	switch {
+	case given == kind:
+		return ""
+	case kind == "string" && (given == "number" || given == "bool"):
+		return ""
+	}
+	return fmt.Sprintf("a %s is not a %s", given, kind)
+}
+
+//checkVariables tells if the variables of the configuration give every
+//required variable of its terraform files a value of the right type. A
+//configuration terraform files we cannot read is not checked.
+func checkVariables(ws Workspace, config ConfigRecord) error {
+	dir := configDir(ws, config)
+	schemas, err := readVariableSchema(dir)
+	if err == nil {
+		var auto map[string]bool
+		auto, err = autoTFVars(dir)
+		if err == nil {
+			return compareVariables(schemas, auto, config.Variables)
+		}
+	}
+	log.Println("Failed to read the variables of "+config.ID+", they are not checked : ", err)
+	return nil
+}
+
+//compareVariables returns a *VariablesError listing the variables missing or
+//mistyped.
+func compareVariables(schemas []VariableSchema, auto map[string]bool, variables []ConfigVariable) error {
+	given := map[string]ConfigVariable{}
+	for _, v := range variables {
+		given[v.Name] = v
+	}
+
+	verr := &VariablesError{}
+	for _, schema := range schemas {
+		v, ok := given[schema.Name]
+		if !ok {
+			if schema.Required && !auto[schema.Name] {
+				verr.Missing = append(verr.Missing, schema.Name)
+			}
+			continue
+		}
+		if reason := checkVariableType(v, schema.Type); reason != "" {
+			verr.Mistyped = append(verr.Mistyped, MistypedVariable{Name: schema.Name, Type: schema.Type, Reason: reason})
+		}
+	}
+	if len(verr.Missing) == 0 && len(verr.Mistyped) == 0 {
+		return nil
+	}
+
+	problems := []string{}
+	if len(verr.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(verr.Missing, ", "))
+	}
+	for _, m := range verr.Mistyped {
+		problems = append(problems, fmt.Sprintf("%s: %s", m.Name, m.Reason))
+	}
+	verr.Message = "invalid variables: " + strings.Join(problems, "; ")
+	return verr
+}
+
+//writeVariablesError writes the error of checkVariables.
+func writeVariablesError(w http.ResponseWriter, err error) {
+	output, _ := json.MarshalIndent(err, "", "  ")
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(400)
+	w.Write(output)
+}
+
+//VariablesHandler handles request to get the variables of the configuration.
+// @Title VariablesHandler
+// @Description Get the variables the terraform files of the configuration declare, with their types, defaults and descriptions.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} VariableSchema
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/variables [get]
+func VariablesHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		if _, err := os.Stat(path.Join(ws.Dir, repoName)); reservedDirs[repoName] || err != nil {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		config, err := jobConfig(store, Job{Tenant: ws.Tenant, ConfigName: repoName})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		dir := configDir(ws, config)
+		schemas, err := readVariableSchema(dir)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		auto, err := autoTFVars(dir)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		given := map[string]bool{}
+		for _, v := range config.Variables {
+			given[v.Name] = true
+		}
+		for i := range schemas {
+			schemas[i].Given = given[schemas[i].Name] || auto[schemas[i].Name]
+		}
+		writeJSON(w, schemas)
+	}
+}
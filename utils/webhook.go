@@ -0,0 +1,612 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//errNoWebhookKey is returned when a webhook is created but its secret
+//cannot be stored.
+var errNoWebhookKey = errors.New("webhooks cannot be created, their secrets need the server started with -masterKey")
+
+//deliveryInterval is how often the deliveries due for a retry are sent.
+var deliveryInterval = 10 * time.Second
+
+//webhookTimeout is how long a webhook has to answer.
+var webhookTimeout = 10 * time.Second
+
+//webhookAttempts is how many times a delivery is tried, waiting
+//webhookBackoff after the first attempt and twice as long after each next
+//one.
+var (
+	webhookAttempts = 6
+	webhookBackoff  = 30 * time.Second
+)
+
+//maxDeliveries is how many deliveries of a webhook the delivery log lists.
+const maxDeliveries = 100
+
+//Delivery statuses
+const (
+	DeliveryPending   = "Pending"
+	DeliveryDelivered = "Delivered"
+	DeliveryFailed    = "Failed"
+)
+
+// Webhook -
+type Webhook struct {
+	Tenant     string    `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName string    `json:"id" description:"Name of the configuration"`
+	WebhookID  string    `json:"webhook_id" description:"ID of the webhook"`
+	URL        string    `json:"url" description:"Where the events are posted"`
+	Secret     string    `json:"secret,omitempty" description:"Key of the HMAC-SHA256 signature of the events, only returned when the webhook is created"`
+	Events     []string  `json:"events,omitempty" description:"The events posted, all if empty"`
+	Enabled    bool      `json:"enabled"`
+	CreatedBy  string    `json:"created_by,omitempty" description:"Who created the webhook"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookRequest -
+type WebhookRequest struct {
+	URL     string   `json:"url,omitempty" description:"Where the events are posted, an http or https URL"`
+	Secret  string   `json:"secret,omitempty" description:"Key of the HMAC-SHA256 signature of the events, a random one if empty"`
+	Events  []string `json:"events,omitempty" description:"The events posted, all if empty"`
+	Enabled *bool    `json:"enabled,omitempty" description:"Whether the events are posted, true if not given"`
+}
+
+// WebhookDelivery -
+type WebhookDelivery struct {
+	Tenant      string            `json:"tenant,omitempty" description:"Tenant of the configuration"`
+	ConfigName  string            `json:"id" description:"Name of the configuration"`
+	WebhookID   string            `json:"webhook_id" description:"ID of the webhook"`
+	DeliveryID  string            `json:"delivery_id" description:"ID of the delivery, sent in the X-Webhook-Delivery header"`
+	URL         string            `json:"url" description:"Where the event is posted"`
+	Event       ActionEvent       `json:"event" description:"The event posted"`
+	Status      string            `json:"status" description:"Pending, Delivered or Failed"`
+	Attempts    []DeliveryAttempt `json:"attempts" description:"The attempts to post the event"`
+	NextAttempt *time.Time        `json:"next_attempt,omitempty" description:"When the event is posted again"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// DeliveryAttempt -
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty" description:"HTTP status of the answer of the webhook"`
+	Error      string    `json:"error,omitempty" description:"Why the attempt failed"`
+	DurationMS int64     `json:"duration_ms" description:"How long the webhook took to answer"`
+}
+
+//WebhookStore keeps the webhooks of the configurations and the log of their
+//deliveries.
+type WebhookStore interface {
+	//InsertWebhook adds the webhook.
+	InsertWebhook(webhook Webhook) error
+	//SaveWebhook replaces the webhook or returns ErrNotFound.
+	SaveWebhook(webhook Webhook) error
+	//GetWebhook returns the webhook of the configuration or ErrNotFound.
+	GetWebhook(tenant, configName, webhookID string) (Webhook, error)
+	//ListWebhooks returns the webhooks of the configuration.
+	ListWebhooks(tenant, configName string) ([]Webhook, error)
+	//DeleteWebhook removes the webhook and its deliveries or returns
+	//ErrNotFound.
+	DeleteWebhook(tenant, configName, webhookID string) error
+
+	//InsertDelivery adds the delivery. The oldest deliveries of the webhook
+	//may be dropped.
+	InsertDelivery(delivery WebhookDelivery) error
+	//SaveDelivery replaces the delivery or returns ErrNotFound.
+	SaveDelivery(delivery WebhookDelivery) error
+	//DeleteDelivery removes the delivery or returns ErrNotFound.
+	DeleteDelivery(deliveryID string) error
+	//ListDeliveries returns the last maxDeliveries deliveries of the
+	//webhook, the newest first.
+	ListDeliveries(tenant, configName, webhookID string) ([]WebhookDelivery, error)
+	//ListDueDeliveries returns the pending deliveries of all the tenants
+	//whose next attempt is not after now.
+	ListDueDeliveries(now time.Time) ([]WebhookDelivery, error)
+	//ClaimDelivery moves the next attempt of the delivery to next. It
+	//returns ErrNotFound when the next attempt is no longer the one of
+	//delivery, another server claimed it.
+	ClaimDelivery(delivery WebhookDelivery, next *time.Time) error
+}
+
+//subscribed tells if the webhook posts the event.
+func (w Webhook) subscribed(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//webhookNotifier posts the events a webhook subscribed to, signed with its
+//secret. The delivery is logged and retried until the webhook takes it.
+type webhookNotifier struct {
+	store   ActionStore
+	webhook Webhook
+}
+
+//Notify records the delivery of the event and posts it.
+func (n webhookNotifier) Notify(event ActionEvent) error {
+	if !n.webhook.subscribed(event.Event) {
+		return nil
+	}
+	// The store may keep the times to the millisecond only
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	delivery := WebhookDelivery{
+		Tenant:      n.webhook.Tenant,
+		ConfigName:  n.webhook.ConfigName,
+		WebhookID:   n.webhook.WebhookID,
+		DeliveryID:  newActionID(),
+		URL:         n.webhook.URL,
+		Event:       event,
+		Status:      DeliveryPending,
+		Attempts:    []DeliveryAttempt{},
+		NextAttempt: &now,
+		CreatedAt:   now,
+	}
+	err := n.store.InsertDelivery(delivery)
+	if err != nil {
+		return err
+	}
+	go deliverWebhook(n.store, delivery)
+	return nil
+}
+
+//StartWebhookDeliveries retries the deliveries of the webhooks as they fall
+//due, including the ones left pending by a server that stopped.
+func StartWebhookDeliveries(store ActionStore) {
+	go func() {
+		for range time.Tick(deliveryInterval) {
+			deliveries, err := store.ListDueDeliveries(time.Now())
+			if err != nil {
+				log.Println("Failed to list the webhook deliveries : ", err)
+				continue
+			}
+			for _, delivery := range deliveries {
+				go deliverWebhook(store, delivery)
+			}
+		}
+	}()
+}
+
+//deliverWebhook makes the next attempt of the delivery. It first moves the
+//next attempt to the time of the retry, so no other server makes the same
+//attempt and a server stopping halfway leaves the delivery to be retried.
+//Each attempt posts to the webhook as it is now, the deliveries of a deleted
+//webhook are dropped.
+func deliverWebhook(store ActionStore, delivery WebhookDelivery) {
+	backoff := webhookBackoff << uint(len(delivery.Attempts))
+	next := time.Now().UTC().Add(backoff).Truncate(time.Millisecond)
+	err := store.ClaimDelivery(delivery, &next)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("Failed to claim the webhook delivery : ", err)
+		return
+	}
+	delivery.NextAttempt = &next
+
+	webhook, err := store.GetWebhook(delivery.Tenant, delivery.ConfigName, delivery.WebhookID)
+	if err == ErrNotFound {
+		err = store.DeleteDelivery(delivery.DeliveryID)
+		if err != nil && err != ErrNotFound {
+			log.Println("Failed to drop the delivery of a deleted webhook : ", err)
+		}
+		return
+	}
+	if err != nil {
+		// The claim leaves the delivery to the next retry
+		log.Println("Failed to get the webhook of the delivery : ", err)
+		return
+	}
+
+	var attempt DeliveryAttempt
+	retry := false
+	if webhook.Enabled {
+		delivery.URL = webhook.URL
+		attempt, retry = postWebhook(webhook, delivery)
+	} else {
+		attempt = DeliveryAttempt{At: time.Now().UTC(), Error: "the webhook was disabled"}
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case attempt.Error == "":
+		delivery.Status = DeliveryDelivered
+		delivery.NextAttempt = nil
+	case !retry || len(delivery.Attempts) >= webhookAttempts:
+		log.Printf("Failed to deliver %s to the webhook %s: %s\n", delivery.DeliveryID, delivery.WebhookID, attempt.Error)
+		delivery.Status = DeliveryFailed
+		delivery.NextAttempt = nil
+	}
+	err = store.SaveDelivery(delivery)
+	if err != nil && err != ErrNotFound {
+		log.Println("Failed to record the webhook delivery : ", err)
+	}
+}
+
+//postWebhook posts the event of the delivery to the webhook. It tells if
+//a failed attempt is worth retrying.
+func postWebhook(webhook Webhook, delivery WebhookDelivery) (DeliveryAttempt, bool) {
+	attempt := DeliveryAttempt{At: time.Now().UTC()}
+	secret, err := decryptSecret(webhook.Secret)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "terraform-provider-ibm-api")
+	req.Header.Set("X-Webhook-Event", delivery.Event.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.DeliveryID)
+	req.Header.Set("X-Webhook-Signature-256", "sha256="+signPayload(secret, body))
+
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	attempt.DurationMS = time.Since(attempt.At).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return attempt, false
+	}
+	attempt.Error = "the webhook answered " + resp.Status
+	// Other client errors will not go away by themselves
+	return attempt, resp.StatusCode >= 500 || resp.StatusCode == 429 || resp.StatusCode == 408
+}
+
+//signPayload returns the hex encoded HMAC-SHA256 of the body with the secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//newWebhookSecret returns a random secret for a webhook created without one.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//checkWebhook checks the URL and the events of the webhook.
+func checkWebhook(w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, it must be an http or https URL", w.URL)
+	}
+	for _, event := range w.Events {
+		if !notifyEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+//deleteWebhooks removes the webhooks of the configuration.
+func deleteWebhooks(store ActionStore, tenant, configName string) error {
+	webhooks, err := store.ListWebhooks(tenant, configName)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		err = store.DeleteWebhook(tenant, configName, webhook.WebhookID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//readWebhookRequest reads the body of a webhook request.
+func readWebhookRequest(r *http.Request) (WebhookRequest, error) {
+	var msg WebhookRequest
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(b, &msg)
+	return msg, err
+}
+
+//withoutSecret returns the webhook without its secret, for the responses.
+func (w Webhook) withoutSecret() Webhook {
+	w.Secret = ""
+	return w
+}
+
+//WebhooksHandler handles request to list the webhooks of the configuration.
+// @Title WebhooksHandler
+// @Description List the webhooks of the configuration.
+// @Param   repo_name     path    string     true "configuration id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} Webhook
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks [get]
+func WebhooksHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+
+		webhooks, err := store.ListWebhooks(RequestTenant(r), repoName)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for i := range webhooks {
+			webhooks[i] = webhooks[i].withoutSecret()
+		}
+		writeJSON(w, webhooks)
+	}
+}
+
+//CreateWebhookHandler handles request to add a webhook to the configuration.
+// @Title CreateWebhookHandler
+// @Description Post the events of the actions of the configuration to a URL, signed with HMAC-SHA256 in the X-Webhook-Signature-256 header. The secret is only returned here.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   body     body     WebhookRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 201 {object} Webhook
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks [post]
+func CreateWebhookHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repoName := vars["repo_name"]
+		ws := requestWorkspace(r)
+
+		if _, err := os.Stat(path.Join(ws.Dir, repoName)); reservedDirs[repoName] || err != nil {
+			http.Error(w, "There is no such configuration.", 404)
+			return
+		}
+		if masterKey == nil {
+			http.Error(w, errNoWebhookKey.Error(), 400)
+			return
+		}
+		msg, err := readWebhookRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		webhook := Webhook{
+			Tenant:     ws.Tenant,
+			ConfigName: repoName,
+			WebhookID:  newActionID(),
+			URL:        msg.URL,
+			Events:     msg.Events,
+			Enabled:    msg.Enabled == nil || *msg.Enabled,
+			CreatedBy:  RequestIdentity(r).Subject,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+		err = checkWebhook(webhook)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		secret := msg.Secret
+		if secret == "" {
+			secret, err = newWebhookSecret()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		webhook.Secret, err = encryptSecret(secret)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = store.InsertWebhook(webhook)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		webhook.Secret = secret
+		output, err := json.MarshalIndent(webhook, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(201)
+		w.Write(output)
+	}
+}
+
+//WebhookHandler handles request to get a webhook of the configuration.
+// @Title WebhookHandler
+// @Description Get the webhook, without its secret.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   webhook_id     path    string     true "webhook id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} Webhook
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks/{webhook_id} [get]
+func WebhookHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		webhook, err := store.GetWebhook(RequestTenant(r), vars["repo_name"], vars["webhook_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such webhook.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, webhook.withoutSecret())
+	}
+}
+
+//UpdateWebhookHandler handles request to update a webhook of the configuration.
+// @Title UpdateWebhookHandler
+// @Description Change the URL, secret, events or enabled flag of the webhook. The fields not given are kept.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   webhook_id     path    string     true "webhook id"
+// @Param   body     body     WebhookRequest   true "request body"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} Webhook
+// @Failure 400 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks/{webhook_id} [patch]
+func UpdateWebhookHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		msg, err := readWebhookRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		webhook, err := store.GetWebhook(RequestTenant(r), vars["repo_name"], vars["webhook_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such webhook.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if msg.URL != "" {
+			webhook.URL = msg.URL
+		}
+		if msg.Events != nil {
+			webhook.Events = msg.Events
+		}
+		if msg.Enabled != nil {
+			webhook.Enabled = *msg.Enabled
+		}
+		webhook.UpdatedAt = time.Now()
+		err = checkWebhook(webhook)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if msg.Secret != "" {
+			webhook.Secret, err = encryptSecret(msg.Secret)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		err = store.SaveWebhook(webhook)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, webhook.withoutSecret())
+	}
+}
+
+//DeleteWebhookHandler handles request to delete a webhook of the configuration.
+// @Title DeleteWebhookHandler
+// @Description Delete the webhook and its delivery log.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   webhook_id     path    string     true "webhook id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} string
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks/{webhook_id} [delete]
+func DeleteWebhookHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		err := store.DeleteWebhook(RequestTenant(r), vars["repo_name"], vars["webhook_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such webhook.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}
+}
+
+//WebhookDeliveriesHandler handles request to get the delivery log of a webhook.
+// @Title WebhookDeliveriesHandler
+// @Description List the last deliveries of the webhook, the newest first, with their attempts.
+// @Param   repo_name     path    string     true "configuration id"
+// @Param   webhook_id     path    string     true "webhook id"
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} WebhookDelivery
+// @Failure 404 {object} string
+// @Failure 500 {object} string
+// @Router /v1/configuration/{repo_name}/webhooks/{webhook_id}/deliveries [get]
+func WebhookDeliveriesHandler(store ActionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		tenant := RequestTenant(r)
+
+		_, err := store.GetWebhook(tenant, vars["repo_name"], vars["webhook_id"])
+		if err == ErrNotFound {
+			http.Error(w, "There is no such webhook.", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		deliveries, err := store.ListDeliveries(tenant, vars["repo_name"], vars["webhook_id"])
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, deliveries)
+	}
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		secret string
+		body   string
+		want   string
+	}{
+		{secret: "It's a Secret to Everybody", body: "Hello, World!", want: "757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"},
+		{secret: "key", body: "The quick brown fox jumps over the lazy dog", want: "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	}
+	for _, tt := range tests {
+		got := signPayload(tt.secret, []byte(tt.body))
+		if got != tt.want {
+			t.Errorf("signPayload(%q, %q) = %s, want %s", tt.secret, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	defer func(previous []byte) { masterKey = previous }(masterKey)
+	masterKey = make([]byte, 32)
+
+	status := 200
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	secret, err := encryptSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := Webhook{Tenant: "t", ConfigName: "config", WebhookID: "w1", URL: server.URL, Secret: secret, Enabled: true}
+	delivery := WebhookDelivery{
+		Tenant:     "t",
+		ConfigName: "config",
+		WebhookID:  "w1",
+		DeliveryID: "d1",
+		Event:      ActionEvent{Event: EventCompleted, ConfigName: "config", ActionID: "a1", Status: StatusCompleted},
+		Status:     DeliveryPending,
+	}
+
+	tests := []struct {
+		name      string
+		status    int
+		wantError bool
+		wantRetry bool
+	}{
+		{name: "delivered", status: 200},
+		{name: "accepted", status: 202},
+		{name: "server error", status: 500, wantError: true, wantRetry: true},
+		{name: "too many requests", status: 429, wantError: true, wantRetry: true},
+		{name: "request timeout", status: 408, wantError: true, wantRetry: true},
+		{name: "not found", status: 404, wantError: true},
+	}
+	for _, tt := range tests {
+		status = tt.status
+		got = nil
+		attempt, retry := postWebhook(webhook, delivery)
+		if (attempt.Error != "") != tt.wantError || retry != tt.wantRetry {
+			t.Errorf("%s: attempt %+v retry %v, want error %v retry %v", tt.name, attempt, retry, tt.wantError, tt.wantRetry)
+		}
+		if got == nil {
+			continue
+		}
+
+		// The receiver can check the signature with the secret
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		signature := got.Header.Get("X-Webhook-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") || !hmac.Equal([]byte(signature[len("sha256="):]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			t.Errorf("%s: invalid signature %q", tt.name, signature)
+		}
+		if got.Header.Get("X-Webhook-Event") != EventCompleted || got.Header.Get("X-Webhook-Delivery") != "d1" {
+			t.Errorf("%s: headers %v", tt.name, got.Header)
+		}
+		var event ActionEvent
+		if err := json.Unmarshal(body, &event); err != nil || event.ActionID != "a1" {
+			t.Errorf("%s: body %s", tt.name, body)
+		}
+		if attempt.StatusCode != tt.status {
+			t.Errorf("%s: status code %d, want %d", tt.name, attempt.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	defer func(previous []byte) { masterKey = previous }(masterKey)
+	masterKey = make([]byte, 32)
+
+	posted := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.URL.Path
+	}))
+	defer server.Close()
+	secret, err := encryptSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		update     func(store *MemoryStore, webhook Webhook, delivery WebhookDelivery)
+		wantPosted string
+		wantStatus string
+		wantGone   bool
+	}{
+		{name: "posted", update: func(*MemoryStore, Webhook, WebhookDelivery) {}, wantPosted: "/old", wantStatus: DeliveryDelivered},
+		{name: "posted to the new URL", update: func(store *MemoryStore, webhook Webhook, delivery WebhookDelivery) {
+			webhook.URL = server.URL + "/new"
+			store.SaveWebhook(webhook)
+		}, wantPosted: "/new", wantStatus: DeliveryDelivered},
+		{name: "disabled", update: func(store *MemoryStore, webhook Webhook, delivery WebhookDelivery) {
+			webhook.Enabled = false
+			store.SaveWebhook(webhook)
+		}, wantStatus: DeliveryFailed},
+		{name: "deleted", update: func(store *MemoryStore, webhook Webhook, delivery WebhookDelivery) {
+			// A delivery left over by the deletion is dropped
+			store.DeleteWebhook(webhook.Tenant, webhook.ConfigName, webhook.WebhookID)
+			store.InsertDelivery(delivery)
+		}, wantGone: true},
+	}
+	for _, tt := range tests {
+		store := NewMemoryStore()
+		webhook := Webhook{Tenant: "t", ConfigName: "config", WebhookID: "w1", URL: server.URL + "/old", Secret: secret, Enabled: true}
+		store.InsertWebhook(webhook)
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		delivery := WebhookDelivery{
+			Tenant:      "t",
+			ConfigName:  "config",
+			WebhookID:   "w1",
+			DeliveryID:  "d1",
+			URL:         webhook.URL,
+			Event:       ActionEvent{Event: EventCompleted},
+			Status:      DeliveryPending,
+			NextAttempt: &now,
+		}
+		store.InsertDelivery(delivery)
+		tt.update(store, webhook, delivery)
+
+		deliverWebhook(store, delivery)
+		select {
+		case path := <-posted:
+			if path != tt.wantPosted {
+				t.Errorf("%s: posted to %s, want %s", tt.name, path, tt.wantPosted)
+			}
+		default:
+			if tt.wantPosted != "" {
+				t.Errorf("%s: nothing was posted", tt.name)
+			}
+		}
+		deliveries, _ := store.ListDeliveries("t", "config", "w1")
+		if tt.wantGone {
+			if len(deliveries) != 0 {
+				t.Errorf("%s: the delivery was kept: %+v", tt.name, deliveries)
+			}
+			continue
+		}
+		if len(deliveries) != 1 || deliveries[0].Status != tt.wantStatus || len(deliveries[0].Attempts) != 1 {
+			t.Errorf("%s: deliveries %+v, want one %s after one attempt", tt.name, deliveries, tt.wantStatus)
+		}
+	}
+}
+
+func TestWebhookSubscribed(t *testing.T) {
+	tests := []struct {
+		events []string
+		event  string
+		want   bool
+	}{
+		{events: nil, event: EventQueued, want: true},
+		{events: nil, event: EventDriftDetected, want: true},
+		{events: []string{EventFailed, EventTimedOut}, event: EventTimedOut, want: true},
+		{events: []string{EventFailed}, event: EventCompleted, want: false},
+	}
+	for _, tt := range tests {
+		got := Webhook{Events: tt.events}.subscribed(tt.event)
+		if got != tt.want {
+			t.Errorf("subscribed(%s) with %v = %v, want %v", tt.event, tt.events, got, tt.want)
+		}
+	}
+}
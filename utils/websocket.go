@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//websocketGUID is the magic value of RFC 6455 used to compute Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+//wsConn is a minimal server side WebSocket connection. It only sends text
+//messages, the messages of the client are read to answer pings and to notice
+//when the client goes away.
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+//upgradeWebSocket does the opening handshake and takes over the connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket handshake")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("the connection does not support websocket")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &wsConn{conn: conn, rw: rw, closed: make(chan struct{})}
+	go ws.readLoop()
+	return ws, nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	n := len(payload)
+	switch {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+//WriteText sends a text message.
+func (ws *wsConn) WriteText(message []byte) error {
+	return ws.writeFrame(wsText, message)
+}
+
+//Close sends a close frame and closes the connection.
+func (ws *wsConn) Close() {
+	ws.writeFrame(wsClose, []byte{0x03, 0xE8})
+	ws.conn.Close()
+}
+
+//readLoop reads the frames of the client until it closes the connection.
+func (ws *wsConn) readLoop() {
+	defer close(ws.closed)
+	for {
+		var head [2]byte
+		_, err := io.ReadFull(ws.rw, head[:])
+		if err != nil {
+			return
+		}
+		opcode := head[0] & 0x0F
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			_, err = io.ReadFull(ws.rw, ext[:])
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			_, err = io.ReadFull(ws.rw, ext[:])
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if err != nil {
+			return
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			_, err = io.ReadFull(ws.rw, mask[:])
+			if err != nil {
+				return
+			}
+		}
+		if length > 1<<20 {
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(ws.rw, payload)
+		if err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			return
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+		}
+	}
+}
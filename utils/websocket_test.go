@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//readFrame reads a frame sent by the server, which never masks them.
+func readFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head[0]&0x80 == 0 {
+		t.Errorf("frame without FIN bit: %x", head[0])
+	}
+	if head[1]&0x80 != 0 {
+		t.Errorf("masked frame from the server")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+//maskedFrame returns a frame as a client sends it, masked.
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocket(t *testing.T) {
+	messages := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("a"), 125),
+		bytes.Repeat([]byte("b"), 126),
+		bytes.Repeat([]byte("c"), 0xFFFF),
+		bytes.Repeat([]byte("d"), 0x10000),
+	}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			http.Error(w, "not a websocket", 400)
+			return
+		}
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, message := range messages {
+			ws.WriteText(message)
+		}
+		// Wait for the close of the client
+		select {
+		case <-ws.closed:
+		case <-time.After(5 * time.Second):
+			t.Error("the close of the client was not read")
+		}
+		ws.Close()
+		close(done)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// The handshake of RFC 6455
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake answered %s with accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	for _, want := range messages {
+		opcode, payload := readFrame(t, r)
+		if opcode != wsText || !bytes.Equal(payload, want) {
+			t.Errorf("frame %x of %d bytes, want a text frame of %d bytes", opcode, len(payload), len(want))
+		}
+	}
+
+	// A ping is answered with a pong of the same payload
+	conn.Write(maskedFrame(wsPing, []byte("ping!")))
+	opcode, payload := readFrame(t, r)
+	if opcode != wsPong || string(payload) != "ping!" {
+		t.Errorf("answer to the ping: %x %q", opcode, payload)
+	}
+
+	conn.Write(maskedFrame(wsClose, []byte{0x03, 0xE8}))
+	opcode, _ = readFrame(t, r)
+	if opcode != wsClose {
+		t.Errorf("answer to the close: %x", opcode)
+	}
+	<-done
+}
+
+func TestUpgradeWebSocketRejectsBadHandshakes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+	}{
+		{name: "no key", header: map[string]string{"Sec-WebSocket-Version": "13"}},
+		{name: "old version", header: map[string]string{"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version": "8"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		_, err := upgradeWebSocket(httptest.NewRecorder(), r)
+		if err == nil {
+			t.Errorf("%s: the handshake was accepted", tt.name)
+		}
+	}
+}
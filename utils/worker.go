@@ -0,0 +1,426 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var jobPollInterval = 5 * time.Second
+var jobRecoverInterval = time.Minute
+
+//workerHeartbeat is how often the server records that its workers are
+//alive, workerTimeout how long after the last heartbeat the jobs of a server
+//are put back in the queue.
+var (
+	workerHeartbeat = 30 * time.Second
+	workerTimeout   = 5 * time.Minute
+)
+
+//bootID tells this run of the server apart from the earlier ones with the
+//same hostname and pid, such as PID 1 of a restarted container.
+var bootID = newActionID()
+
+//StartWorkers starts n workers draining the job queue. Jobs left running by
+//a server that is gone, e.g. after a restart, are put back in the queue.
+func StartWorkers(store ActionStore, n int) {
+	owner := workerOwner()
+	heartbeat(store)
+	recoverJobs(store)
+	go func() {
+		for range time.Tick(workerHeartbeat) {
+			heartbeat(store)
+		}
+	}()
+	go func() {
+		for range time.Tick(jobRecoverInterval) {
+			recoverJobs(store)
+			expireApprovals(store)
+			expireConfigs(store)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		go worker(store, owner)
+	}
+	log.Printf("Started %d workers as %s\n", n, owner)
+}
+
+//workerOwner returns the owner of the jobs run by this server:
+//hostname:pid:boot.
+func workerOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), bootID)
+}
+
+//heartbeat records that the workers of this server are alive.
+func heartbeat(store ActionStore) {
+	err := store.Heartbeat(workerOwner(), time.Now().UTC())
+	if err != nil {
+		log.Println("Failed to record the heartbeat of the workers : ", err)
+	}
+}
+
+//ownerAlive tells if the owner of a running job is a live server: this one,
+//or one with a recent heartbeat whose process is still there if it is on
+//this host. The owners of older servers, hostname:pid, have no heartbeat,
+//they are alive while their process on this host is and cannot be told
+//about on other hosts.
+func ownerAlive(owner string, live map[string]bool) bool {
+	if owner == workerOwner() {
+		return true
+	}
+	hostname, _ := os.Hostname()
+	parts := strings.Split(owner, ":")
+	if len(parts) == 2 && parts[0] != hostname {
+		return true
+	}
+	if len(parts) < 2 || parts[0] != hostname {
+		return live[owner]
+	}
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil || pid == os.Getpid() || syscall.Kill(pid, 0) == syscall.ESRCH {
+		return false
+	}
+	return len(parts) == 2 || live[owner]
+}
+
+//recoverJobs requeues the running jobs whose owner is not a live server.
+func recoverJobs(store ActionStore) {
+	live, err := store.LiveOwners(time.Now().UTC().Add(-workerTimeout))
+	if err != nil {
+		log.Println("Failed to list the live workers : ", err)
+		return
+	}
+	jobs, err := store.ListJobs(JobRunning)
+	if err != nil {
+		log.Println("Failed to list the running jobs : ", err)
+		return
+	}
+	for _, job := range jobs {
+		if ownerAlive(job.Owner, live) {
+			continue
+		}
+		log.Printf("Requeue %s %s left running by %s\n", job.Action, job.ActionID, job.Owner)
+		err = store.RequeueJob(job.ActionID, job.Owner)
+		if err != nil {
+			log.Println("Failed to requeue the job : ", err)
+			continue
+		}
+		store.UpdateActionStatus(job.ActionID, StatusQueued)
+		wakeWorkers()
+	}
+}
+
+//workers tracks the jobs of the workers so the server can stop them:
+//stopping is closed once the workers take no more jobs, running counts the
+//jobs they hold.
+var workers = struct {
+	sync.Mutex
+	stopping chan struct{}
+	running  sync.WaitGroup
+}{stopping: make(chan struct{})}
+
+//beginWork counts a job the worker is about to claim, unless the server is
+//stopping.
+func beginWork() bool {
+	workers.Lock()
+	defer workers.Unlock()
+	select {
+	case <-workers.stopping:
+		return false
+	default:
+	}
+	workers.running.Add(1)
+	return true
+}
+
+//StopWorkers stops the workers from taking jobs and waits for the ones they
+//run. The actions still running after the timeout are cancelled, so no
+//terraform process outlives the server.
+func StopWorkers(timeout time.Duration) {
+	workers.Lock()
+	close(workers.stopping)
+	workers.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		workers.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	log.Println("Cancelling the actions still running")
+	cancelRuns()
+	<-done
+}
+
+func worker(store ActionStore, owner string) {
+	for beginWork() {
+		job, err := store.ClaimJob(owner)
+		if err != nil {
+			workers.running.Done()
+			if err != ErrNotFound {
+				log.Println("Failed to claim a job : ", err)
+			}
+			select {
+			case <-jobNotify:
+			case <-workers.stopping:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		workJob(store, job)
+		workers.running.Done()
+	}
+}
+
+//workJob runs the job claimed by the worker and finishes it. The run is
+//registered until the job is finished, so it can be cancelled all along.
+func workJob(store ActionStore, job Job) {
+	startRun(job.ActionID)
+	defer endRun(job.ActionID)
+	stop := make(chan struct{})
+	go watchCancel(store, job.ActionID, stop)
+
+	runJob(store, job)
+	close(stop)
+	if lockingActions[job.Action] {
+		unlockConfig(store, job.Tenant, job.ConfigName, job.ActionID)
+	}
+	err := store.FinishJob(job.ActionID)
+	if err != nil {
+		log.Println("Failed to finish the job : ", err)
+	}
+}
+
+//runJob runs the terraform action of the job and records the outcome.
+func runJob(store ActionStore, job Job) {
+	var statusResponse StatusResponse
+
+	err := startAction(store, job.ActionID)
+	if err != nil {
+		log.Println("Failed to update the action status : ", err)
+	}
+
+	// Tell that the action has started and link the logs
+	notify(store, job, EventStarted, "")
+
+	err = runAction(store, job)
+	if err == ErrCancelled {
+		err = endAction(store, job.ActionID, StatusCancelled, "")
+		if err != nil {
+			log.Println("Failed to update the action status : ", err)
+		}
+		notify(store, job, EventCancelled, "")
+		return
+	}
+	if err != nil {
+		statusResponse.Error = err.Error()
+		statusResponse.Status = StatusFailed
+		if err == ErrTimedOut {
+			statusResponse.Status = StatusTimedOut
+		}
+
+		// Update the status in the db in case it is failed
+		err = endAction(store, job.ActionID, statusResponse.Status, statusResponse.Error)
+		if err != nil {
+			log.Println("Failed to update the action status : ", err)
+		}
+		notify(store, job, statusEvents[statusResponse.Status], "")
+		return
+	}
+	statusResponse.Status = StatusCompleted
+
+	// Update the status in the db in case it is completed
+	err = endAction(store, job.ActionID, statusResponse.Status, "")
+	if err != nil {
+		log.Println("Failed to update the action status : ", err)
+	}
+	notify(store, job, EventCompleted, "")
+}
+
+//runAction checks out the ref of the configuration, or the one asked for by
+//the job, and runs the terraform commands of the action.
+func runAction(store ActionStore, job Job) error {
+	ws := tenantWorkspace(job.Tenant)
+	repoName := job.ConfigName
+
+	config, err := jobConfig(store, job)
+	if err != nil {
+		return err
+	}
+	auth, err := newGitAuth(config.Credentials)
+	if err != nil {
+		return err
+	}
+	defer auth.close()
+	secrets, err := config.sensitiveValues()
+	if err != nil {
+		return err
+	}
+	confDir := configDir(ws, config)
+	ref := config.Ref
+	if job.Ref != "" {
+		ref = job.Ref
+	}
+
+	switch job.Action {
+	case "plan":
+		err = checkoutConfig(auth, ws, config, ref, job.ActionID)
+		if err == nil {
+			err = recordRevision(store, ws, job.ActionID, repoName)
+		}
+		if err == nil {
+			err = TerraformPlan(confDir, ws.StateDir, ws.LogDir, planFile(ws, job.ActionID), repoName, secrets, &planTimeOut, job.ActionID)
+		}
+		if err == nil {
+			err = savePlanSummary(store, ws, confDir, job.ActionID)
+		}
+		if err != nil {
+			removePlanFile(ws, job.ActionID)
+		}
+	case "apply":
+		if job.PlanActionID != "" {
+			// Apply exactly what was planned, so no checkout
+			err = checkSavedPlan(store, ws, repoName, job.PlanActionID)
+			if err == nil {
+				err = initConfig(ws, config, job.ActionID)
+			}
+			if err == nil {
+				err = recordRevision(store, ws, job.ActionID, repoName)
+			}
+			if err == nil {
+				err = TerraformApplyPlan(confDir, ws.StateDir, ws.LogDir, planFile(ws, job.PlanActionID), repoName, secrets, &planTimeOut, job.ActionID)
+				// The plan is used up even when its apply failed
+				removePlanFile(ws, job.PlanActionID)
+			}
+			if _, ok := err.(*StalePlanError); ok {
+				removePlanFile(ws, job.PlanActionID)
+			}
+			if err == nil {
+				recordStateVersion(store, ws, job)
+				recordOutputs(store, ws, config, job.ActionID)
+				removePlanFiles(store, ws, repoName)
+				if job.TTL != "" {
+					recordExpiry(store, job)
+				}
+			}
+			break
+		}
+		err = checkoutConfig(auth, ws, config, ref, job.ActionID)
+		if err == nil {
+			err = recordRevision(store, ws, job.ActionID, repoName)
+		}
+		if err == nil {
+			err = TerraformApply(confDir, ws.StateDir, ws.LogDir, repoName, secrets, &planTimeOut, job.ActionID)
+		}
+		if err == nil {
+			recordStateVersion(store, ws, job)
+			recordOutputs(store, ws, config, job.ActionID)
+			removePlanFiles(store, ws, repoName)
+			if job.TTL != "" {
+				recordExpiry(store, job)
+			}
+		}
+	case "destroy":
+		err = checkoutConfig(auth, ws, config, ref, job.ActionID)
+		if err == nil {
+			err = recordRevision(store, ws, job.ActionID, repoName)
+		}
+		if err == nil {
+			err = TerraformDestroy(confDir, ws.StateDir, ws.LogDir, repoName, secrets, &planTimeOut, job.ActionID)
+		}
+		if err == nil {
+			recordStateVersion(store, ws, job)
+			removePlanFiles(store, ws, repoName)
+			clearExpiry(store, job)
+		}
+	case "drift":
+		err = checkoutConfig(auth, ws, config, ref, job.ActionID)
+		if err == nil {
+			err = recordRevision(store, ws, job.ActionID, repoName)
+		}
+		if err == nil {
+			err = runDrift(store, ws, confDir, secrets, job)
+		}
+	case "show":
+		err = initConfig(ws, config, job.ActionID)
+		if err == nil {
+			err = recordRevision(store, ws, job.ActionID, repoName)
+		}
+		if err == nil {
+			err = TerraformShow(confDir, ws.StateDir, ws.LogDir, repoName, secrets, &planTimeOut, job.ActionID)
+		}
+	default:
+		err = fmt.Errorf("unknown action %s", job.Action)
+	}
+	return err
+}
+
+//checkoutConfig checks out the ref in the repo of the configuration and
+//initializes terraform again.
+func checkoutConfig(auth *gitAuth, ws Workspace, config ConfigRecord, ref, actionID string) error {
+	_, err := checkoutRepo(auth, path.Join(ws.Dir, config.ID), ref)
+	if err != nil {
+		return err
+	}
+	return initConfig(ws, config, actionID)
+}
+
+//initConfig writes the backend override of the configuration and runs
+//terraform init before each action: the ref checked out may change the
+//modules, the providers or the backend, and the configuration may have been
+//cloned before the server was its state backend.
+func initConfig(ws Workspace, config ConfigRecord, actionID string) error {
+	confDir := configDir(ws, config)
+	err := writeBackendOverride(confDir, config)
+	if err != nil {
+		return err
+	}
+	return TerraformInit(confDir, ws.LogDir, config.ID, &planTimeOut, actionID)
+}
+
+//recordOutputs records the outputs on the apply action. The apply has
+//succeeded anyway, so a failure is only logged.
+func recordOutputs(store ActionStore, ws Workspace, config ConfigRecord, actionID string) {
+	err := saveOutputs(store, ws, config, actionID)
+	if err != nil {
+		log.Println("Failed to record the outputs : ", err)
+	}
+}
+
+//startAction records the action as in progress from now.
+func startAction(store ActionStore, actionID string) error {
+	actionResponse, err := store.GetAction(actionID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	actionResponse.Status = StatusInProgress
+	actionResponse.StartedAt = &now
+	return store.SaveAction(actionResponse)
+}
+
+//endAction records the action as ended with the status, and the reason it
+//failed.
+func endAction(store ActionStore, actionID, status, reason string) error {
+	actionResponse, err := store.GetAction(actionID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	actionResponse.Status = status
+	actionResponse.Error = reason
+	actionResponse.FinishedAt = &now
+	return store.SaveAction(actionResponse)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOwnerAlive(t *testing.T) {
+	hostname, _ := os.Hostname()
+	// The parent of the test is a live process of this host
+	other := os.Getppid()
+	tests := []struct {
+		name  string
+		owner string
+		live  map[string]bool
+		want  bool
+	}{
+		{name: "this server", owner: workerOwner(), want: true},
+		{name: "earlier boot with the same pid", owner: fmt.Sprintf("%s:%d:earlier", hostname, os.Getpid()), live: map[string]bool{fmt.Sprintf("%s:%d:earlier", hostname, os.Getpid()): true}},
+		{name: "live server of this host", owner: fmt.Sprintf("%s:%d:b", hostname, other), live: map[string]bool{fmt.Sprintf("%s:%d:b", hostname, other): true}, want: true},
+		{name: "process of this host without heartbeat", owner: fmt.Sprintf("%s:%d:b", hostname, other)},
+		{name: "server of another host", owner: "elsewhere:1:b", live: map[string]bool{"elsewhere:1:b": true}, want: true},
+		{name: "server of another host without heartbeat", owner: "elsewhere:1:b"},
+		{name: "older server of this host", owner: fmt.Sprintf("%s:%d", hostname, other), want: true},
+		{name: "older server of this host that is gone", owner: fmt.Sprintf("%s:%d", hostname, os.Getpid())},
+		{name: "older server of another host", owner: "elsewhere:1", want: true},
+		{name: "no owner", owner: ""},
+	}
+	for _, tt := range tests {
+		got := ownerAlive(tt.owner, tt.live)
+		if got != tt.want {
+			t.Errorf("%s: ownerAlive(%s) = %v, want %v", tt.name, tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	hostname, _ := os.Hostname()
+	store := NewMemoryStore()
+	owners := map[string]string{
+		"mine":      workerOwner(),
+		"restarted": fmt.Sprintf("%s:%d:earlier", hostname, os.Getpid()),
+		"remote":    "elsewhere:1:b",
+		"gone":      "elsewhere:2:b",
+	}
+	for id, owner := range owners {
+		store.InsertAction(ActionResponse{ActionID: id, Status: StatusInProgress})
+		store.EnqueueJob(Job{ActionID: id, ConfigName: "config", Action: "plan", State: JobQueued, EnqueuedAt: time.Now()})
+		_, err := store.ClaimJob(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Heartbeat("elsewhere:1:b", time.Now().UTC())
+	store.Heartbeat("elsewhere:2:b", time.Now().UTC().Add(-2*workerTimeout))
+
+	recoverJobs(store)
+	for id, want := range map[string]string{"mine": JobRunning, "restarted": JobQueued, "remote": JobRunning, "gone": JobQueued} {
+		job, _ := store.GetJob(id)
+		if job.State != want {
+			t.Errorf("job of %s is %s, want %s", owners[id], job.State, want)
+		}
+	}
+}